@@ -7,11 +7,14 @@ import (
 	"fmt"
 	"github.com/evilsocket/islazy/log"
 	"github.com/evilsocket/pwngrid/crypto"
+	"github.com/evilsocket/pwngrid/metrics"
 	"github.com/evilsocket/pwngrid/models"
 	"github.com/evilsocket/pwngrid/utils"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
@@ -25,6 +28,28 @@ const (
 	Endpoint = "https://api.pwnagotchi.ai/api/v1"
 )
 
+var (
+	requestLatency = metrics.NewHistogram("pwngrid_client_request_duration_seconds", "Latency of the requests to the server.", nil, "method", "endpoint")
+	requestErrors  = metrics.NewCounter("pwngrid_client_request_errors_total", "Failed requests to the server.", "method", "endpoint")
+	tokenRefreshes = metrics.NewCounter("pwngrid_client_token_refreshes_total", "API token refreshes.")
+
+	idParser = regexp.MustCompile(`^([a-fA-F0-9]{64}|[0-9]+)$`)
+)
+
+// replaces fingerprints and numeric ids in a request path so that it can be used as a metric label
+func endpointOf(path string) string {
+	if idx := strings.IndexByte(path, '?'); idx != -1 {
+		path = path[:idx]
+	}
+	parts := strings.Split(path, "/")
+	for idx, part := range parts {
+		if idParser.MatchString(part) {
+			parts[idx] = ":id"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
 type Client struct {
 	sync.Mutex
 
@@ -96,6 +121,7 @@ func (c *Client) enroll() error {
 
 	c.tokenAt = time.Now()
 	c.token = obj["token"].(string)
+	tokenRefreshes.Inc()
 	log.Debug("new token: %s", c.token)
 
 	if raw, err := json.Marshal(obj); err == nil {
@@ -114,7 +140,13 @@ func (c *Client) request(method string, path string, data interface{}, auth bool
 	url := fmt.Sprintf("%s%s", Endpoint, path)
 	err := (error)(nil)
 	started := time.Now()
+	endpoint := endpointOf(path)
 	defer func() {
+		requestLatency.Observe(time.Since(started).Seconds(), method, endpoint)
+		if err != nil {
+			requestErrors.Inc(method, endpoint)
+		}
+
 		if err == nil {
 			log.Debug("%s %s (%s)", method, url, time.Since(started))
 		} else {
@@ -136,7 +168,7 @@ func (c *Client) request(method string, path string, data interface{}, auth bool
 
 	if auth {
 		if time.Since(c.tokenAt) >= models.TokenTTL {
-			if err := c.enroll(); err != nil {
+			if err = c.enroll(); err != nil {
 				return nil, err
 			}
 		}
@@ -211,6 +243,10 @@ func (c *Client) ReportAP(report interface{}) (map[string]interface{}, error) {
 	return c.Post("/unit/report/ap", report, true)
 }
 
+func (c *Client) ReportEncounters(proofs interface{}) (map[string]interface{}, error) {
+	return c.Post("/unit/report/encounters", proofs, true)
+}
+
 func (c *Client) Inbox(page int) (map[string]interface{}, error) {
 	return c.Get(fmt.Sprintf("/unit/inbox/?p=%d", page), true)
 }
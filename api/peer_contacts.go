@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/mesh"
+	"github.com/go-chi/chi"
+	"io/ioutil"
+	"net/http"
+)
+
+// GET /api/v1/mesh/contacts
+func (api *API) PeerGetContacts(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Mesh.Contacts().List())
+}
+
+// POST /api/v1/mesh/contacts
+func (api *API) PeerAddContact(w http.ResponseWriter, r *http.Request) {
+	var contact mesh.Contact
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	log.Debug("%s", body)
+
+	if err = json.Unmarshal(body, &contact); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	} else if err = api.Mesh.Contacts().Add(contact); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// DELETE /api/v1/mesh/contacts/<fingerprint>
+func (api *API) PeerDelContact(w http.ResponseWriter, r *http.Request) {
+	fingerprint := chi.URLParam(r, "fingerprint")
+	if found, err := api.Mesh.Contacts().Remove(fingerprint); err != nil {
+		ERROR(w, http.StatusInternalServerError, err)
+		return
+	} else if !found {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
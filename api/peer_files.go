@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/evilsocket/islazy/log"
+	"github.com/go-chi/chi"
+	"io/ioutil"
+	"net/http"
+)
+
+type fileOfferRequest struct {
+	// name of the file in the share folder
+	Path string `json:"path"`
+	// fingerprint of the recipient, empty for everyone
+	To string `json:"to"`
+}
+
+// GET /api/v1/mesh/files
+func (api *API) PeerGetFiles(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Mesh.Files())
+}
+
+// GET /api/v1/mesh/files/<id>
+func (api *API) PeerGetFile(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	transfer := api.Mesh.Files().Of(id)
+	if transfer == nil {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+	JSON(w, http.StatusOK, transfer)
+}
+
+// POST /api/v1/mesh/files
+func (api *API) PeerOfferFile(w http.ResponseWriter, r *http.Request) {
+	var req fileOfferRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	log.Debug("%s", body)
+
+	if err = json.Unmarshal(body, &req); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	offer, err := api.Mesh.Files().Offer(req.Path, req.To)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, offer)
+}
+
+// DELETE /api/v1/mesh/files/<id>
+func (api *API) PeerDelFile(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if found, err := api.Mesh.Files().Remove(id); err != nil {
+		ERROR(w, http.StatusInternalServerError, err)
+		return
+	} else if !found {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
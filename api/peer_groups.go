@@ -0,0 +1,324 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/crypto"
+	"github.com/evilsocket/pwngrid/mesh"
+	"github.com/go-chi/chi"
+	"io/ioutil"
+	"net/http"
+)
+
+type groupRequest struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+type groupMemberRequest struct {
+	Fingerprint string `json:"fingerprint"`
+}
+
+type groupPostRequest struct {
+	Data string `json:"data"`
+	// if true the post is also relayed to every member via the server
+	Server bool `json:"server"`
+}
+
+// group messages relayed via the server are wrapped in this envelope inside the inbox message
+type groupEnvelope struct {
+	Group *mesh.Message `json:"pwngrid_group"`
+}
+
+func (api *API) relayGroupMessage(fingerprint string, msg *mesh.Message) error {
+	data, err := json.Marshal(groupEnvelope{Group: msg})
+	if err != nil {
+		return err
+	}
+	_, err = api.SendMessage(fingerprint, data)
+	return err
+}
+
+func (api *API) unitKeys(fingerprint string) (*crypto.KeyPair, error) {
+	unit, err := api.Client.Unit(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, ok := unit["public_key"].(string)
+	if !ok {
+		return nil, fmt.Errorf("unit %s has no public key", fingerprint)
+	}
+	return crypto.FromPublicPEM(pubKey)
+}
+
+// sends the current key of a group we own via the server to the members that didn't acknowledge it yet
+func (api *API) distributeGroupKey(id string) {
+	groups := api.Mesh.Groups()
+	for _, member := range groups.Pending(id) {
+		keys, err := api.unitKeys(member)
+		if err != nil {
+			log.Debug("error getting public key of %s: %v", member, err)
+			continue
+		}
+
+		msg, err := groups.KeyMessageFor(id, member, keys)
+		if err != nil {
+			log.Debug("error creating key message of group %s for %s: %v", id, member, err)
+		} else if err = api.relayGroupMessage(member, msg); err != nil {
+			log.Debug("error sending key of group %s to %s via server: %v", id, member, err)
+		}
+	}
+}
+
+// processes the group messages received in the server inbox since the last check
+func (api *API) SyncGroups() error {
+	groups := api.Mesh.Groups()
+	cursor := groups.Cursor()
+
+	box, err := api.Client.Inbox(1)
+	if err != nil {
+		return err
+	}
+
+	messages, ok := box["messages"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	maxID := cursor
+	for _, m := range messages {
+		obj, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		id, ok := obj["id"].(float64)
+		if !ok {
+			log.Debug("skipping inbox message without a valid id: %v", obj)
+			continue
+		}
+
+		msgID := int(id)
+		if msgID <= cursor {
+			continue
+		} else if msgID > maxID {
+			maxID = msgID
+		}
+
+		// group messages are marked as seen once processed, don't decrypt them again if the cursor got lost
+		if obj["seen_at"] != nil {
+			continue
+		}
+
+		message, _, err := api.InboxMessage(msgID)
+		if err != nil {
+			log.Debug("error reading message %d: %v", msgID, err)
+			continue
+		}
+
+		data, _ := message["data"].([]byte)
+		sender, _ := message["sender"].(string)
+
+		var envelope groupEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil || envelope.Group == nil || sender == "" {
+			// not a group message
+			continue
+		}
+
+		keys, err := api.unitKeys(sender)
+		if err != nil {
+			log.Debug("error getting public key of %s: %v", sender, err)
+			continue
+		}
+
+		if reply, err := groups.Receive(sender, keys, envelope.Group, mesh.GroupViaServer); err != nil {
+			log.Debug("error processing group message %d from %s: %v", msgID, sender, err)
+		} else if reply != nil {
+			if err = api.relayGroupMessage(sender, reply); err != nil {
+				log.Debug("error replying to %s via server: %v", sender, err)
+			}
+		}
+
+		// group messages are not meant for humans
+		if _, err := api.Client.MarkInboxMessage(msgID, "seen"); err != nil {
+			log.Debug("error marking message %d as seen: %v", msgID, err)
+		}
+	}
+
+	return groups.SetCursor(maxID)
+}
+
+// GET /api/v1/mesh/groups
+func (api *API) PeerGetGroups(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Mesh.Groups().List())
+}
+
+// GET /api/v1/mesh/groups/<id>
+func (api *API) PeerGetGroup(w http.ResponseWriter, r *http.Request) {
+	group := api.Mesh.Groups().Of(chi.URLParam(r, "id"))
+	if group == nil {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+	JSON(w, http.StatusOK, group)
+}
+
+// POST /api/v1/mesh/groups
+func (api *API) PeerCreateGroup(w http.ResponseWriter, r *http.Request) {
+	var req groupRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	log.Debug("%s", body)
+
+	if err = json.Unmarshal(body, &req); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	group, err := api.Mesh.Groups().Create(req.Name, req.Members)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	go api.distributeGroupKey(group.ID)
+
+	JSON(w, http.StatusOK, group)
+}
+
+// DELETE /api/v1/mesh/groups/<id>
+func (api *API) PeerLeaveGroup(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	group := api.Mesh.Groups().Of(id)
+	if group == nil {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+
+	msg, err := api.Mesh.Groups().Leave(id)
+	if err != nil {
+		ERROR(w, http.StatusInternalServerError, err)
+		return
+	} else if msg != nil {
+		go func() {
+			if err := api.relayGroupMessage(group.Owner, msg); err != nil {
+				log.Debug("error notifying %s via server: %v", group.Owner, err)
+			}
+		}()
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// POST /api/v1/mesh/groups/<id>/rekey
+func (api *API) PeerRekeyGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := api.Mesh.Groups().Rekey(chi.URLParam(r, "id"))
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	go api.distributeGroupKey(group.ID)
+
+	JSON(w, http.StatusOK, group)
+}
+
+// POST /api/v1/mesh/groups/<id>/members
+func (api *API) PeerAddGroupMember(w http.ResponseWriter, r *http.Request) {
+	var req groupMemberRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	log.Debug("%s", body)
+
+	if err = json.Unmarshal(body, &req); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	group, err := api.Mesh.Groups().AddMember(chi.URLParam(r, "id"), req.Fingerprint)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	go api.distributeGroupKey(group.ID)
+
+	JSON(w, http.StatusOK, group)
+}
+
+// DELETE /api/v1/mesh/groups/<id>/members/<fingerprint>
+func (api *API) PeerDelGroupMember(w http.ResponseWriter, r *http.Request) {
+	group, err := api.Mesh.Groups().RemoveMember(chi.URLParam(r, "id"), chi.URLParam(r, "fingerprint"))
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	go api.distributeGroupKey(group.ID)
+
+	JSON(w, http.StatusOK, group)
+}
+
+// GET /api/v1/mesh/groups/<id>/inbox
+func (api *API) PeerGetGroupInbox(w http.ResponseWriter, r *http.Request) {
+	posts, err := api.Mesh.Groups().Inbox(chi.URLParam(r, "id"))
+	if err != nil {
+		ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	JSON(w, http.StatusOK, posts)
+}
+
+// POST /api/v1/mesh/groups/<id>/inbox
+func (api *API) PeerPostToGroup(w http.ResponseWriter, r *http.Request) {
+	var req groupPostRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	log.Debug("%s", body)
+
+	if err = json.Unmarshal(body, &req); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	msg, err := api.Mesh.Groups().Post(id, req.Data)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	if group := api.Mesh.Groups().Of(id); req.Server && group != nil {
+		go func() {
+			for _, member := range group.Members {
+				if member != api.Keys.FingerprintHex {
+					if err := api.relayGroupMessage(member, msg); err != nil {
+						log.Warning("error relaying post to %s via server: %v", member, err)
+					}
+				}
+			}
+		}()
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
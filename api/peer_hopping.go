@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/mesh"
+	"github.com/go-chi/chi"
+	"io/ioutil"
+	"net/http"
+)
+
+// GET /api/v1/mesh/hopping
+func (api *API) PeerGetHopping(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Mesh.Hopper().Status())
+}
+
+// POST /api/v1/mesh/hopping
+func (api *API) PeerSetHopping(w http.ResponseWriter, r *http.Request) {
+	var schedule mesh.Schedule
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	log.Debug("%s", body)
+
+	if err = json.Unmarshal(body, &schedule); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	} else if err = api.Mesh.Hopper().Configure(schedule); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, api.Mesh.Hopper().Status())
+}
+
+// GET /api/v1/mesh/hopping/<status>
+func (api *API) PeerEnableHopping(w http.ResponseWriter, r *http.Request) {
+	status := chi.URLParam(r, "status")
+
+	if status == "enabled" || status == "true" {
+		api.Mesh.Hopper().Enable(true)
+	} else if status == "disabled" || status == "false" {
+		api.Mesh.Hopper().Enable(false)
+	} else {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+
+	JSON(w, http.StatusOK, api.Mesh.Hopper().Status())
+}
+
+// GET /api/v1/mesh/channels
+func (api *API) PeerGetChannels(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Mesh.Channels())
+}
@@ -2,30 +2,99 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/evilsocket/islazy/log"
 	"github.com/evilsocket/pwngrid/mesh"
 	"github.com/go-chi/chi"
 	"io/ioutil"
 	"net/http"
 	"sort"
+	"strconv"
+	"time"
 )
 
-// GET /api/v1/mesh/peers
+// GET /api/v1/mesh/peers?presence=<state>&proximity=<class>&sort=<rssi|signal|distance|seen>
 func (api *API) PeerGetPeers(w http.ResponseWriter, r *http.Request) {
-	peers := make([]*mesh.Peer, 0)
-	mesh.Peers.Range(func(key, value interface{}) bool {
-		peers = append(peers, value.(*mesh.Peer))
-		return true
-	})
+	peers := api.Mesh.Peers()
 
-	// closer first
-	sort.Slice(peers, func(i, j int) bool {
-		return peers[i].RSSI > peers[j].RSSI
-	})
+	if state := r.URL.Query().Get("presence"); state != "" {
+		filtered := make([]*mesh.Peer, 0)
+		for _, peer := range peers {
+			if presence := peer.Presence(); presence != nil && string(presence.State) == state {
+				filtered = append(filtered, peer)
+			}
+		}
+		peers = filtered
+	}
+
+	signals := make(map[*mesh.Peer]*mesh.SignalStatus)
+	for _, peer := range peers {
+		if signal := peer.Signal(); signal != nil {
+			signals[peer] = signal
+		} else {
+			distance := mesh.EstimateDistance(float64(peer.RSSI), mesh.DefaultTxPower)
+			signals[peer] = &mesh.SignalStatus{
+				Kalman:    float64(peer.RSSI),
+				Distance:  distance,
+				Proximity: mesh.ProximityOf(distance),
+			}
+		}
+	}
+
+	if class := r.URL.Query().Get("proximity"); class != "" {
+		filtered := make([]*mesh.Peer, 0)
+		for _, peer := range peers {
+			if string(signals[peer].Proximity) == class {
+				filtered = append(filtered, peer)
+			}
+		}
+		peers = filtered
+	}
+
+	switch by := r.URL.Query().Get("sort"); by {
+	case "rssi":
+		// raw signal of the last frame
+		sort.Slice(peers, func(i, j int) bool {
+			return peers[i].RSSI > peers[j].RSSI
+		})
+	case "distance":
+		sort.Slice(peers, func(i, j int) bool {
+			return signals[peers[i]].Distance < signals[peers[j]].Distance
+		})
+	case "seen":
+		sort.Slice(peers, func(i, j int) bool {
+			return peers[i].SeenAt.After(peers[j].SeenAt)
+		})
+	case "", "signal":
+		// closer first, using the filtered signal
+		sort.Slice(peers, func(i, j int) bool {
+			return signals[peers[i]].Kalman > signals[peers[j]].Kalman
+		})
+	default:
+		ERROR(w, http.StatusUnprocessableEntity, fmt.Errorf("unknown sort field %s", by))
+		return
+	}
 
 	JSON(w, http.StatusOK, peers)
 }
 
+// GET /api/v1/mesh/peers/<fingerprint>/signal
+func (api *API) PeerGetSignalOf(w http.ResponseWriter, r *http.Request) {
+	fingerprint := chi.URLParam(r, "fingerprint")
+	peer := api.Mesh.Peer(fingerprint)
+	if peer == nil {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+
+	signal := peer.SignalHistory()
+	if signal == nil {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+	JSON(w, http.StatusOK, signal)
+}
+
 // GET /api/v1/mesh/memory
 func (api *API) PeerGetMemory(w http.ResponseWriter, r *http.Request) {
 	peers := api.Mesh.Memory()
@@ -47,6 +116,62 @@ func (api *API) PeerGetMemoryOf(w http.ResponseWriter, r *http.Request) {
 	JSON(w, http.StatusOK, peer)
 }
 
+// DELETE /api/v1/mesh/memory/<fingerprint>
+func (api *API) PeerForget(w http.ResponseWriter, r *http.Request) {
+	fingerprint := chi.URLParam(r, "fingerprint")
+	if !api.Mesh.Forget(fingerprint) {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// POST /api/v1/mesh/memory/compact
+func (api *API) PeerCompactMemory(w http.ResponseWriter, r *http.Request) {
+	removed, err := api.Mesh.CompactMemory()
+	if err != nil {
+		ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"removed": removed,
+	})
+}
+
+// GET /api/v1/mesh/memory/<fingerprint>/encounters?from=<time>&to=<time>
+func (api *API) PeerGetEncountersOf(w http.ResponseWriter, r *http.Request) {
+	fingerprint := chi.URLParam(r, "fingerprint")
+	if api.Mesh.MemoryOf(fingerprint) == nil {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+
+	from, err := timeParam(r, "from", time.Time{})
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	to, err := timeParam(r, "to", time.Now())
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	encounters, err := api.Mesh.EncountersOf(fingerprint, from, to)
+	if err != nil {
+		ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, encounters)
+}
+
 // GET /api/v1/mesh/<status>
 func (api *API) PeerSetSignaling(w http.ResponseWriter, r *http.Request) {
 	status := chi.URLParam(r, "status")
@@ -65,15 +190,55 @@ func (api *API) PeerSetSignaling(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// GET /api/v1/mesh/neighbourhood
+func (api *API) PeerGetNeighbourhood(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Mesh.Neighbourhood())
+}
+
+// GET /api/v1/mesh/health
+func (api *API) PeerGetHealth(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Mesh.Health())
+}
+
+// GET /api/v1/mesh/advertiser
+func (api *API) PeerGetAdvertiser(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Peer.DutyCycle().Status())
+}
+
+// GET /api/v1/mesh/data/budget
+func (api *API) PeerGetMeshBudget(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Peer.Budget())
+}
+
+// GET /api/v1/mesh/schema
+func (api *API) PeerGetSchema(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, mesh.GetSchema())
+}
+
 // GET /api/v1/mesh/data
 func (api *API) PeerGetMeshData(w http.ResponseWriter, r *http.Request) {
 	JSON(w, http.StatusOK, api.Peer.Data())
 }
 
-// POST /api/v1/mesh/data
+// GET /api/v1/mesh/data/fields
+func (api *API) PeerGetMeshFields(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Peer.Fields())
+}
+
+// POST /api/v1/mesh/data?owner=<plugin>&ttl=<seconds>
 func (api *API) PeerSetMeshData(w http.ResponseWriter, r *http.Request) {
 	var newData map[string]interface{}
 
+	ttl := 0
+	if param := r.URL.Query().Get("ttl"); param != "" {
+		var err error
+		if ttl, err = strconv.Atoi(param); err != nil {
+			ERROR(w, http.StatusUnprocessableEntity, fmt.Errorf("invalid ttl %s", param))
+			return
+		}
+	}
+	owner := r.URL.Query().Get("owner")
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		ERROR(w, http.StatusUnprocessableEntity, err)
@@ -87,14 +252,17 @@ func (api *API) PeerSetMeshData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// update mesh advertisement data
+	if err = api.Peer.SetFields(owner, time.Duration(ttl)*time.Second, newData); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
 	// this makes sure that the pwngrid server receives advertisements
 	api.Client.SetData(map[string]interface{}{
 		"advertisement": newData,
 	})
 
-	// update mesh advertisement data
-	api.Peer.SetData(newData)
-
 	JSON(w, http.StatusOK, map[string]interface{}{
 		"success": true,
 	})
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/mesh"
+	"github.com/go-chi/chi"
+	"io/ioutil"
+	"net/http"
+)
+
+// GET /api/v1/mesh/policy
+func (api *API) PeerGetPolicy(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Mesh.Policy())
+}
+
+// POST /api/v1/mesh/policy
+func (api *API) PeerSetPolicy(w http.ResponseWriter, r *http.Request) {
+	var rule mesh.PolicyRule
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	log.Debug("%s", body)
+
+	if err = json.Unmarshal(body, &rule); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	} else if err = api.Mesh.Policy().Set(rule); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// DELETE /api/v1/mesh/policy/<fingerprint|session_id>
+func (api *API) PeerDelPolicy(w http.ResponseWriter, r *http.Request) {
+	target := chi.URLParam(r, "target")
+	if found, err := api.Mesh.Policy().Remove(target); err != nil {
+		ERROR(w, http.StatusInternalServerError, err)
+		return
+	} else if !found {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// GET /api/v1/mesh/policy/allowlist/<status>
+func (api *API) PeerSetAllowlistOnly(w http.ResponseWriter, r *http.Request) {
+	status := chi.URLParam(r, "status")
+	enabled := false
+
+	if status == "enabled" || status == "true" {
+		enabled = true
+	} else if status != "disabled" && status != "false" {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+
+	if err := api.Mesh.Policy().SetAllowlistOnly(enabled); err != nil {
+		ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
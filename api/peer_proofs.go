@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+)
+
+// GET /api/v1/mesh/proofs?fingerprint=<fingerprint>&pending=<true|false>
+func (api *API) PeerGetProofs(w http.ResponseWriter, r *http.Request) {
+	fingerprint := r.URL.Query().Get("fingerprint")
+	pending := r.URL.Query().Get("pending") == "true"
+
+	proofs, err := api.Mesh.Proofs(fingerprint, pending)
+	if err != nil {
+		ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, proofs)
+}
+
+// POST /api/v1/mesh/proofs/upload
+func (api *API) PeerUploadProofs(w http.ResponseWriter, r *http.Request) {
+	proofs, err := api.Mesh.Proofs("", true)
+	if err != nil {
+		ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	accepted := make([]string, 0)
+	rejected := make(map[string]string)
+	// the server only accepts so many proofs per report
+	for len(proofs) > 0 {
+		batch := proofs
+		if len(batch) > maxEncounterReports {
+			batch = batch[:maxEncounterReports]
+		}
+		proofs = proofs[len(batch):]
+
+		obj, err := api.Client.ReportEncounters(batch)
+		if err != nil {
+			ERROR(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		batchAccepted, batchRejected := reportResults(obj)
+		if err = api.Mesh.ProofsUploaded(batchAccepted); err != nil {
+			ERROR(w, http.StatusInternalServerError, err)
+			return
+		} else if err = api.Mesh.ProofsRejected(batchRejected); err != nil {
+			ERROR(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		accepted = append(accepted, batchAccepted...)
+		for id, reason := range batchRejected {
+			rejected[id] = reason
+		}
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"accepted": accepted,
+		"rejected": rejected,
+	})
+}
+
+// returns the accepted proofs and the ones rejected for good from the response of the server
+func reportResults(obj map[string]interface{}) ([]string, map[string]string) {
+	accepted := make([]string, 0)
+	if list, ok := obj["accepted"].([]interface{}); ok {
+		for _, id := range list {
+			if idStr, ok := id.(string); ok {
+				accepted = append(accepted, idStr)
+			}
+		}
+	}
+
+	retry := make(map[string]bool)
+	if list, ok := obj["retry"].([]interface{}); ok {
+		for _, id := range list {
+			if idStr, ok := id.(string); ok {
+				retry[idStr] = true
+			}
+		}
+	}
+
+	rejected := make(map[string]string)
+	if reasons, ok := obj["rejected"].(map[string]interface{}); ok {
+		for id, reason := range reasons {
+			if reasonStr, ok := reason.(string); ok && !retry[id] {
+				rejected[id] = reasonStr
+			}
+		}
+	}
+
+	return accepted, rejected
+}
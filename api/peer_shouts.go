@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/mesh"
+	"github.com/go-chi/chi"
+	"io/ioutil"
+	"net/http"
+)
+
+type shoutRequest struct {
+	Text string `json:"text"`
+	// lifetime in seconds, 0 for the default
+	TTL int `json:"ttl"`
+}
+
+// this makes sure that the pwngrid server receives the feed with the next enrollment
+func (api *API) relayShouts(shout *mesh.Shout) {
+	api.Client.SetData(map[string]interface{}{
+		"shouts": api.Mesh.Shouts().Feed(),
+	})
+}
+
+// GET /api/v1/mesh/shouts
+func (api *API) PeerGetShouts(w http.ResponseWriter, r *http.Request) {
+	JSON(w, http.StatusOK, api.Mesh.Shouts().Feed())
+}
+
+// POST /api/v1/mesh/shouts
+func (api *API) PeerShout(w http.ResponseWriter, r *http.Request) {
+	var req shoutRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	log.Debug("%s", body)
+
+	if err = json.Unmarshal(body, &req); err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	shout, err := api.Mesh.Shouts().Shout(req.Text, req.TTL)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	JSON(w, http.StatusOK, shout)
+}
+
+// DELETE /api/v1/mesh/shouts/<id>
+func (api *API) PeerDelShout(w http.ResponseWriter, r *http.Request) {
+	if !api.Mesh.Shouts().Remove(chi.URLParam(r, "id")) {
+		ERROR(w, http.StatusNotFound, ErrEmpty)
+		return
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
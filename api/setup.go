@@ -33,6 +33,9 @@ func Setup(keys *crypto.KeyPair, peer *mesh.Peer, router *mesh.Router) (err erro
 		api.setupServerRoutes()
 	} else {
 		api.setupPeerRoutes()
+		if router != nil && mesh.ShoutRelay {
+			router.Shouts().OnShout(api.relayShouts)
+		}
 	}
 
 	return
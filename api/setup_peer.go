@@ -2,31 +2,140 @@ package api
 
 import (
 	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/metrics"
 	"github.com/go-chi/chi"
 )
 
 func (api *API) setupPeerRoutes() {
 	log.Debug("registering peer api ...")
 
+	// GET /metrics
+	api.Router.Get("/metrics", metrics.Handler)
+
 	api.Router.Route("/api", func(r chi.Router) {
 		r.Route("/v1", func(r chi.Router) {
 			r.Route("/mesh", func(r chi.Router) {
-				// GET /api/v1/mesh/peers
+				// GET /api/v1/mesh/peers?presence=<state>&proximity=<class>&sort=<rssi|signal|distance|seen>
 				r.Get("/peers", api.PeerGetPeers)
+				// GET /api/v1/mesh/peers/<fingerprint>/signal
+				r.Get("/peers/{fingerprint:[a-fA-F0-9]+}/signal", api.PeerGetSignalOf)
 
 				r.Route("/memory", func(r chi.Router) {
 					// GET /api/v1/mesh/memory
 					r.Get("/", api.PeerGetMemory)
+					// POST /api/v1/mesh/memory/compact
+					r.Post("/compact", api.PeerCompactMemory)
 					// GET /api/v1/mesh/memory/<fingerprint>
 					r.Get("/{fingerprint:[a-fA-F0-9]+}", api.PeerGetMemoryOf)
+					// DELETE /api/v1/mesh/memory/<fingerprint>
+					r.Delete("/{fingerprint:[a-fA-F0-9]+}", api.PeerForget)
+					// GET /api/v1/mesh/memory/<fingerprint>/encounters?from=<time>&to=<time>
+					r.Get("/{fingerprint:[a-fA-F0-9]+}/encounters", api.PeerGetEncountersOf)
+				})
+
+				r.Route("/policy", func(r chi.Router) {
+					// GET /api/v1/mesh/policy
+					r.Get("/", api.PeerGetPolicy)
+					// POST /api/v1/mesh/policy
+					r.Post("/", api.PeerSetPolicy)
+					// GET /api/v1/mesh/policy/allowlist/<status>
+					r.Get("/allowlist/{status:[a-z]+}", api.PeerSetAllowlistOnly)
+					// DELETE /api/v1/mesh/policy/<fingerprint|session_id>
+					r.Delete("/{target}", api.PeerDelPolicy)
+				})
+
+				r.Route("/contacts", func(r chi.Router) {
+					// GET /api/v1/mesh/contacts
+					r.Get("/", api.PeerGetContacts)
+					// POST /api/v1/mesh/contacts
+					r.Post("/", api.PeerAddContact)
+					// DELETE /api/v1/mesh/contacts/<fingerprint>
+					r.Delete("/{fingerprint:[a-fA-F0-9]+}", api.PeerDelContact)
+				})
+
+				r.Route("/hopping", func(r chi.Router) {
+					// GET /api/v1/mesh/hopping
+					r.Get("/", api.PeerGetHopping)
+					// POST /api/v1/mesh/hopping
+					r.Post("/", api.PeerSetHopping)
+					// GET /api/v1/mesh/hopping/<status>
+					r.Get("/{status:[a-z]+}", api.PeerEnableHopping)
+				})
+
+				// GET /api/v1/mesh/channels
+				r.Get("/channels", api.PeerGetChannels)
+
+				r.Route("/files", func(r chi.Router) {
+					// GET /api/v1/mesh/files
+					r.Get("/", api.PeerGetFiles)
+					// POST /api/v1/mesh/files
+					r.Post("/", api.PeerOfferFile)
+					// GET /api/v1/mesh/files/<id>
+					r.Get("/{id:[a-f0-9]+}", api.PeerGetFile)
+					// DELETE /api/v1/mesh/files/<id>
+					r.Delete("/{id:[a-f0-9]+}", api.PeerDelFile)
 				})
 
+				r.Route("/groups", func(r chi.Router) {
+					// GET /api/v1/mesh/groups
+					r.Get("/", api.PeerGetGroups)
+					// POST /api/v1/mesh/groups
+					r.Post("/", api.PeerCreateGroup)
+					r.Route("/{id:[a-f0-9]+}", func(r chi.Router) {
+						// GET /api/v1/mesh/groups/<id>
+						r.Get("/", api.PeerGetGroup)
+						// DELETE /api/v1/mesh/groups/<id>
+						r.Delete("/", api.PeerLeaveGroup)
+						// POST /api/v1/mesh/groups/<id>/rekey
+						r.Post("/rekey", api.PeerRekeyGroup)
+						// POST /api/v1/mesh/groups/<id>/members
+						r.Post("/members", api.PeerAddGroupMember)
+						// DELETE /api/v1/mesh/groups/<id>/members/<fingerprint>
+						r.Delete("/members/{fingerprint:[a-fA-F0-9]+}", api.PeerDelGroupMember)
+						// GET /api/v1/mesh/groups/<id>/inbox
+						r.Get("/inbox", api.PeerGetGroupInbox)
+						// POST /api/v1/mesh/groups/<id>/inbox
+						r.Post("/inbox", api.PeerPostToGroup)
+					})
+				})
+
+				r.Route("/shouts", func(r chi.Router) {
+					// GET /api/v1/mesh/shouts
+					r.Get("/", api.PeerGetShouts)
+					// POST /api/v1/mesh/shouts
+					r.Post("/", api.PeerShout)
+					// DELETE /api/v1/mesh/shouts/<id>
+					r.Delete("/{id:[a-f0-9]+}", api.PeerDelShout)
+				})
+
+				// GET /api/v1/mesh/health
+				r.Get("/health", api.PeerGetHealth)
+				// GET /api/v1/mesh/neighbourhood
+				r.Get("/neighbourhood", api.PeerGetNeighbourhood)
+
+				r.Route("/proofs", func(r chi.Router) {
+					// GET /api/v1/mesh/proofs?fingerprint=<fingerprint>&pending=<true|false>
+					r.Get("/", api.PeerGetProofs)
+					// POST /api/v1/mesh/proofs/upload
+					r.Post("/upload", api.PeerUploadProofs)
+				})
+
+				// GET /api/v1/mesh/advertiser
+				r.Get("/advertiser", api.PeerGetAdvertiser)
+
 				// GET /api/v1/mesh/<status>
 				r.Get("/{status:[a-z]+}", api.PeerSetSignaling)
 
+				// GET /api/v1/mesh/schema
+				r.Get("/schema", api.PeerGetSchema)
+
 				// GET /api/v1/mesh/data
 				r.Get("/data", api.PeerGetMeshData)
-				// POST /api/v1/mesh/data
+				// GET /api/v1/mesh/data/budget
+				r.Get("/data/budget", api.PeerGetMeshBudget)
+				// GET /api/v1/mesh/data/fields
+				r.Get("/data/fields", api.PeerGetMeshFields)
+				// POST /api/v1/mesh/data?owner=<plugin>&ttl=<seconds>
 				r.Post("/data", api.PeerSetMeshData)
 			})
 
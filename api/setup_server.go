@@ -44,6 +44,8 @@ func (api *API) setupServerRoutes() {
 				})
 				// POST /api/v1/unit/<fingerprint>/inbox
 				r.Post("/{fingerprint:[a-fA-F0-9]+}/inbox", api.SendMessageTo)
+				// GET /api/v1/unit/met
+				r.Get("/met", api.GetMetUnits)
 				// POST /api/v1/unit/enroll
 				r.Post("/enroll", api.UnitEnroll)
 				r.Route("/report", func(r chi.Router) {
@@ -51,6 +53,8 @@ func (api *API) setupServerRoutes() {
 					r.Post("/ap", api.UnitReportAP)
 					// POST /api/v1/unit/report/aps
 					r.Post("/aps", api.UnitReportMultipleAP)
+					// POST /api/v1/unit/report/encounters
+					r.Post("/encounters", api.UnitReportEncounters)
 				})
 			})
 		})
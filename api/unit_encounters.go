@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/crypto"
+	"github.com/evilsocket/pwngrid/mesh"
+	"github.com/evilsocket/pwngrid/models"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maximum number of proofs accepted in a single report
+const maxEncounterReports = 500
+
+// a proof that could not be recorded for reasons that don't depend on it, it can be reported again
+type retryError struct {
+	error
+}
+
+func unitKeys(fingerprint string) (*models.Unit, *crypto.KeyPair, error) {
+	unit := models.FindUnitByFingerprint(strings.ToLower(fingerprint))
+	if unit == nil {
+		return nil, nil, fmt.Errorf("unit %s is not enrolled", fingerprint)
+	}
+	keys, err := crypto.FromPublicPEM(unit.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing public key of %s: %v", fingerprint, err)
+	}
+	return unit, keys, nil
+}
+
+func (api *API) unitEncounter(unit *models.Unit, proof *mesh.Proof) error {
+	if !strings.EqualFold(proof.A, unit.Fingerprint) && !strings.EqualFold(proof.B, unit.Fingerprint) {
+		return fmt.Errorf("proof %s doesn't involve the reporting unit", proof.ID())
+	} else if proof.Time().After(time.Now().Add(time.Duration(mesh.ProofMaxSkew) * time.Second)) {
+		return fmt.Errorf("proof %s is dated in the future", proof.ID())
+	}
+
+	unitA, keysA, err := unitKeys(proof.A)
+	if err != nil {
+		return err
+	}
+	unitB, keysB, err := unitKeys(proof.B)
+	if err != nil {
+		return err
+	}
+
+	if err = proof.Verify(keysA, keysB); err != nil {
+		return fmt.Errorf("proof %s is not valid: %v", proof.ID(), err)
+	} else if added, err := models.RecordEncounter(proof.ID(), unitA, unitB, proof.Time(), proof.Channel, unit); err != nil {
+		return retryError{fmt.Errorf("error saving proof %s: %v", proof.ID(), err)}
+	} else if added {
+		log.Debug("unit %s proved encounter of %s and %s", unit.Identity(), unitA.Identity(), unitB.Identity())
+	}
+	return nil
+}
+
+func (api *API) UnitReportEncounters(w http.ResponseWriter, r *http.Request) {
+	unit := Authenticate(w, r)
+	if unit == nil {
+		return
+	}
+
+	client := clientIP(r)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ERROR(w, http.StatusUnprocessableEntity, ErrEmpty)
+		return
+	}
+
+	var proofs []*mesh.Proof
+	if err = json.Unmarshal(body, &proofs); err != nil {
+		log.Warning("error while reading encounter proofs from %s: %v", client, err)
+		ERROR(w, http.StatusUnprocessableEntity, ErrEmpty)
+		return
+	} else if len(proofs) > maxEncounterReports {
+		ERROR(w, http.StatusUnprocessableEntity, fmt.Errorf("max %d proofs per report", maxEncounterReports))
+		return
+	}
+
+	for _, proof := range proofs {
+		if proof == nil {
+			log.Warning("null encounter proof from %s", client)
+			ERROR(w, http.StatusUnprocessableEntity, ErrEmpty)
+			return
+		}
+	}
+
+	accepted := make([]string, 0)
+	rejected := make(map[string]string)
+	retry := make([]string, 0)
+	for _, proof := range proofs {
+		if err := api.unitEncounter(unit, proof); err != nil {
+			log.Warning("%v", err)
+			rejected[proof.ID()] = err.Error()
+			if _, ok := err.(retryError); ok {
+				retry = append(retry, proof.ID())
+			}
+		} else {
+			accepted = append(accepted, proof.ID())
+		}
+	}
+
+	JSON(w, http.StatusOK, map[string]interface{}{
+		"accepted": accepted,
+		"rejected": rejected,
+		// rejected proofs that can be reported again
+		"retry": retry,
+	})
+}
+
+// only the unit itself can list the units it met, other features should rely on Unit.HasMet
+func (api *API) GetMetUnits(w http.ResponseWriter, r *http.Request) {
+	unit := Authenticate(w, r)
+	if unit == nil {
+		return
+	} else if met, err := unit.MetUnits(); err != nil {
+		log.Error("error loading units met by %s: %v", unit.Identity(), err)
+		ERROR(w, http.StatusInternalServerError, ErrEmpty)
+		return
+	} else {
+		JSON(w, http.StatusOK, met)
+	}
+}
@@ -3,10 +3,12 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/evilsocket/islazy/log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -48,6 +50,19 @@ func pageNum(r *http.Request) (int, error) {
 	return strconv.Atoi(pageParam)
 }
 
+// parses a time query parameter either as a unix timestamp or as a RFC3339 string
+func timeParam(r *http.Request, name string, def time.Time) (time.Time, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return def, nil
+	} else if ts, err := strconv.ParseInt(param, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	} else if t, err := time.Parse(time.RFC3339, param); err == nil {
+		return t, nil
+	}
+	return def, fmt.Errorf("can't parse '%s' as a time value", param)
+}
+
 func JSON(w http.ResponseWriter, statusCode int, data interface{}) {
 	js, err := json.Marshal(data)
 	if err != nil {
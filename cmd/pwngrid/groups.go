@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/evilsocket/islazy/log"
+	"time"
+)
+
+// periodically checks the server inbox for group keys and posts relayed by other members
+func groupsWatcher() {
+	if groupsSync <= 0 {
+		return
+	}
+
+	period := time.Duration(groupsSync) * time.Second
+	log.Debug("groups watcher started with a %s period", period)
+
+	for {
+		if err := server.SyncGroups(); err != nil {
+			log.Debug("error syncing groups: %v", err)
+		}
+		time.Sleep(period)
+	}
+}
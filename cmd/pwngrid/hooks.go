@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/hooks"
+	"github.com/evilsocket/pwngrid/mesh"
+	"time"
+)
+
+func setupHooks() {
+	if hooksPath == "" {
+		return
+	}
+
+	var err error
+	if err, eventHooks = hooks.Load(hooksPath); err != nil {
+		log.Fatal("%v", err)
+	}
+}
+
+func setupMeshHooks() {
+	peer.OnSignalingChange(func(enabled bool) {
+		eventHooks.Fire(hooks.NewEvent(hooks.EventSignaling, keys.FingerprintHex, map[string]interface{}{
+			"enabled": enabled,
+		}))
+	})
+}
+
+func firePeerEvent(eventType string, ident string, peer *mesh.Peer) {
+	eventHooks.Fire(hooks.NewEvent(eventType, ident, peer))
+}
+
+func firePresenceEvent(ident string, peer *mesh.Peer, from mesh.PresenceState, to mesh.PresenceState) {
+	eventHooks.Fire(hooks.NewEvent(hooks.EventPeerPresence, ident, map[string]interface{}{
+		"from": from,
+		"to":   to,
+		"peer": peer,
+	}))
+}
+
+// periodically polls the inbox and fires an event for every new unread message
+func inboxWatcher() {
+	if !eventHooks.Handles(hooks.EventInboxMessage) {
+		return
+	}
+
+	period := time.Duration(inboxPeriod) * time.Second
+	log.Debug("inbox watcher started with a %s period", period)
+
+	lastID := -1
+	for {
+		if box, err := server.Client.Inbox(1); err != nil {
+			log.Debug("error polling inbox: %v", err)
+		} else if messages, ok := box["messages"].([]interface{}); ok {
+			maxID := lastID
+			for _, m := range messages {
+				msg, ok := m.(map[string]interface{})
+				if !ok {
+					continue
+				}
+
+				id, ok := msg["id"].(float64)
+				if !ok {
+					log.Debug("skipping inbox message without a valid id: %v", msg)
+					continue
+				}
+
+				msgID := int(id)
+				if msgID > maxID {
+					maxID = msgID
+				}
+
+				// the first poll just sets the baseline
+				if lastID >= 0 && msgID > lastID && msg["seen_at"] == nil {
+					sender, _ := msg["sender"].(string)
+					eventHooks.Fire(hooks.NewEvent(hooks.EventInboxMessage, sender, msg))
+				}
+			}
+			if maxID < 0 {
+				maxID = 0
+			}
+			lastID = maxID
+		}
+
+		time.Sleep(period)
+	}
+}
@@ -25,6 +25,10 @@ func main() {
 	}
 	defer log.Close()
 
+	if err := validateFlags(); err != nil {
+		log.Fatal("%v", err)
+	}
+
 	// do mode related initialization
 	setupMode()
 
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"github.com/evilsocket/islazy/fs"
 	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/islazy/str"
 	"github.com/evilsocket/pwngrid/api"
 	"github.com/evilsocket/pwngrid/crypto"
+	"github.com/evilsocket/pwngrid/hooks"
 	"github.com/evilsocket/pwngrid/mesh"
 	"github.com/evilsocket/pwngrid/models"
 	"github.com/evilsocket/pwngrid/utils"
@@ -12,11 +15,24 @@ import (
 	"github.com/joho/godotenv"
 	"os"
 	"os/signal"
+	"path"
 	"runtime/pprof"
+	"syscall"
 	"time"
 )
 
 func cleanup() {
+	if peer != nil {
+		peer.StopAdvertising()
+	}
+
+	if router != nil {
+		log.Info("saving peers memory ...")
+		if err := router.Close(); err != nil {
+			log.Error("error saving peers memory: %v", err)
+		}
+	}
+
 	if cpuProfile != "" {
 		log.Info("writing CPU profile to %s ...", cpuProfile)
 		pprof.StopCPUProfile()
@@ -41,7 +57,8 @@ func cleanup() {
 
 func setupCore() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	// systemd stops the service with SIGTERM
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		for sig := range c {
 			log.Warning("received signal %v", sig)
@@ -85,20 +102,54 @@ func waitForKeys() {
 
 func setupMesh() {
 	var err error
+	// interfaces that are not available are retried in the background, the api keeps working meanwhile
+	ctx := context.Background()
+	ifaces := str.Comma(iface)
 	peer = mesh.MakeLocalPeer(utils.Hostname(), keys)
-	if err = peer.StartAdvertising(iface); err != nil {
-		log.Fatal("error while starting signaling: %v", err)
+	if err = peer.StartAdvertising(ctx, ifaces); err != nil {
+		log.Error("error while starting signaling: %v", err)
+	}
+	if policyPath == "" {
+		policyPath = path.Join(peersPath, "policy.json")
+	}
+	if contactsPath == "" {
+		contactsPath = path.Join(peersPath, "contacts.json")
 	}
-	if router, err = mesh.StartRouting(iface, peersPath, peer); err != nil {
+	if filesPath == "" {
+		filesPath = path.Join(peersPath, "files")
+	}
+	if sharePath == "" {
+		sharePath = path.Join(filesPath, "shared")
+	}
+	if groupsPath == "" {
+		groupsPath = path.Join(peersPath, "groups.json")
+	}
+	config := mesh.RouterConfig{
+		Interfaces:   ifaces,
+		PeersPath:    peersPath,
+		PolicyPath:   policyPath,
+		ContactsPath: contactsPath,
+		FilesPath:    filesPath,
+		SharePath:    sharePath,
+		GroupsPath:   groupsPath,
+	}
+	if router, err = mesh.StartRouting(ctx, config, peer); err != nil {
 		log.Fatal("%v", err)
 	} else {
 		router.OnNewPeer(func(ident string, peer *mesh.Peer) {
 			log.Info("detected new peer %s on channel %d", peer.ID(), peer.Channel)
+			firePeerEvent(hooks.EventPeerNew, ident, peer)
 		})
 		router.OnPeerLost(func(ident string, peer *mesh.Peer) {
 			log.Info("peer %s lost (inactive for %fs)", peer.ID(), peer.InactiveFor())
+			firePeerEvent(hooks.EventPeerLost, ident, peer)
+		})
+		router.OnPresenceChange(func(ident string, peer *mesh.Peer, from mesh.PresenceState, to mesh.PresenceState) {
+			log.Info("peer %s is %s", peer.ID(), to)
+			firePresenceEvent(ident, peer, from, to)
 		})
 	}
+	setupMeshHooks()
 	log.Info("peer %s signaling is ready", peer.ID())
 }
 
@@ -169,6 +220,7 @@ func setupMode() string {
 		}
 		// only start mesh signaling if this is not an inbox action
 		if !inbox {
+			setupHooks()
 			setupMesh()
 		}
 	} else if mode == "server" {
@@ -182,5 +234,10 @@ func setupMode() string {
 		log.Fatal("%v", err)
 	}
 
+	if mode == "peer" && !inbox {
+		go inboxWatcher()
+		go groupsWatcher()
+	}
+
 	return mode
 }
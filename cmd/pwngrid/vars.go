@@ -2,41 +2,52 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/evilsocket/islazy/log"
 	"github.com/evilsocket/pwngrid/api"
 	"github.com/evilsocket/pwngrid/crypto"
+	"github.com/evilsocket/pwngrid/hooks"
 	"github.com/evilsocket/pwngrid/mesh"
 )
 
 var (
-	debug      = false
-	ver        = false
-	wait       = false
-	inbox      = false
-	del        = false
-	unread     = false
-	clear      = false
-	whoami     = false
-	generate   = false
-	loop       = false
-	nodb       = false
-	loopPeriod = 30
-	receiver   = ""
-	message    = ""
-	output     = ""
-	page       = 1
-	id         = 0
-	address    = "0.0.0.0:8666"
-	env        = ".env"
-	iface      = "mon0"
-	keysPath   = ""
-	peersPath  = "/root/peers"
-	keys       = (*crypto.KeyPair)(nil)
-	router     = (*mesh.Router)(nil)
-	peer       = (*mesh.Peer)(nil)
-	server     = (*api.API)(nil)
-	cpuProfile = ""
-	memProfile = ""
+	debug        = false
+	ver          = false
+	wait         = false
+	inbox        = false
+	del          = false
+	unread       = false
+	clear        = false
+	whoami       = false
+	generate     = false
+	loop         = false
+	nodb         = false
+	loopPeriod   = 30
+	receiver     = ""
+	message      = ""
+	output       = ""
+	page         = 1
+	id           = 0
+	address      = "0.0.0.0:8666"
+	env          = ".env"
+	iface        = "mon0"
+	keysPath     = ""
+	peersPath    = "/root/peers"
+	hooksPath    = ""
+	policyPath   = ""
+	contactsPath = ""
+	filesPath    = ""
+	sharePath    = ""
+	groupsPath   = ""
+	groupsSync   = 60
+	keys         = (*crypto.KeyPair)(nil)
+	router       = (*mesh.Router)(nil)
+	peer         = (*mesh.Peer)(nil)
+	server       = (*api.API)(nil)
+	eventHooks   = (*hooks.Manager)(nil)
+	inboxPeriod  = 60
+	cpuProfile   = ""
+	memProfile   = ""
 )
 
 func init() {
@@ -53,9 +64,63 @@ func init() {
 	flag.IntVar(&api.ClientTimeout, "client-timeout", api.ClientTimeout, "Timeout in seconds for requests to the server when in peer mode.")
 	flag.StringVar(&api.ClientTokenFile, "client-token", api.ClientTokenFile, "File where to store the API token.")
 
-	flag.StringVar(&iface, "iface", iface, "Monitor interface to use for mesh advertising.")
+	flag.StringVar(&iface, "iface", iface, "Comma separated list of monitor interfaces to use for mesh advertising.")
 	flag.StringVar(&peersPath, "peers", peersPath, "path to save historical information of met peers.")
+	flag.IntVar(&mesh.MemoryFlushPeriod, "peers-flush-period", mesh.MemoryFlushPeriod, "Period in seconds to flush peers memory changes to disk.")
+	flag.BoolVar(&mesh.MemorySync, "peers-sync", mesh.MemorySync, "If false, peers memory flushes will not wait for the data to be synced to disk.")
+	flag.StringVar(&policyPath, "policy", policyPath, "Path of the allow/deny/mute peers policy file, if empty it'll be saved in the -peers folder.")
+	flag.StringVar(&contactsPath, "contacts", contactsPath, "Path of the known contacts file, if empty it'll be saved in the -peers folder.")
+	flag.StringVar(&filesPath, "files", filesPath, "Folder where files received from peers are saved, if empty it'll be created in the -peers folder.")
+	flag.StringVar(&sharePath, "files-share", sharePath, "Folder of the files that can be offered to peers, if empty it'll be created in the -files folder.")
+	flag.IntVar(&mesh.FileMaxSize, "files-max-size", mesh.FileMaxSize, "Maximum size in bytes of files shared over the mesh.")
+	flag.BoolVar(&mesh.FileAccept, "files-accept", mesh.FileAccept, "Accept files offered by peers.")
+	flag.StringVar(&groupsPath, "groups", groupsPath, "Path of the groups file, if empty it'll be saved in the -peers folder.")
+	flag.IntVar(&groupsSync, "groups-sync-period", groupsSync, "Period in seconds to check the server inbox for group messages, 0 to disable.")
+	flag.IntVar(&mesh.ShoutTTL, "shouts-ttl", mesh.ShoutTTL, "Maximum lifetime in seconds of shouts.")
+	flag.IntVar(&mesh.ShoutMinInterval, "shouts-min-interval", mesh.ShoutMinInterval, "Minimum time in seconds between two shouts of this unit.")
+	flag.BoolVar(&mesh.ShoutRelay, "shouts-relay", mesh.ShoutRelay, "Send the shouts feed to the server with the unit data.")
+	flag.IntVar(&mesh.PeerTTL, "peers-ttl", mesh.PeerTTL, "Seconds without frames after which a peer is considered lost.")
+	flag.IntVar(&mesh.PresenceFadingAfter, "presence-fading", mesh.PresenceFadingAfter, "Number of missed advertisements after which a peer is considered fading.")
+	flag.IntVar(&mesh.PresenceAwayAfter, "presence-away", mesh.PresenceAwayAfter, "Number of missed advertisements after which a peer is considered away.")
+	flag.IntVar(&mesh.PresenceMinSilence, "presence-min-silence", mesh.PresenceMinSilence, "Minimum seconds without frames before a peer can be considered fading.")
+	flag.IntVar(&mesh.PresenceRecoverFrames, "presence-recover", mesh.PresenceRecoverFrames, "Consecutive frames needed for a fading or away peer to be considered present again.")
+	flag.IntVar(&mesh.PresenceWeakRSSI, "presence-weak-rssi", mesh.PresenceWeakRSSI, "RSSI below which a dropping signal makes a peer fading.")
+	flag.IntVar(&mesh.TxPower, "tx-power", mesh.TxPower, "Calibrated RSSI measured at one meter from this unit, advertised to peers if not 0.")
+	flag.IntVar(&mesh.DefaultTxPower, "tx-power-default", mesh.DefaultTxPower, "RSSI at one meter assumed for peers that don't advertise their calibration.")
+	flag.Float64Var(&mesh.PathLossExponent, "path-loss", mesh.PathLossExponent, "Path loss exponent used to estimate the distance of peers.")
+	flag.IntVar(&mesh.SignalWindow, "signal-window", mesh.SignalWindow, "Window in seconds for the minimum and maximum RSSI of peers.")
+	flag.IntVar(&mesh.ReconnectMaxDelay, "mesh-reconnect-max", mesh.ReconnectMaxDelay, "Maximum time in seconds between two attempts to reopen a mesh interface that went away.")
+	flag.IntVar(&mesh.LinkCheckPeriod, "mesh-link-check", mesh.LinkCheckPeriod, "Period in milliseconds to check if the mesh interfaces are still available.")
+	flag.IntVar(&mesh.AdvFrameBudget, "signaling-budget", mesh.AdvFrameBudget, "Maximum size in bytes of an advertisement frame.")
+	flag.StringVar(&mesh.AdvOverflow, "signaling-overflow", mesh.AdvOverflow, "What to do with the advertisement fields exceeding the budget, drop or rotate.")
+	flag.BoolVar(&mesh.AdvDeltas, "signaling-deltas", mesh.AdvDeltas, "Only advertise the fields changed since the last snapshot between full snapshots.")
+	flag.IntVar(&mesh.AdvSnapshotPeriod, "signaling-snapshot-period", mesh.AdvSnapshotPeriod, "Period in seconds for a full snapshot of the advertisement data to be sent.")
+	flag.BoolVar(&mesh.NeighboursAdvertise, "mesh-neighbours", mesh.NeighboursAdvertise, "Advertise the truncated fingerprints of the peers in range, not in privacy mode nor with -mesh-private.")
+	flag.IntVar(&mesh.NeighboursMax, "mesh-neighbours-max", mesh.NeighboursMax, "Maximum number of peers advertised with -mesh-neighbours.")
+	flag.BoolVar(&mesh.EncounterProofs, "mesh-proofs", mesh.EncounterProofs, "Exchange signed proofs of encounter with the peers in range.")
+	flag.IntVar(&mesh.ProofInterval, "mesh-proofs-interval", mesh.ProofInterval, "Minimum time in seconds between two proofs of encounter with the same peer.")
+	flag.BoolVar(&mesh.PrivacyMode, "privacy", mesh.PrivacyMode, "Do not advertise identity and name, only contacts that received our key will be able to recognize this unit.")
+	flag.BoolVar(&mesh.PrivateAdvertisements, "mesh-private", mesh.PrivateAdvertisements, "Encrypt every advertised field but the session ones with a key shared only with contacts.")
+	flag.IntVar(&mesh.SessionRotation, "session-rotation", mesh.SessionRotation, "Period in seconds after which the mesh session id is changed, 0 to disable.")
+	flag.BoolVar(&mesh.AllowlistOnly, "allowlist-only", mesh.AllowlistOnly, "Only discover peers explicitly allowed by the policy.")
+	flag.IntVar(&mesh.MemoryMaxPeers, "peers-max", mesh.MemoryMaxPeers, "Maximum number of peers to remember, least recently seen ones are evicted first (0 for no limit).")
+	flag.IntVar(&mesh.MemoryMaxAge, "peers-max-age", mesh.MemoryMaxAge, "Forget peers not seen for this amount of seconds (0 to never forget).")
+	flag.IntVar(&mesh.MemoryMinEncounters, "peers-min-encounters", mesh.MemoryMinEncounters, "Forget inactive peers met in less than this number of separate encounter sessions (0 to keep all).")
+	flag.IntVar(&mesh.MemoryEncountersGrace, "peers-min-encounters-grace", mesh.MemoryEncountersGrace, "Seconds after the last sighting before -peers-min-encounters applies to a peer.")
+	flag.BoolVar(&mesh.HopEnabled, "hopping", mesh.HopEnabled, "Enable coordinated channel hopping on the monitor interface.")
+	flag.IntVar(&mesh.HopPeriod, "hop-period", mesh.HopPeriod, "Channel hopping time slot in milliseconds, between 100 and 60000.")
+	flag.StringVar(&mesh.HopChannels, "hop-channels", mesh.HopChannels, "Comma separated list of rendezvous channels.")
+	flag.IntVar(&mesh.DwellFactor, "hop-dwell", mesh.DwellFactor, "When peers are detected, spend this many slots on their channels for every rendezvous slot.")
 	flag.IntVar(&mesh.SignalingPeriod, "signaling-period", mesh.SignalingPeriod, "Period in milliseconds for mesh signaling frames.")
+	flag.IntVar(&mesh.AdvMaxPeriod, "signaling-max-period", mesh.AdvMaxPeriod, "Maximum period in milliseconds for mesh signaling frames when no peers are around.")
+	flag.IntVar(&mesh.AdvBoostPeriod, "signaling-boost-period", mesh.AdvBoostPeriod, "Period in milliseconds for mesh signaling frames right after a new peer is detected.")
+	flag.IntVar(&mesh.AdvBoostTime, "signaling-boost-time", mesh.AdvBoostTime, "How many seconds to use the boost period for after a new peer is detected.")
+	flag.IntVar(&mesh.AdvJitter, "signaling-jitter", mesh.AdvJitter, "Random jitter percentage applied to the signaling period, from 0 to 99.")
+	flag.StringVar(&mesh.AdvQuietHours, "quiet-hours", mesh.AdvQuietHours, "Comma separated list of HH:MM-HH:MM time ranges during which signaling is reduced.")
+	flag.IntVar(&mesh.AdvQuietPeriod, "quiet-period", mesh.AdvQuietPeriod, "Period in milliseconds for mesh signaling frames during quiet hours, 0 to stop signaling.")
+
+	flag.StringVar(&hooksPath, "hooks", hooksPath, "If set, load the event hooks configuration from this JSON file.")
+	flag.IntVar(&inboxPeriod, "hooks-inbox-period", inboxPeriod, "Period in seconds to check the inbox for new messages when inbox hooks are configured.")
 
 	flag.BoolVar(&whoami, "whoami", whoami, "Prints the public key fingerprint and exit.")
 	flag.BoolVar(&inbox, "inbox", inbox, "Show inbox.")
@@ -73,3 +138,76 @@ func init() {
 	flag.StringVar(&cpuProfile, "cpu-profile", cpuProfile, "Generate CPU profile to this file.")
 	flag.StringVar(&memProfile, "mem-profile", cpuProfile, "Generate memory profile to this file.")
 }
+
+// periods and limits that would make the workers panic or spin if not positive
+func positiveFlags() map[string]int {
+	return map[string]int{
+		"-client-timeout":            api.ClientTimeout,
+		"-peers-flush-period":        mesh.MemoryFlushPeriod,
+		"-files-max-size":            mesh.FileMaxSize,
+		"-shouts-ttl":                mesh.ShoutTTL,
+		"-peers-ttl":                 mesh.PeerTTL,
+		"-presence-fading":           mesh.PresenceFadingAfter,
+		"-presence-away":             mesh.PresenceAwayAfter,
+		"-signal-window":             mesh.SignalWindow,
+		"-mesh-reconnect-max":        mesh.ReconnectMaxDelay,
+		"-mesh-link-check":           mesh.LinkCheckPeriod,
+		"-signaling-budget":          mesh.AdvFrameBudget,
+		"-signaling-snapshot-period": mesh.AdvSnapshotPeriod,
+		"-mesh-proofs-interval":      mesh.ProofInterval,
+		"-hop-period":                mesh.HopPeriod,
+		"-signaling-period":          mesh.SignalingPeriod,
+		"-signaling-max-period":      mesh.AdvMaxPeriod,
+		"-signaling-boost-period":    mesh.AdvBoostPeriod,
+		"-hooks-inbox-period":        inboxPeriod,
+		"-loop-period":               loopPeriod,
+		// not configurable from the command line
+		"mesh.PrivateKeyPeriod": mesh.PrivateKeyPeriod,
+		"mesh.GroupKeyPeriod":   mesh.GroupKeyPeriod,
+		"mesh.ShoutPeriod":      mesh.ShoutPeriod,
+		"mesh.NeighboursPeriod": mesh.NeighboursPeriod,
+		"mesh.ProofTimeout":     mesh.ProofTimeout,
+		"mesh.FileOfferPeriod":  mesh.FileOfferPeriod,
+		"mesh.FragmentTimeout":  mesh.FragmentTimeout,
+	}
+}
+
+// limits for which 0 means disabled or unlimited
+func nonNegativeFlags() map[string]int {
+	return map[string]int{
+		"-groups-sync-period":         groupsSync,
+		"-shouts-min-interval":        mesh.ShoutMinInterval,
+		"-presence-min-silence":       mesh.PresenceMinSilence,
+		"-presence-recover":           mesh.PresenceRecoverFrames,
+		"-mesh-neighbours-max":        mesh.NeighboursMax,
+		"-session-rotation":           mesh.SessionRotation,
+		"-peers-max":                  mesh.MemoryMaxPeers,
+		"-peers-max-age":              mesh.MemoryMaxAge,
+		"-peers-min-encounters":       mesh.MemoryMinEncounters,
+		"-peers-min-encounters-grace": mesh.MemoryEncountersGrace,
+		"-hop-dwell":                  mesh.DwellFactor,
+		"-signaling-boost-time":       mesh.AdvBoostTime,
+		"-quiet-period":               mesh.AdvQuietPeriod,
+		"-signaling-jitter":           mesh.AdvJitter,
+	}
+}
+
+func validateFlags() error {
+	if !(mesh.PathLossExponent > 0) {
+		return fmt.Errorf("-path-loss must be greater than 0, got %f", mesh.PathLossExponent)
+	}
+	if mesh.AdvJitter > mesh.AdvMaxJitter {
+		return fmt.Errorf("-signaling-jitter can't be greater than %d, got %d", mesh.AdvMaxJitter, mesh.AdvJitter)
+	}
+	for name, value := range positiveFlags() {
+		if value <= 0 {
+			return fmt.Errorf("%s must be greater than 0, got %d", name, value)
+		}
+	}
+	for name, value := range nonNegativeFlags() {
+		if value < 0 {
+			return fmt.Errorf("%s can't be negative, got %d", name, value)
+		}
+	}
+	return nil
+}
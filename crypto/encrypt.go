@@ -118,3 +118,42 @@ func (pair *KeyPair) Decrypt(ciphertext []byte) ([]byte, error) {
 
 	return gcm.Open(nil, nonce, ciphertext, nil)
 }
+
+// EncryptWith encrypts the cleartext in AES-GCM with a symmetric key, the nonce is prepended to the ciphertext.
+func EncryptWith(key []byte, cleartext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, NonceLength)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, cleartext, nil), nil
+}
+
+// DecryptWith decrypts data encrypted with EncryptWith.
+func DecryptWith(key []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < NonceLength {
+		return nil, fmt.Errorf("data buffer too short")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Open(nil, ciphertext[:NonceLength], ciphertext[NonceLength:], nil)
+}
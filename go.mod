@@ -11,5 +11,6 @@ require (
 	github.com/google/gopacket v1.1.17
 	github.com/jinzhu/gorm v1.9.11
 	github.com/joho/godotenv v1.3.0
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20191002192127-34f69633bfdc // indirect
 )
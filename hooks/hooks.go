@@ -0,0 +1,213 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/evilsocket/islazy/fs"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/metrics"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	EventPeerNew      = "peer_new"
+	EventPeerLost     = "peer_lost"
+	EventInboxMessage = "inbox_message"
+	EventSignaling    = "signaling"
+	EventPeerPresence = "peer_presence"
+)
+
+var (
+	DefaultTimeout       = 30
+	DefaultMaxConcurrent = 4
+	// events waiting for a hook slot, beyond this they are dropped
+	DefaultQueueSize = 64
+
+	eventsDropped = metrics.NewCounter("pwngrid_hooks_events_dropped_total", "Events dropped because the hooks queue was full.", "event")
+)
+
+// Event is what hooks receive as JSON on their standard input.
+type Event struct {
+	Type        string      `json:"type"`
+	Time        time.Time   `json:"time"`
+	Fingerprint string      `json:"fingerprint,omitempty"`
+	Data        interface{} `json:"data,omitempty"`
+}
+
+func NewEvent(eventType string, fingerprint string, data interface{}) Event {
+	return Event{
+		Type:        eventType,
+		Time:        time.Now(),
+		Fingerprint: fingerprint,
+		Data:        data,
+	}
+}
+
+type Hook struct {
+	Event   string   `json:"event"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	// timeout in seconds after which the process is killed
+	Timeout int `json:"timeout"`
+	// if not empty, the hook only runs for events related to these fingerprints
+	Fingerprints []string `json:"fingerprints"`
+}
+
+func (hook *Hook) matches(event Event) bool {
+	if hook.Event != event.Type {
+		return false
+	} else if len(hook.Fingerprints) == 0 {
+		return true
+	}
+
+	for _, fingerprint := range hook.Fingerprints {
+		if strings.EqualFold(fingerprint, event.Fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+type config struct {
+	MaxConcurrent int     `json:"max_concurrent"`
+	QueueSize     int     `json:"queue_size"`
+	Hooks         []*Hook `json:"hooks"`
+}
+
+type job struct {
+	hook    *Hook
+	event   Event
+	payload []byte
+}
+
+type Manager struct {
+	hooks []*Hook
+	queue chan job
+}
+
+func Load(fileName string) (err error, mgr *Manager) {
+	if fileName, err = fs.Expand(fileName); err != nil {
+		return err, nil
+	}
+
+	conf := config{
+		MaxConcurrent: DefaultMaxConcurrent,
+		QueueSize:     DefaultQueueSize,
+	}
+
+	log.Debug("loading hooks from %s ...", fileName)
+	if data, err := ioutil.ReadFile(fileName); err != nil {
+		return fmt.Errorf("error loading %s: %v", fileName, err), nil
+	} else if err = json.Unmarshal(data, &conf); err != nil {
+		return fmt.Errorf("error loading %s: %v", fileName, err), nil
+	}
+
+	if conf.MaxConcurrent <= 0 {
+		conf.MaxConcurrent = DefaultMaxConcurrent
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = DefaultQueueSize
+	}
+
+	for _, hook := range conf.Hooks {
+		if hook.Command == "" {
+			return fmt.Errorf("hook for event '%s' has no command", hook.Event), nil
+		} else if hook.Timeout <= 0 {
+			hook.Timeout = DefaultTimeout
+		}
+		log.Debug("hook %s -> %s %v", hook.Event, hook.Command, hook.Args)
+	}
+
+	mgr = &Manager{
+		hooks: conf.Hooks,
+		queue: make(chan job, conf.QueueSize),
+	}
+
+	for i := 0; i < conf.MaxConcurrent; i++ {
+		go mgr.worker()
+	}
+
+	log.Info("loaded %d hooks (max concurrent:%d queue:%d)", len(mgr.hooks), conf.MaxConcurrent, conf.QueueSize)
+
+	return nil, mgr
+}
+
+// returns true if at least one hook is registered for this event type
+func (mgr *Manager) Handles(eventType string) bool {
+	if mgr == nil {
+		return false
+	}
+	for _, hook := range mgr.hooks {
+		if hook.Event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (mgr *Manager) worker() {
+	for j := range mgr.queue {
+		mgr.run(j.hook, j.event, j.payload)
+	}
+}
+
+// queues every hook matching the event to run in the background, events are dropped if the queue is full
+func (mgr *Manager) Fire(event Event) {
+	if mgr == nil {
+		return
+	}
+
+	var payload []byte
+	for _, hook := range mgr.hooks {
+		if !hook.matches(event) {
+			continue
+		}
+
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(event); err != nil {
+				log.Error("error encoding %s event: %v", event.Type, err)
+				return
+			}
+		}
+
+		select {
+		case mgr.queue <- job{hook: hook, event: event, payload: payload}:
+		default:
+			eventsDropped.Inc(event.Type)
+			log.Warning("hooks queue is full, dropping %s event for %s", event.Type, hook.Command)
+		}
+	}
+}
+
+func (mgr *Manager) run(hook *Hook, event Event, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(hook.Timeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.Command, hook.Args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("PWNGRID_EVENT=%s", event.Type),
+		fmt.Sprintf("PWNGRID_TIME=%d", event.Time.Unix()),
+		fmt.Sprintf("PWNGRID_FINGERPRINT=%s", event.Fingerprint))
+
+	started := time.Now()
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Warning("hook %s for %s timed out after %s", hook.Command, event.Type, time.Since(started))
+	} else if err != nil {
+		log.Warning("hook %s for %s failed: %v", hook.Command, event.Type, err)
+	} else {
+		log.Debug("hook %s for %s completed in %s", hook.Command, event.Type, time.Since(started))
+	}
+
+	if len(out) > 0 {
+		log.Debug("%s: %s", hook.Command, out)
+	}
+}
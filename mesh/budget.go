@@ -0,0 +1,181 @@
+package mesh
+
+import (
+	"encoding/json"
+	"github.com/evilsocket/pwngrid/wifi"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type Priority int
+
+const (
+	PriorityLow Priority = iota + 1
+	PriorityNormal
+	PriorityHigh
+	// never left out, even if the frame doesn't fit the budget
+	PriorityRequired
+)
+
+const (
+	OverflowDrop   = "drop"
+	OverflowRotate = "rotate"
+)
+
+var (
+	// maximum size in bytes of an advertisement frame
+	AdvFrameBudget = 1400
+	// what to do with the fields that don't fit: always drop the same ones or rotate them across beacons
+	AdvOverflow = OverflowRotate
+
+	frameOverhead     = 0
+	frameOverheadOnce = sync.Once{}
+)
+
+// BudgetStatus reports how the advertisement fits in a frame.
+type BudgetStatus struct {
+	Budget   int      `json:"budget"`
+	Size     int      `json:"size"`
+	Headroom int      `json:"headroom"`
+	Overflow string   `json:"overflow"`
+	Dropped  []string `json:"dropped"`
+	// size of the frame if every field was sent
+	FullSize int `json:"full_size"`
+}
+
+// budget for the advertisement data before the private fields are encrypted, their base64
+// encoded ciphertext is about 4/3 of the cleartext plus nonce and tag
+func advBudget() int {
+	if PrivateAdvertisements {
+		return AdvFrameBudget*3/4 - 64
+	}
+	return AdvFrameBudget
+}
+
+// size in bytes of an advertisement frame carrying a payload of the given size
+func frameSize(payloadSize int) int {
+	frameOverheadOnce.Do(func() {
+		if err, raw := wifi.Pack(make(net.HardwareAddr, 6), wifi.BroadcastAddr, nil, false); err == nil {
+			frameOverhead = len(raw)
+		}
+	})
+	// every 255 bytes chunk of payload is an information element with a 2 bytes header
+	chunks := (payloadSize + 0xfe) / 0xff
+	return frameOverhead + payloadSize + 2*chunks
+}
+
+type budgetField struct {
+	name     string
+	priority Priority
+}
+
+// fields of the advertisement, extension fields are budgeted one by one as ext.<name>
+func budgetFields(data map[string]interface{}) []budgetField {
+	list := make([]budgetField, 0, len(data))
+	for key, value := range data {
+		if ext, ok := value.(map[string]interface{}); ok && key == ExtField {
+			for extKey := range ext {
+				list = append(list, budgetField{name: ExtField + "." + extKey, priority: PriorityLow})
+			}
+		} else if spec := fields[key]; spec != nil {
+			list = append(list, budgetField{name: key, priority: spec.Priority})
+		} else {
+			list = append(list, budgetField{name: key, priority: PriorityNormal})
+		}
+	}
+	return list
+}
+
+func setBudgetField(frame map[string]interface{}, data map[string]interface{}, name string) {
+	if strings.HasPrefix(name, ExtField+".") {
+		key := name[len(ExtField)+1:]
+		ext, ok := frame[ExtField].(map[string]interface{})
+		if !ok {
+			ext = make(map[string]interface{})
+			frame[ExtField] = ext
+		}
+		ext[key] = data[ExtField].(map[string]interface{})[key]
+	} else {
+		frame[name] = data[name]
+	}
+}
+
+func delBudgetField(frame map[string]interface{}, name string) {
+	if strings.HasPrefix(name, ExtField+".") {
+		if ext, ok := frame[ExtField].(map[string]interface{}); ok {
+			delete(ext, name[len(ExtField)+1:])
+			if len(ext) == 0 {
+				delete(frame, ExtField)
+			}
+		}
+	} else {
+		delete(frame, name)
+	}
+}
+
+func encodedSize(frame map[string]interface{}) int {
+	raw, err := json.Marshal(frame)
+	if err != nil {
+		return 0
+	}
+	return frameSize(len(raw))
+}
+
+// returns the subset of the advertisement data that fits the budget. Fields are added by
+// priority and, with the same priority, in an order that is rotated by round if AdvOverflow is
+// OverflowRotate, so that every field is eventually sent.
+func fitBudget(data map[string]interface{}, budget int, round int) (map[string]interface{}, *BudgetStatus) {
+	status := &BudgetStatus{
+		Budget:   budget,
+		Overflow: AdvOverflow,
+		Dropped:  make([]string, 0),
+		FullSize: encodedSize(data),
+	}
+
+	if status.FullSize <= budget {
+		status.Size = status.FullSize
+		status.Headroom = budget - status.Size
+		return data, status
+	}
+
+	list := budgetFields(data)
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].priority != list[j].priority {
+			return list[i].priority > list[j].priority
+		}
+		return list[i].name < list[j].name
+	})
+
+	if AdvOverflow == OverflowRotate && round > 0 {
+		// rotate the fields of each priority class
+		for start := 0; start < len(list); {
+			end := start
+			for end < len(list) && list[end].priority == list[start].priority {
+				end++
+			}
+			if class := list[start:end]; len(class) > 1 && class[0].priority != PriorityRequired {
+				shift := round % len(class)
+				rotated := append(append([]budgetField{}, class[shift:]...), class[:shift]...)
+				copy(class, rotated)
+			}
+			start = end
+		}
+	}
+
+	frame := make(map[string]interface{})
+	for _, field := range list {
+		setBudgetField(frame, data, field.name)
+		if field.priority != PriorityRequired && encodedSize(frame) > budget {
+			delBudgetField(frame, field.name)
+			status.Dropped = append(status.Dropped, field.name)
+		}
+	}
+
+	sort.Strings(status.Dropped)
+	status.Size = encodedSize(frame)
+	status.Headroom = budget - status.Size
+
+	return frame, status
+}
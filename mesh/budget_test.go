@@ -0,0 +1,80 @@
+package mesh
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testAdvertisement() map[string]interface{} {
+	return map[string]interface{}{
+		"identity":   strings.Repeat("a", 64),
+		"session_id": "aa:bb:cc:dd:ee:ff",
+		"name":       "alpha",
+		"face":       "(◕‿‿◕)",
+		"version":    "1.0.0",
+		ExtField:     map[string]interface{}{"one": strings.Repeat("1", 200), "two": strings.Repeat("2", 200)},
+	}
+}
+
+func TestFitBudget(t *testing.T) {
+	defer func(prev string) { AdvOverflow = prev }(AdvOverflow)
+	AdvOverflow = OverflowDrop
+
+	data := testAdvertisement()
+	full := encodedSize(data)
+	required := encodedSize(map[string]interface{}{
+		"identity":   data["identity"],
+		"session_id": data["session_id"],
+	})
+
+	tests := []struct {
+		name    string
+		budget  int
+		dropped []string
+	}{
+		{"everything fits", full, []string{}},
+		{"low priority dropped first", full - 200, []string{"ext.two"}},
+		{"only required fields", required, []string{"ext.one", "ext.two", "face", "name", "version"}},
+		{"required fields are never dropped", 1, []string{"ext.one", "ext.two", "face", "name", "version"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, status := fitBudget(data, test.budget, 0)
+			if !reflect.DeepEqual(status.Dropped, test.dropped) {
+				t.Fatalf("expected %v to be dropped, got %v", test.dropped, status.Dropped)
+			} else if status.FullSize != full {
+				t.Fatalf("expected full size %d, got %d", full, status.FullSize)
+			} else if status.Size != encodedSize(frame) {
+				t.Fatalf("expected size %d, got %d", encodedSize(frame), status.Size)
+			} else if _, found := frame["identity"]; !found {
+				t.Fatalf("required field missing")
+			} else if test.budget >= required && status.Size > test.budget {
+				t.Fatalf("frame of %d bytes exceeds the budget of %d", status.Size, test.budget)
+			}
+		})
+	}
+}
+
+func TestFitBudgetRotate(t *testing.T) {
+	defer func(prev string) { AdvOverflow = prev }(AdvOverflow)
+	AdvOverflow = OverflowRotate
+
+	data := testAdvertisement()
+	// room for a single one of the extension fields
+	budget := encodedSize(data) - 200
+
+	sent := make(map[string]bool)
+	for round := 0; round < 2; round++ {
+		_, status := fitBudget(data, budget, round)
+		if len(status.Dropped) != 1 {
+			t.Fatalf("round %d: expected one field to be dropped, got %v", round, status.Dropped)
+		}
+		sent[status.Dropped[0]] = true
+	}
+
+	if !sent["ext.one"] || !sent["ext.two"] {
+		t.Fatalf("expected both extension fields to be rotated, dropped %v", sent)
+	}
+}
@@ -0,0 +1,240 @@
+package mesh
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// sliding windows in seconds for the channel statistics, the longest one is how much history is kept
+	ChannelWindows = []int{60, 300}
+	// minimum number of frames over the longest window for a channel to be recommended
+	ChannelMinFrames = 10
+)
+
+const (
+	// PLCP preamble and header duration of a long preamble DSSS frame
+	plcpAirtime = 192 * time.Microsecond
+	// beacons are sent at the lowest rate if radiotap doesn't say otherwise
+	defaultRate = 1.0
+)
+
+// per second aggregation of the frames seen on a channel
+type channelBucket struct {
+	second  int64
+	frames  uint64
+	rssiSum int64
+	airtime time.Duration
+	peers   map[string]bool
+}
+
+// ChannelWindowStats are the statistics of a channel over the last Window seconds.
+type ChannelWindowStats struct {
+	Window  int     `json:"window"`
+	Frames  uint64  `json:"frames"`
+	Peers   int     `json:"peers"`
+	RSSIAvg float64 `json:"rssi_avg"`
+	// estimated fraction of time the channel has been busy with mesh frames
+	Airtime float64 `json:"airtime"`
+}
+
+type ChannelUsage struct {
+	Channel int                   `json:"channel"`
+	SeenAt  time.Time             `json:"seen_at"`
+	Windows []*ChannelWindowStats `json:"windows"`
+}
+
+type ChannelsReport struct {
+	Channels    []*ChannelUsage `json:"channels"`
+	Recommended int             `json:"recommended"`
+}
+
+// Channels keeps occupancy and peer density statistics for every channel mesh frames are received on.
+type Channels struct {
+	sync.Mutex
+	buckets map[int][]*channelBucket
+	seenAt  map[int]time.Time
+}
+
+func NewChannels() *Channels {
+	return &Channels{
+		buckets: make(map[int][]*channelBucket),
+		seenAt:  make(map[int]time.Time),
+	}
+}
+
+func maxWindow() int {
+	max := 0
+	for _, w := range ChannelWindows {
+		if w > max {
+			max = w
+		}
+	}
+	return max
+}
+
+// estimated time on air of a frame of the given size at the given rate in Mbps
+func frameAirtime(size int, rate float64) time.Duration {
+	if rate <= 0 {
+		rate = defaultRate
+	}
+	return plcpAirtime + time.Duration(float64(size*8)/rate)*time.Microsecond
+}
+
+func (c *Channels) Seen(at time.Time, channel int, sender string, rssi int, size int, rate float64) {
+	if channel <= 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	second := at.Unix()
+	buckets := c.buckets[channel]
+
+	var bucket *channelBucket
+	if n := len(buckets); n > 0 && buckets[n-1].second == second {
+		bucket = buckets[n-1]
+	} else {
+		bucket = &channelBucket{
+			second: second,
+			peers:  make(map[string]bool),
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	bucket.frames++
+	bucket.rssiSum += int64(rssi)
+	bucket.airtime += frameAirtime(size, rate)
+	bucket.peers[sender] = true
+
+	c.buckets[channel] = c.prune(buckets, second)
+	c.seenAt[channel] = at
+}
+
+// to be called with the lock held
+func (c *Channels) prune(buckets []*channelBucket, now int64) []*channelBucket {
+	from := now - int64(maxWindow())
+	idx := 0
+	for idx < len(buckets) && buckets[idx].second <= from {
+		idx++
+	}
+	return buckets[idx:]
+}
+
+// to be called with the lock held
+func (c *Channels) usage(channel int, now time.Time) *ChannelUsage {
+	buckets := c.prune(c.buckets[channel], now.Unix())
+	c.buckets[channel] = buckets
+
+	usage := &ChannelUsage{
+		Channel: channel,
+		SeenAt:  c.seenAt[channel],
+		Windows: make([]*ChannelWindowStats, 0, len(ChannelWindows)),
+	}
+
+	for _, window := range ChannelWindows {
+		stats := &ChannelWindowStats{Window: window}
+		from := now.Unix() - int64(window)
+		peers := make(map[string]bool)
+		rssiSum := int64(0)
+		airtime := time.Duration(0)
+
+		for _, bucket := range buckets {
+			if bucket.second > from {
+				stats.Frames += bucket.frames
+				rssiSum += bucket.rssiSum
+				airtime += bucket.airtime
+				for peer := range bucket.peers {
+					peers[peer] = true
+				}
+			}
+		}
+
+		stats.Peers = len(peers)
+		if stats.Frames > 0 {
+			stats.RSSIAvg = float64(rssiSum) / float64(stats.Frames)
+		}
+		stats.Airtime = airtime.Seconds() / float64(window)
+
+		usage.Windows = append(usage.Windows, stats)
+	}
+
+	return usage
+}
+
+// returns the statistics of every channel, those without frames in the longest window are dropped
+func (c *Channels) Usage() []*ChannelUsage {
+	c.Lock()
+	defer c.Unlock()
+	return c.list(time.Now())
+}
+
+// to be called with the lock held
+func (c *Channels) list(now time.Time) []*ChannelUsage {
+	list := make([]*ChannelUsage, 0)
+	for channel := range c.buckets {
+		if usage := c.usage(channel, now); len(c.buckets[channel]) > 0 {
+			list = append(list, usage)
+		} else {
+			delete(c.buckets, channel)
+			delete(c.seenAt, channel)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Channel < list[j].Channel
+	})
+	return list
+}
+
+// the best rendezvous channel among the candidates is the one where more peers have been seen over the
+// longest window, ties are broken by the lowest airtime. Returns 0 if there's not enough data.
+func (c *Channels) Best(candidates []int) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.best(c.list(time.Now()), candidates)
+}
+
+func (c *Channels) best(list []*ChannelUsage, candidates []int) int {
+	allowed := make(map[int]bool)
+	for _, ch := range candidates {
+		allowed[ch] = true
+	}
+
+	best := 0
+	var bestStats *ChannelWindowStats
+	for _, usage := range list {
+		if len(candidates) > 0 && !allowed[usage.Channel] {
+			continue
+		}
+
+		var stats *ChannelWindowStats
+		for _, w := range usage.Windows {
+			if stats == nil || w.Window > stats.Window {
+				stats = w
+			}
+		}
+
+		if stats == nil || stats.Frames < uint64(ChannelMinFrames) {
+			continue
+		} else if bestStats == nil || stats.Peers > bestStats.Peers ||
+			(stats.Peers == bestStats.Peers && stats.Airtime < bestStats.Airtime) {
+			best = usage.Channel
+			bestStats = stats
+		}
+	}
+
+	return best
+}
+
+func (c *Channels) Report(candidates []int) *ChannelsReport {
+	c.Lock()
+	defer c.Unlock()
+
+	list := c.list(time.Now())
+	return &ChannelsReport{
+		Channels:    list,
+		Recommended: c.best(list, candidates),
+	}
+}
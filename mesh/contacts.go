@@ -0,0 +1,199 @@
+package mesh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/evilsocket/islazy/fs"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/crypto"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of bytes of the HMAC used as blinded identity
+const BlindedSize = 16
+
+// BlindIdentity returns HMAC(key, session_id): it changes with every session id rotation and can only be
+// linked to a unit by the contacts it shared its private advertisement key with.
+func BlindIdentity(key []byte, sessionID []byte) string {
+	mac := hmac.New(sha256.New, blindingKey(key))
+	mac.Write(sessionID)
+	return hex.EncodeToString(mac.Sum(nil)[:BlindedSize])
+}
+
+// the private advertisement key is also used to encrypt, derive a different one for blinding
+func blindingKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("pwngrid-blinding"))
+	return mac.Sum(nil)
+}
+
+type Contact struct {
+	Fingerprint string `json:"fingerprint"`
+	Name        string `json:"name,omitempty"`
+	// PEM of the contact, learned when it's met or set when adding it: needed to deliver our key
+	// when neither of us can resolve the other
+	PublicKey string    `json:"public_key,omitempty"`
+	AddedAt   time.Time `json:"added_at"`
+}
+
+// Contacts is the list of known units, the only ones that can resolve our identity when in privacy mode.
+type Contacts struct {
+	sync.Mutex
+	path     string
+	contacts map[string]*Contact
+	// private advertisement keys
+	key   []byte
+	epoch int
+	keys  map[string]*contactKeys
+}
+
+func ContactsFromPath(path string) (err error, contacts *Contacts) {
+	if path, err = fs.Expand(path); err != nil {
+		return err, nil
+	}
+
+	contacts = &Contacts{
+		path:     path,
+		contacts: make(map[string]*Contact),
+	}
+
+	if fs.Exists(path) {
+		log.Debug("loading %s ...", path)
+		list := make([]*Contact, 0)
+		if data, err := ioutil.ReadFile(path); err != nil {
+			return fmt.Errorf("error loading %s: %v", path, err), nil
+		} else if err = json.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("error loading %s: %v", path, err), nil
+		}
+
+		for _, contact := range list {
+			contacts.contacts[strings.ToLower(contact.Fingerprint)] = contact
+		}
+	}
+
+	if err = contacts.loadKeys(); err != nil {
+		return err, nil
+	}
+
+	log.Debug("loaded %d contacts", len(contacts.contacts))
+
+	return
+}
+
+func (c *Contacts) list() []*Contact {
+	list := make([]*Contact, 0, len(c.contacts))
+	for _, contact := range c.contacts {
+		list = append(list, contact)
+	}
+	return list
+}
+
+func (c *Contacts) save() error {
+	data, err := json.Marshal(c.list())
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := c.path + ".tmp"
+	if err = ioutil.WriteFile(tmpFileName, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, c.path)
+}
+
+func (c *Contacts) List() []*Contact {
+	c.Lock()
+	defer c.Unlock()
+	return c.list()
+}
+
+func (c *Contacts) Of(fingerprint string) *Contact {
+	c.Lock()
+	defer c.Unlock()
+	return c.contacts[strings.ToLower(fingerprint)]
+}
+
+func (c *Contacts) Add(contact Contact) error {
+	if !fingValidator.MatchString(contact.Fingerprint) {
+		return fmt.Errorf("invalid fingerprint %s", contact.Fingerprint)
+	} else if contact.PublicKey != "" {
+		if keys, err := crypto.FromPublicPEM(contact.PublicKey); err != nil {
+			return fmt.Errorf("invalid public key: %v", err)
+		} else if !strings.EqualFold(keys.FingerprintHex, contact.Fingerprint) {
+			return fmt.Errorf("public key fingerprint is %s", keys.FingerprintHex)
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	contact.Fingerprint = strings.ToLower(contact.Fingerprint)
+	if contact.AddedAt.IsZero() {
+		contact.AddedAt = time.Now()
+	}
+	if prev, found := c.contacts[contact.Fingerprint]; found && contact.PublicKey == "" {
+		contact.PublicKey = prev.PublicKey
+	}
+	c.contacts[contact.Fingerprint] = &contact
+
+	log.Info("contact %s added", contact.Fingerprint)
+
+	return c.save()
+}
+
+func (c *Contacts) Remove(fingerprint string) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	fingerprint = strings.ToLower(fingerprint)
+	if _, found := c.contacts[fingerprint]; !found {
+		return false, nil
+	}
+
+	delete(c.contacts, fingerprint)
+
+	log.Info("contact %s removed", fingerprint)
+
+	// it must not be able to read our private advertisements anymore
+	delete(c.keys, fingerprint)
+	if c.key != nil {
+		if err := c.rekey(); err != nil {
+			return true, err
+		}
+	} else if err := c.saveKeys(); err != nil {
+		return true, err
+	}
+
+	return true, c.save()
+}
+
+// returns the contact advertising the given blinded identity for the given session id, if any
+func (c *Contacts) Resolve(sessionID []byte, blinded string) *Contact {
+	c.Lock()
+	defer c.Unlock()
+
+	expected, err := hex.DecodeString(blinded)
+	if err != nil || len(expected) != BlindedSize {
+		return nil
+	}
+
+	for fingerprint, contact := range c.contacts {
+		keys, found := c.keys[fingerprint]
+		if !found || keys.Key == nil {
+			// this contact didn't share its key with us yet
+			continue
+		}
+		if got, _ := hex.DecodeString(BlindIdentity(keys.Key, sessionID)); hmac.Equal(got, expected) {
+			return contact
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package mesh
+
+import (
+	"encoding/json"
+	"github.com/evilsocket/islazy/log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// advertisement field with the version metadata
+	AdvMetaField = "adv"
+
+	MessageSnapshotRequest = "adv_snapshot"
+)
+
+const (
+	snapshotNone = iota
+	snapshotFull
+	// the snapshot didn't fit the frame budget, some fields are missing
+	snapshotPartial
+)
+
+var (
+	// if false every advertisement carries the full data
+	AdvDeltas = true
+	// period in seconds for a full snapshot of the advertisement data to be sent
+	AdvSnapshotPeriod = 30
+	// minimum time in seconds between two snapshot requests to the same peer
+	AdvSnapshotRetry = 5
+)
+
+// advMeta tags advertisements with the version of the data. Deltas are cumulative since the
+// last snapshot, receivers that got that snapshot can apply any of them even if some are lost.
+type advMeta struct {
+	Version  uint64   `json:"v"`
+	Base     uint64   `json:"base,omitempty"`
+	Snapshot int      `json:"snapshot,omitempty"`
+	Deleted  []string `json:"deleted,omitempty"`
+}
+
+func advMetaOf(adv map[string]interface{}) *advMeta {
+	obj, found := adv[AdvMetaField]
+	if !found {
+		return nil
+	}
+
+	var meta advMeta
+	if raw, err := json.Marshal(obj); err != nil {
+		return nil
+	} else if err = json.Unmarshal(raw, &meta); err != nil {
+		return nil
+	}
+	return &meta
+}
+
+// tracks a local change of the advertisement data, to be called with the lock held
+func (peer *Peer) changed(key string, value interface{}) bool {
+	prev, found := peer.AdvData.Load(key)
+	if (value == nil && !found) || (found && reflect.DeepEqual(prev, value)) {
+		return false
+	}
+	peer.advChanged[key] = true
+	return true
+}
+
+// forces the next advertisement to be a full snapshot
+func (peer *Peer) RequestSnapshot() {
+	peer.Lock()
+	defer peer.Unlock()
+	// many peers might ask at the same time
+	if time.Since(peer.snapAt) >= time.Second {
+		peer.snapForce = true
+	}
+}
+
+// returns the frame to send, either a full snapshot or the fields changed since the last one,
+// to be called with the lock held
+func (peer *Peer) deltaFrame(full map[string]interface{}) (map[string]interface{}, *advMeta) {
+	now := time.Now()
+	meta := &advMeta{Version: peer.advVersion}
+	snapshot := !AdvDeltas || peer.snapForce || peer.snapAt.IsZero() ||
+		now.Sub(peer.snapAt) >= time.Duration(AdvSnapshotPeriod)*time.Second
+
+	if !snapshot {
+		delta := make(map[string]interface{})
+		for key, value := range full {
+			if spec := fields[key]; (spec != nil && spec.Priority == PriorityRequired) || peer.advChanged[key] {
+				delta[key] = value
+			}
+		}
+		for key := range peer.advChanged {
+			if _, found := full[key]; !found {
+				meta.Deleted = append(meta.Deleted, key)
+			}
+		}
+		sort.Strings(meta.Deleted)
+		meta.Base = peer.snapVersion
+		delta[AdvMetaField] = meta
+
+		// a delta almost as big as the whole data is not worth it
+		if encodedSize(delta) < encodedSize(full)/2 {
+			return delta, meta
+		}
+	}
+
+	meta.Base = 0
+	meta.Deleted = nil
+	meta.Snapshot = snapshotFull
+
+	peer.snapForce = false
+	peer.snapAt = now
+	peer.snapVersion = peer.advVersion
+	peer.advChanged = make(map[string]bool)
+
+	full[AdvMetaField] = meta
+	return full, meta
+}
+
+// fields left out of a snapshot because of the budget are sent with the following deltas
+func (peer *Peer) leftOut(meta *advMeta, dropped []string) {
+	if meta.Snapshot == snapshotNone || len(dropped) == 0 {
+		return
+	}
+	meta.Snapshot = snapshotPartial
+	for _, name := range dropped {
+		if strings.HasPrefix(name, ExtField+".") {
+			name = ExtField
+		}
+		peer.advChanged[name] = true
+	}
+}
+
+// applies received advertisement data, to be called with the lock held
+func (peer *Peer) applyAdvertisement(adv map[string]interface{}) {
+	meta := advMetaOf(adv)
+	delete(adv, AdvMetaField)
+
+	if meta != nil && meta.Snapshot == snapshotFull {
+		peer.AdvData.Range(func(key, value interface{}) bool {
+			if _, found := adv[key.(string)]; !found {
+				peer.AdvData.Delete(key)
+			}
+			return true
+		})
+	}
+
+	for key, value := range adv {
+		peer.AdvData.Store(key, value)
+	}
+
+	if meta == nil {
+		// legacy units always send the whole data
+		return
+	}
+
+	switch {
+	case meta.Snapshot != snapshotNone:
+		peer.advVersion = meta.Version
+		peer.advSynced = true
+		peer.needSnapshot = false
+
+	case !peer.advSynced || peer.advVersion < meta.Base:
+		// we missed the snapshot this delta is based on, what we have might be incomplete
+		peer.needSnapshot = true
+
+	case meta.Version > peer.advVersion:
+		for _, key := range meta.Deleted {
+			peer.AdvData.Delete(key)
+		}
+		peer.advVersion = meta.Version
+	}
+}
+
+// returns true if a snapshot should be requested to this peer
+func (peer *Peer) wantsSnapshot() bool {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if !peer.needSnapshot || time.Since(peer.snapRequestedAt) < time.Duration(AdvSnapshotRetry)*time.Second {
+		return false
+	}
+	peer.snapRequestedAt = time.Now()
+	return true
+}
+
+func (router *Router) requestSnapshot(ident string, peer *Peer) {
+	if peer.wantsSnapshot() {
+		router.spawn(func() {
+			log.Debug("requesting advertisement snapshot to %s", ident)
+			if err := router.SendTo(ident, MessageSnapshotRequest, nil); err != nil {
+				log.Debug("error requesting snapshot to %s: %v", ident, err)
+			}
+		})
+	}
+}
+
+func (router *Router) onSnapshotRequest(ident string, peer *Peer, msg *Message) {
+	router.local.RequestSnapshot()
+}
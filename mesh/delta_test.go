@@ -0,0 +1,105 @@
+package mesh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func advData(peer *Peer) map[string]interface{} {
+	data := make(map[string]interface{})
+	peer.AdvData.Range(func(key, value interface{}) bool {
+		data[key.(string)] = value
+		return true
+	})
+	return data
+}
+
+func TestApplyAdvertisement(t *testing.T) {
+	snapshot := func(version uint64, data map[string]interface{}) map[string]interface{} {
+		data[AdvMetaField] = map[string]interface{}{"v": float64(version), "snapshot": float64(snapshotFull)}
+		return data
+	}
+	delta := func(version, base uint64, deleted []interface{}, data map[string]interface{}) map[string]interface{} {
+		data[AdvMetaField] = map[string]interface{}{"v": float64(version), "base": float64(base), "deleted": deleted}
+		return data
+	}
+
+	tests := []struct {
+		name     string
+		frames   []map[string]interface{}
+		expected map[string]interface{}
+		version  uint64
+		needSnap bool
+	}{
+		{
+			name: "legacy frames replace fields",
+			frames: []map[string]interface{}{
+				{"name": "a", "face": "x"},
+				{"name": "b"},
+			},
+			expected: map[string]interface{}{"name": "b", "face": "x"},
+		},
+		{
+			name: "snapshot removes missing fields",
+			frames: []map[string]interface{}{
+				snapshot(1, map[string]interface{}{"name": "a", "face": "x"}),
+				snapshot(2, map[string]interface{}{"name": "a"}),
+			},
+			expected: map[string]interface{}{"name": "a"},
+			version:  2,
+		},
+		{
+			name: "delta applied on its snapshot",
+			frames: []map[string]interface{}{
+				snapshot(1, map[string]interface{}{"name": "a", "face": "x"}),
+				delta(3, 1, []interface{}{"face"}, map[string]interface{}{"uptime": float64(10)}),
+			},
+			expected: map[string]interface{}{"name": "a", "uptime": float64(10)},
+			version:  3,
+		},
+		{
+			name: "stale delta doesn't delete",
+			frames: []map[string]interface{}{
+				snapshot(5, map[string]interface{}{"name": "a", "face": "x"}),
+				delta(4, 1, []interface{}{"face"}, map[string]interface{}{}),
+			},
+			expected: map[string]interface{}{"name": "a", "face": "x"},
+			version:  5,
+		},
+		{
+			name: "delta without snapshot",
+			frames: []map[string]interface{}{
+				delta(3, 1, nil, map[string]interface{}{"name": "a"}),
+			},
+			expected: map[string]interface{}{"name": "a"},
+			needSnap: true,
+		},
+		{
+			name: "delta on a missed snapshot",
+			frames: []map[string]interface{}{
+				snapshot(1, map[string]interface{}{"name": "a"}),
+				delta(6, 4, nil, map[string]interface{}{"name": "b"}),
+			},
+			expected: map[string]interface{}{"name": "b"},
+			version:  1,
+			needSnap: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peer := &Peer{}
+			for _, frame := range test.frames {
+				peer.applyAdvertisement(frame)
+			}
+
+			if data := advData(peer); !reflect.DeepEqual(data, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, data)
+			} else if peer.advVersion != test.version {
+				t.Fatalf("expected version %d, got %d", test.version, peer.advVersion)
+			} else if peer.needSnapshot != test.needSnap {
+				t.Fatalf("expected need snapshot %v, got %v", test.needSnap, peer.needSnapshot)
+			}
+		})
+	}
+}
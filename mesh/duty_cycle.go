@@ -0,0 +1,200 @@
+package mesh
+
+import (
+	"fmt"
+	"github.com/evilsocket/islazy/str"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// upper bound in milliseconds of the advertisement period when nobody is around
+	AdvMaxPeriod = 5000
+	// period in milliseconds used for AdvBoostTime seconds after a new peer is detected
+	AdvBoostPeriod = 100
+	AdvBoostTime   = 10
+	// random jitter applied to each period, in percentage
+	AdvJitter = 20
+	// the jitter is clamped to this so that a period can never get to zero
+	AdvMaxJitter = 99
+	// comma separated list of HH:MM-HH:MM ranges
+	AdvQuietHours = ""
+	// period in milliseconds during quiet hours, 0 to stop advertising
+	AdvQuietPeriod = 0
+)
+
+type timeRange struct {
+	from int
+	to   int
+}
+
+func (r timeRange) contains(minute int) bool {
+	if r.from <= r.to {
+		return minute >= r.from && minute < r.to
+	}
+	// the range crosses midnight
+	return minute >= r.from || minute < r.to
+}
+
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil {
+		return 0, fmt.Errorf("can't parse '%s' as HH:MM: %v", s, err)
+	} else if h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid time %s", s)
+	}
+	return h*60 + m, nil
+}
+
+func parseQuietHours(spec string) ([]timeRange, error) {
+	ranges := make([]timeRange, 0)
+	for _, part := range str.Comma(spec) {
+		bounds := strings.Split(part, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("can't parse quiet hours range '%s'", part)
+		}
+
+		from, err := parseClock(str.Trim(bounds[0]))
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClock(str.Trim(bounds[1]))
+		if err != nil {
+			return nil, err
+		}
+
+		ranges = append(ranges, timeRange{from: from, to: to})
+	}
+	return ranges, nil
+}
+
+type PeersCounter func() int
+
+// DutyCycle computes the advertisement period: it backs off exponentially while nobody is around,
+// speeds up for a while after a new peer is detected and slows down or stops during quiet hours.
+type DutyCycle struct {
+	sync.Mutex
+	base       time.Duration
+	current    time.Duration
+	effective  time.Duration
+	boostUntil time.Time
+	quiet      []timeRange
+	quietNow   bool
+	peers      PeersCounter
+}
+
+type DutyCycleStatus struct {
+	Base       int       `json:"base"`
+	Effective  int       `json:"effective"`
+	Backoff    int       `json:"backoff"`
+	BoostUntil time.Time `json:"boost_until"`
+	Quiet      bool      `json:"quiet"`
+	Peers      int       `json:"peers"`
+}
+
+func NewDutyCycle(basePeriod int) *DutyCycle {
+	base := time.Duration(basePeriod) * time.Millisecond
+	return &DutyCycle{
+		base:      base,
+		current:   base,
+		effective: base,
+		quiet:     make([]timeRange, 0),
+		peers:     func() int { return 0 },
+	}
+}
+
+func (dc *DutyCycle) SetQuietHours(spec string) error {
+	ranges, err := parseQuietHours(spec)
+	if err != nil {
+		return err
+	}
+
+	dc.Lock()
+	defer dc.Unlock()
+	dc.quiet = ranges
+	return nil
+}
+
+func (dc *DutyCycle) CountPeersWith(cb PeersCounter) {
+	dc.Lock()
+	defer dc.Unlock()
+	dc.peers = cb
+}
+
+// to be called when a new peer is detected
+func (dc *DutyCycle) Boost() {
+	dc.Lock()
+	defer dc.Unlock()
+	dc.boostUntil = time.Now().Add(time.Duration(AdvBoostTime) * time.Second)
+	dc.current = dc.base
+}
+
+func (dc *DutyCycle) isQuiet(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	for _, r := range dc.quiet {
+		if r.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns how long to wait before the next advertisement and whether it should be sent at all
+func (dc *DutyCycle) Next(now time.Time) (time.Duration, bool) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	dc.quietNow = dc.isQuiet(now)
+	if dc.quietNow {
+		if AdvQuietPeriod <= 0 {
+			// check again in a minute
+			dc.effective = 0
+			return time.Minute, false
+		}
+		dc.effective = time.Duration(AdvQuietPeriod) * time.Millisecond
+	} else if now.Before(dc.boostUntil) {
+		dc.effective = time.Duration(AdvBoostPeriod) * time.Millisecond
+	} else if dc.peers() == 0 {
+		dc.current *= 2
+		if max := time.Duration(AdvMaxPeriod) * time.Millisecond; dc.current > max {
+			dc.current = max
+		}
+		if dc.current < dc.base {
+			dc.current = dc.base
+		}
+		dc.effective = dc.current
+	} else {
+		dc.current = dc.base
+		dc.effective = dc.base
+	}
+
+	period := dc.effective
+	jitter := AdvJitter
+	if jitter > AdvMaxJitter {
+		jitter = AdvMaxJitter
+	}
+	if jitter > 0 {
+		// +/- jitter% to avoid synchronized collisions
+		spread := int64(period) * int64(jitter) / 100
+		if spread > 0 {
+			period += time.Duration(rand.Int63n(2*spread+1) - spread)
+		}
+	}
+
+	return period, true
+}
+
+func (dc *DutyCycle) Status() DutyCycleStatus {
+	dc.Lock()
+	defer dc.Unlock()
+	return DutyCycleStatus{
+		Base:       int(dc.base / time.Millisecond),
+		Effective:  int(dc.effective / time.Millisecond),
+		Backoff:    int(dc.current / time.Millisecond),
+		BoostUntil: dc.boostUntil,
+		Quiet:      dc.quietNow,
+		Peers:      dc.peers(),
+	}
+}
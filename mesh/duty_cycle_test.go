@@ -0,0 +1,39 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDutyCycleJitter(t *testing.T) {
+	defer func(jitter int) { AdvJitter = jitter }(AdvJitter)
+
+	base := time.Second
+	tests := []struct {
+		jitter int
+		spread time.Duration
+	}{
+		{-10, 0},
+		{0, 0},
+		{20, 200 * time.Millisecond},
+		{AdvMaxJitter, 990 * time.Millisecond},
+		{100, 990 * time.Millisecond},
+		{1000, 990 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		AdvJitter = test.jitter
+
+		dc := NewDutyCycle(int(base / time.Millisecond))
+		dc.CountPeersWith(func() int { return 1 })
+
+		for i := 0; i < 1000; i++ {
+			period, advertise := dc.Next(time.Now())
+			if !advertise {
+				t.Fatalf("jitter %d: expected to advertise", test.jitter)
+			} else if period <= 0 || period < base-test.spread || period > base+test.spread {
+				t.Fatalf("jitter %d: period %s out of range", test.jitter, period)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package mesh
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// RSSI statistics of the frames received from a peer on a given channel.
+type ChannelStats struct {
+	Channel int     `json:"channel"`
+	Frames  uint64  `json:"frames"`
+	RSSIMin int     `json:"rssi_min"`
+	RSSIMax int     `json:"rssi_max"`
+	RSSIAvg float64 `json:"rssi_avg"`
+}
+
+// Encounter is a single session with a peer, from the moment it's been detected to the moment it's been lost.
+type Encounter struct {
+	DetectedAt time.Time             `json:"detected_at"`
+	SeenAt     time.Time             `json:"seen_at"`
+	LostAt     *time.Time            `json:"lost_at"`
+	Duration   float64               `json:"duration"`
+	Channels   map[int]*ChannelStats `json:"channels"`
+}
+
+func NewEncounter(at time.Time) *Encounter {
+	return &Encounter{
+		DetectedAt: at,
+		SeenAt:     at,
+		Channels:   make(map[int]*ChannelStats),
+	}
+}
+
+func (enc *Encounter) Seen(at time.Time, channel int, rssi int) {
+	enc.SeenAt = at
+	enc.Duration = enc.SeenAt.Sub(enc.DetectedAt).Seconds()
+
+	stats, found := enc.Channels[channel]
+	if !found {
+		stats = &ChannelStats{
+			Channel: channel,
+			RSSIMin: rssi,
+			RSSIMax: rssi,
+		}
+		enc.Channels[channel] = stats
+	}
+
+	if rssi < stats.RSSIMin {
+		stats.RSSIMin = rssi
+	}
+	if rssi > stats.RSSIMax {
+		stats.RSSIMax = rssi
+	}
+	stats.Frames++
+	stats.RSSIAvg += (float64(rssi) - stats.RSSIAvg) / float64(stats.Frames)
+}
+
+func (enc *Encounter) Lost(at time.Time) {
+	enc.LostAt = &at
+	enc.Duration = enc.SeenAt.Sub(enc.DetectedAt).Seconds()
+}
+
+// returns true if the encounter overlaps with the [from, to] time range
+func (enc *Encounter) Overlaps(from, to time.Time) bool {
+	return !enc.DetectedAt.After(to) && !enc.SeenAt.Before(from)
+}
+
+// encounters are indexed by detection time so that the bucket cursor returns them in chronological order
+func (enc *Encounter) key() []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(enc.DetectedAt.UnixNano()))
+	return key
+}
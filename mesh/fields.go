@@ -0,0 +1,284 @@
+package mesh
+
+import (
+	"fmt"
+	"github.com/evilsocket/islazy/log"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// owner of the fields set with SetData
+	OwnerDefault = "default"
+	// owner of the fields set by pwngrid itself
+	OwnerSystem = "pwngrid"
+)
+
+var ownerParser = regexp.MustCompile(`^[a-z0-9_\-]{1,32}$`)
+
+type fieldEntry struct {
+	owner     string
+	value     interface{}
+	setAt     time.Time
+	expiresAt time.Time
+	// value of another owner hidden by this one until it expires
+	prev *fieldEntry
+}
+
+func (entry *fieldEntry) expired(now time.Time) bool {
+	return !entry.expiresAt.IsZero() && !now.Before(entry.expiresAt)
+}
+
+// FieldStatus is an advertisement field with its owner and expiration.
+type FieldStatus struct {
+	Name      string      `json:"name"`
+	Value     interface{} `json:"value"`
+	SetAt     *time.Time  `json:"set_at,omitempty"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+	// remaining seconds before the field expires, 0 if it doesn't
+	TTL int `json:"ttl"`
+}
+
+// returns a copy of the extension namespace, to be called with the lock held
+func (peer *Peer) extData() map[string]interface{} {
+	ext := make(map[string]interface{})
+	if obj, found := peer.AdvData.Load(ExtField); found {
+		if current, ok := obj.(map[string]interface{}); ok {
+			for key, value := range current {
+				ext[key] = value
+			}
+		}
+	}
+	return ext
+}
+
+// returns the current value of a field, extension fields are named ext.<name>, to be called with the lock held
+func (peer *Peer) fieldValue(name string) (interface{}, bool) {
+	if strings.HasPrefix(name, ExtField+".") {
+		value, found := peer.extData()[name[len(ExtField)+1:]]
+		return value, found
+	}
+	return peer.AdvData.Load(name)
+}
+
+// to be called with the lock held
+func (peer *Peer) own(name, owner string, value interface{}, now time.Time, ttl time.Duration) {
+	if value == nil {
+		delete(peer.owned, name)
+		return
+	}
+
+	entry := &fieldEntry{
+		owner: owner,
+		value: value,
+		setAt: now,
+	}
+	if ttl > 0 {
+		entry.expiresAt = now.Add(ttl)
+		// if it's temporary, the value of another owner is restored once it expires, when refreshing
+		// our own value we keep the one it was hiding
+		prev := peer.owned[name]
+		if prev == nil {
+			// fields set by pwngrid itself have no entry, they're restored as well
+			if current, found := peer.fieldValue(name); found {
+				prev = &fieldEntry{owner: OwnerSystem, value: current, setAt: now}
+			}
+		}
+		if prev != nil {
+			if prev.owner == owner {
+				prev = prev.prev
+			}
+			entry.prev = withoutOwner(prev, owner)
+		}
+	}
+	peer.owned[name] = entry
+}
+
+// returns a copy of the chain of hidden values without the ones of owner, which are superseded by
+// its new value, so the chain is never longer than the number of owners
+func withoutOwner(entry *fieldEntry, owner string) *fieldEntry {
+	if entry == nil {
+		return nil
+	} else if entry.owner == owner {
+		return withoutOwner(entry.prev, owner)
+	}
+	copied := *entry
+	copied.prev = withoutOwner(entry.prev, owner)
+	return &copied
+}
+
+// SetFields validates and sets advertisement fields on behalf of owner, a nil value removes
+// the field. If ttl is not zero the fields are removed once it's elapsed, or the values they
+// replaced are restored. Extension fields are merged with the ones set by other owners.
+func (peer *Peer) SetFields(owner string, ttl time.Duration, adv map[string]interface{}) error {
+	if owner == "" {
+		owner = OwnerDefault
+	} else if !ownerParser.MatchString(owner) {
+		return fmt.Errorf("invalid owner '%s'", owner)
+	} else if owner == OwnerSystem {
+		return fmt.Errorf("owner '%s' is reserved", owner)
+	}
+
+	if ttl < 0 {
+		return fmt.Errorf("ttl can't be negative")
+	}
+
+	valid, err := ValidateLocal(adv)
+	if err != nil {
+		return err
+	}
+
+	peer.Lock()
+	defer peer.Unlock()
+
+	peer.expire()
+
+	now := time.Now()
+	update := make(map[string]interface{})
+
+	if obj, found := valid[ExtField]; found {
+		if obj == nil {
+			for name := range peer.owned {
+				if strings.HasPrefix(name, ExtField+".") {
+					delete(peer.owned, name)
+				}
+			}
+			update[ExtField] = nil
+		} else {
+			ext := peer.extData()
+			for key, value := range obj.(map[string]interface{}) {
+				if value == nil {
+					delete(ext, key)
+				} else {
+					ext[key] = value
+				}
+			}
+			// the budget applies to the merged namespace
+			if _, err := fields[ExtField].Validate(ext); err != nil {
+				return err
+			}
+			for key, value := range obj.(map[string]interface{}) {
+				peer.own(ExtField+"."+key, owner, value, now, ttl)
+			}
+			if len(ext) == 0 {
+				update[ExtField] = nil
+			} else {
+				update[ExtField] = ext
+			}
+		}
+	}
+
+	for key, value := range valid {
+		if key != ExtField {
+			peer.own(key, owner, value, now, ttl)
+			update[key] = value
+		}
+	}
+
+	peer.apply(update)
+	return nil
+}
+
+// removes expired fields or restores the values they replaced, to be called with the lock held
+func (peer *Peer) expire() {
+	now := time.Now()
+	update := make(map[string]interface{})
+	var ext map[string]interface{}
+
+	for name, entry := range peer.owned {
+		if !entry.expired(now) {
+			continue
+		}
+
+		log.Debug("advertisement field %s of %s expired", name, entry.owner)
+		for entry != nil && entry.expired(now) {
+			entry = entry.prev
+		}
+
+		var value interface{}
+		if entry != nil {
+			peer.owned[name] = entry
+			value = entry.value
+		} else {
+			delete(peer.owned, name)
+		}
+
+		if strings.HasPrefix(name, ExtField+".") {
+			if ext == nil {
+				ext = peer.extData()
+			}
+			if key := name[len(ExtField)+1:]; value == nil {
+				delete(ext, key)
+			} else {
+				ext[key] = value
+			}
+		} else {
+			update[name] = value
+		}
+	}
+
+	if ext != nil {
+		if len(ext) == 0 {
+			update[ExtField] = nil
+		} else {
+			update[ExtField] = ext
+		}
+	}
+
+	if len(update) > 0 {
+		peer.apply(update)
+	}
+}
+
+func (peer *Peer) fieldStatus(name string, value interface{}, now time.Time) (string, FieldStatus) {
+	field := FieldStatus{
+		Name:  name,
+		Value: value,
+	}
+
+	entry := peer.owned[name]
+	if entry == nil {
+		return OwnerSystem, field
+	}
+
+	setAt := entry.setAt
+	field.SetAt = &setAt
+	if !entry.expiresAt.IsZero() {
+		expiresAt := entry.expiresAt
+		field.ExpiresAt = &expiresAt
+		field.TTL = int(math.Ceil(expiresAt.Sub(now).Seconds()))
+	}
+	return entry.owner, field
+}
+
+// returns the advertisement fields grouped by owner, extension fields are listed as ext.<name>
+func (peer *Peer) Fields() map[string][]FieldStatus {
+	peer.Lock()
+	defer peer.Unlock()
+
+	peer.expire()
+
+	now := time.Now()
+	owners := make(map[string][]FieldStatus)
+	for key, value := range peer.dataFrame() {
+		if ext, ok := value.(map[string]interface{}); ok && key == ExtField {
+			for extKey, extValue := range ext {
+				owner, field := peer.fieldStatus(ExtField+"."+extKey, extValue, now)
+				owners[owner] = append(owners[owner], field)
+			}
+		} else {
+			owner, field := peer.fieldStatus(key, value, now)
+			owners[owner] = append(owners[owner], field)
+		}
+	}
+
+	for _, list := range owners {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Name < list[j].Name
+		})
+	}
+	return owners
+}
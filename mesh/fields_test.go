@@ -0,0 +1,93 @@
+package mesh
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fieldsStep struct {
+	owner string
+	ttl   time.Duration
+	data  map[string]interface{}
+}
+
+func TestFieldsExpiration(t *testing.T) {
+	keys := testKeys(t)
+	short := 10 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		steps    []fieldsStep
+		field    string
+		expected interface{}
+	}{
+		{"system field restored", []fieldsStep{
+			{"x", short, map[string]interface{}{"name": "temporary"}},
+		}, "name", "unit"},
+		{"default value restored", []fieldsStep{
+			{"", 0, map[string]interface{}{"face": "(^_^)"}},
+			{"x", short, map[string]interface{}{"face": "(>_<)"}},
+		}, "face", "(^_^)"},
+		{"new field removed", []fieldsStep{
+			{"x", short, map[string]interface{}{"face": "(>_<)"}},
+		}, "face", nil},
+		{"refresh keeps the hidden value", []fieldsStep{
+			{"", 0, map[string]interface{}{"face": "(^_^)"}},
+			{"x", short, map[string]interface{}{"face": "(>_<)"}},
+			{"x", short, map[string]interface{}{"face": "(o_o)"}},
+		}, "face", "(^_^)"},
+		{"nested owners", []fieldsStep{
+			{"x", short, map[string]interface{}{"name": "x"}},
+			{"y", short, map[string]interface{}{"name": "y"}},
+		}, "name", "unit"},
+		{"extension field restored", []fieldsStep{
+			{"", 0, map[string]interface{}{"ext": map[string]interface{}{"mood": "happy", "level": 1.0}}},
+			{"x", short, map[string]interface{}{"ext": map[string]interface{}{"mood": "sad"}}},
+		}, "ext", map[string]interface{}{"mood": "happy", "level": 1.0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peer := MakeLocalPeer("unit", keys)
+			for _, step := range test.steps {
+				if err := peer.SetFields(step.owner, step.ttl, step.data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			time.Sleep(2 * short)
+			peer.Fields()
+
+			value, _ := peer.AdvData.Load(test.field)
+			if !reflect.DeepEqual(value, test.expected) {
+				t.Fatalf("expected %s to be %v, got %v", test.field, test.expected, value)
+			}
+		})
+	}
+}
+
+func TestFieldsOwner(t *testing.T) {
+	peer := MakeLocalPeer("unit", testKeys(t))
+
+	tests := []struct {
+		owner string
+		ttl   time.Duration
+		valid bool
+	}{
+		{"", 0, true},
+		{"plugin-1", time.Minute, true},
+		{"Plugin", 0, false},
+		{OwnerSystem, 0, false},
+		{"x", -time.Second, false},
+	}
+
+	for _, test := range tests {
+		err := peer.SetFields(test.owner, test.ttl, map[string]interface{}{"face": "(^_^)"})
+		if test.valid && err != nil {
+			t.Fatalf("owner '%s': unexpected error: %v", test.owner, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("owner '%s': expected an error", test.owner)
+		}
+	}
+}
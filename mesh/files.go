@@ -0,0 +1,962 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/evilsocket/islazy/fs"
+	"github.com/evilsocket/islazy/log"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MessageFileOffer   = "file_offer"
+	MessageFileRequest = "file_request"
+	MessageFileChunk   = "file_chunk"
+	MessageFileDone    = "file_done"
+)
+
+var (
+	// maximum size in bytes of a shared file
+	FileMaxSize = 2 * 1024 * 1024
+	// size in bytes of the encrypted data sent in each frame
+	FileChunkSize = 1024
+	// how many chunks are requested at once
+	FileWindow = 8
+	// period in seconds for offers to be repeated to peers in range that didn't complete the transfer yet
+	FileOfferPeriod = 5
+	// if false, offers from peers are ignored
+	FileAccept = true
+	// how many times a transfer that fails to decrypt or verify is downloaded again before giving up
+	FileRetries = 3
+
+	fileIDValidator   = regexp.MustCompile("^[a-f0-9]{16}$")
+	fileHashValidator = regexp.MustCompile("^[a-f0-9]{64}$")
+)
+
+// maximum size in bytes added by EncryptFor: nonce, key size, RSA encrypted key (up to 8192 bits) and GCM tag
+const fileEncOverhead = 12 + 4 + 1024 + 16
+
+// FileDelivery is the state of an offered file for a single recipient, the file is encrypted
+// once for each recipient and the ciphertext is kept until it's delivered.
+type FileDelivery struct {
+	Fingerprint string     `json:"fingerprint"`
+	Size        int64      `json:"size"`
+	Chunks      int        `json:"chunks"`
+	Served      int        `json:"served"`
+	OfferedAt   time.Time  `json:"offered_at"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+}
+
+// FileOffer is a file we're sharing with a given fingerprint or, if To is empty, with everyone.
+type FileOffer struct {
+	ID         string                   `json:"id"`
+	Path       string                   `json:"path"`
+	Name       string                   `json:"name"`
+	Size       int64                    `json:"size"`
+	Hash       string                   `json:"hash"`
+	To         string                   `json:"to,omitempty"`
+	CreatedAt  time.Time                `json:"created_at"`
+	Deliveries map[string]*FileDelivery `json:"deliveries"`
+}
+
+func (offer *FileOffer) copy() *FileOffer {
+	copied := *offer
+	copied.Deliveries = make(map[string]*FileDelivery)
+	for fingerprint, delivery := range offer.Deliveries {
+		d := *delivery
+		copied.Deliveries[fingerprint] = &d
+	}
+	return &copied
+}
+
+// FileTransfer is a file being received from a peer.
+type FileTransfer struct {
+	ID          string     `json:"id"`
+	From        string     `json:"from"`
+	Name        string     `json:"name"`
+	Size        int64      `json:"size"`
+	Hash        string     `json:"hash"`
+	EncSize     int64      `json:"enc_size"`
+	ChunkSize   int        `json:"chunk_size"`
+	Chunks      int        `json:"chunks"`
+	Received    int        `json:"received"`
+	Retries     int        `json:"retries"`
+	Bitmap      []byte     `json:"bitmap"`
+	Progress    float64    `json:"progress"`
+	Path        string     `json:"path,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+
+	requestedAt time.Time
+}
+
+func (t *FileTransfer) copy() *FileTransfer {
+	copied := *t
+	copied.Bitmap = append([]byte{}, t.Bitmap...)
+	return &copied
+}
+
+func (t *FileTransfer) has(idx int) bool {
+	return t.Bitmap[idx/8]&(1<<uint(idx%8)) != 0
+}
+
+func (t *FileTransfer) set(idx int) {
+	t.Bitmap[idx/8] |= 1 << uint(idx%8)
+	t.Received++
+	t.Progress = float64(t.Received) / float64(t.Chunks) * 100.0
+	t.UpdatedAt = time.Now()
+}
+
+// discards every chunk received so far
+func (t *FileTransfer) reset() {
+	t.Bitmap = make([]byte, (t.Chunks+7)/8)
+	t.Received = 0
+	t.Progress = 0
+	t.UpdatedAt = time.Now()
+}
+
+func (t *FileTransfer) missing(max int) []int {
+	missing := make([]int, 0)
+	for idx := 0; idx < t.Chunks && len(missing) < max; idx++ {
+		if !t.has(idx) {
+			missing = append(missing, idx)
+		}
+	}
+	return missing
+}
+
+type fileOfferMessage struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Hash      string `json:"hash"`
+	EncSize   int64  `json:"enc_size"`
+	ChunkSize int    `json:"chunk_size"`
+	Chunks    int    `json:"chunks"`
+	Signature string `json:"signature"`
+}
+
+func (m *fileOfferMessage) signed() []byte {
+	return []byte(fmt.Sprintf("%s:%s:%d:%s:%d", m.ID, m.Name, m.Size, m.Hash, m.EncSize))
+}
+
+// checks the offer is within bounds before the bitmap and the .part file are allocated
+func (m *fileOfferMessage) valid() bool {
+	name := filepath.Base(m.Name)
+	maxChunks := (FileMaxSize + fileEncOverhead + FileChunkSize - 1) / FileChunkSize
+	return fileIDValidator.MatchString(m.ID) && fileHashValidator.MatchString(m.Hash) &&
+		name == m.Name && name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\") &&
+		m.Size > 0 && m.Size <= int64(FileMaxSize) &&
+		m.EncSize > m.Size && m.EncSize <= m.Size+fileEncOverhead &&
+		m.ChunkSize > 0 && m.ChunkSize <= FileChunkSize &&
+		m.Chunks > 0 && m.Chunks <= maxChunks &&
+		int64(m.Chunks) == (m.EncSize+int64(m.ChunkSize)-1)/int64(m.ChunkSize)
+}
+
+type fileRequestMessage struct {
+	ID     string `json:"id"`
+	Chunks []int  `json:"chunks"`
+}
+
+// returns the valid chunk indexes of the request without duplicates, at most FileWindow of them
+func (m *fileRequestMessage) chunks(total int) []int {
+	seen := make(map[int]bool)
+	list := make([]int, 0)
+	for _, idx := range m.Chunks {
+		if len(list) >= FileWindow {
+			break
+		} else if idx >= 0 && idx < total && !seen[idx] {
+			seen[idx] = true
+			list = append(list, idx)
+		}
+	}
+	return list
+}
+
+type fileChunkMessage struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+	Data  []byte `json:"data"`
+}
+
+type fileDoneMessage struct {
+	ID string `json:"id"`
+}
+
+type jsonFiles struct {
+	Outgoing map[string]*FileOffer    `json:"outgoing"`
+	Incoming map[string]*FileTransfer `json:"incoming"`
+}
+
+// Files shares files with nearby units: offers are sent to peers in range, which pull the chunks of
+// a copy encrypted with their public key, resuming from where they stopped at every encounter.
+type Files struct {
+	sync.Mutex
+	path     string
+	share    string
+	router   *Router
+	outgoing map[string]*FileOffer
+	incoming map[string]*FileTransfer
+	dirty    bool
+}
+
+// only files inside of sharePath can be offered to peers
+func FilesFromPath(path string, sharePath string, router *Router) (err error, files *Files) {
+	if path, err = fs.Expand(path); err != nil {
+		return err, nil
+	} else if sharePath, err = fs.Expand(sharePath); err != nil {
+		return err, nil
+	}
+
+	files = &Files{
+		path:     path,
+		share:    sharePath,
+		router:   router,
+		outgoing: make(map[string]*FileOffer),
+		incoming: make(map[string]*FileTransfer),
+	}
+
+	for _, dir := range []string{files.outPath(), files.inPath(), files.share} {
+		if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+			return fmt.Errorf("could not create %s: %v", dir, err), nil
+		}
+	}
+
+	if statePath := files.statePath(); fs.Exists(statePath) {
+		log.Debug("loading %s ...", statePath)
+		var doc jsonFiles
+		if data, err := ioutil.ReadFile(statePath); err != nil {
+			return fmt.Errorf("error loading %s: %v", statePath, err), nil
+		} else if err = json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("error loading %s: %v", statePath, err), nil
+		}
+		if doc.Outgoing != nil {
+			files.outgoing = doc.Outgoing
+		}
+		if doc.Incoming != nil {
+			files.incoming = doc.Incoming
+		}
+	}
+
+	router.OnSignedMessage(MessageFileOffer, files.onOffer)
+	router.OnSignedMessage(MessageFileRequest, files.onRequest)
+	router.OnSignedMessage(MessageFileChunk, files.onChunk)
+	router.OnSignedMessage(MessageFileDone, files.onDone)
+
+	log.Debug("loaded %d outgoing and %d incoming file transfers", len(files.outgoing), len(files.incoming))
+
+	router.spawn(files.worker)
+
+	return
+}
+
+func (files *Files) statePath() string {
+	return path.Join(files.path, ".transfers", "state.json")
+}
+
+func (files *Files) outPath() string {
+	return path.Join(files.path, ".transfers", "out")
+}
+
+func (files *Files) inPath() string {
+	return path.Join(files.path, ".transfers", "in")
+}
+
+func (files *Files) blobPath(id string, fingerprint string) string {
+	return path.Join(files.outPath(), fmt.Sprintf("%s-%s.enc", id, fingerprint))
+}
+
+func (files *Files) partPath(id string) string {
+	return path.Join(files.inPath(), id+".part")
+}
+
+// the state file is replaced atomically so a crash can't leave us with a partially written one
+func (files *Files) save() error {
+	data, err := json.Marshal(jsonFiles{
+		Outgoing: files.outgoing,
+		Incoming: files.incoming,
+	})
+	if err != nil {
+		return err
+	}
+
+	statePath := files.statePath()
+	tmpFileName := statePath + ".tmp"
+	if err = ioutil.WriteFile(tmpFileName, data, 0644); err != nil {
+		return err
+	}
+	files.dirty = false
+	return os.Rename(tmpFileName, statePath)
+}
+
+func (files *Files) Outgoing() []*FileOffer {
+	files.Lock()
+	defer files.Unlock()
+
+	list := make([]*FileOffer, 0, len(files.outgoing))
+	for _, offer := range files.outgoing {
+		list = append(list, offer.copy())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+func (files *Files) Incoming() []*FileTransfer {
+	files.Lock()
+	defer files.Unlock()
+
+	list := make([]*FileTransfer, 0, len(files.incoming))
+	for _, transfer := range files.incoming {
+		list = append(list, transfer.copy())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedAt.Before(list[j].StartedAt)
+	})
+	return list
+}
+
+// returns either a *FileOffer or a *FileTransfer with the given id
+func (files *Files) Of(id string) interface{} {
+	files.Lock()
+	defer files.Unlock()
+
+	if offer, found := files.outgoing[id]; found {
+		return offer.copy()
+	} else if transfer, found := files.incoming[id]; found {
+		return transfer.copy()
+	}
+	return nil
+}
+
+func (files *Files) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"outgoing": files.Outgoing(),
+		"incoming": files.Incoming(),
+	})
+}
+
+// returns the path of a regular file inside the share folder, name can either be relative to it or
+// absolute, symlinks are resolved before checking where the file is
+func (files *Files) resolve(name string) (string, error) {
+	root, err := filepath.EvalSymlinks(files.share)
+	if err != nil {
+		return "", err
+	} else if root, err = filepath.Abs(root); err != nil {
+		return "", err
+	}
+
+	fileName := filepath.Clean(name)
+	if !filepath.IsAbs(fileName) {
+		fileName = filepath.Join(files.share, fileName)
+	}
+	if fileName, err = filepath.EvalSymlinks(fileName); err != nil {
+		return "", err
+	} else if fileName, err = filepath.Abs(fileName); err != nil {
+		return "", err
+	}
+
+	if rel, err := filepath.Rel(root, fileName); err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not inside %s", name, files.share)
+	} else if info, err := os.Stat(fileName); err != nil {
+		return "", err
+	} else if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", name)
+	}
+
+	return fileName, nil
+}
+
+// offers the file with the given name in the share folder to the given fingerprint or, if empty,
+// to every peer
+func (files *Files) Offer(name string, to string) (*FileOffer, error) {
+	if to != "" && !fingValidator.MatchString(to) {
+		return nil, fmt.Errorf("invalid fingerprint %s", to)
+	}
+
+	fileName, err := files.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	} else if len(data) > FileMaxSize {
+		return nil, fmt.Errorf("%s is %d bytes, the maximum allowed size is %d", fileName, len(data), FileMaxSize)
+	}
+
+	idBuf := make([]byte, 8)
+	if _, err := rand.Read(idBuf); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+
+	offer := &FileOffer{
+		ID:         hex.EncodeToString(idBuf),
+		Path:       fileName,
+		Name:       filepath.Base(fileName),
+		Size:       int64(len(data)),
+		Hash:       hex.EncodeToString(hash[:]),
+		To:         strings.ToLower(to),
+		CreatedAt:  time.Now(),
+		Deliveries: make(map[string]*FileDelivery),
+	}
+
+	files.Lock()
+	defer files.Unlock()
+
+	files.outgoing[offer.ID] = offer
+
+	log.Info("offering %s (%d bytes) to %s", offer.Name, offer.Size, files.recipient(offer))
+
+	return offer.copy(), files.save()
+}
+
+func (files *Files) recipient(offer *FileOffer) string {
+	if offer.To == "" {
+		return "everyone"
+	}
+	return offer.To
+}
+
+// cancels an offer or an incoming transfer, returns false if not found
+func (files *Files) Remove(id string) (bool, error) {
+	files.Lock()
+	defer files.Unlock()
+
+	if offer, found := files.outgoing[id]; found {
+		for fingerprint := range offer.Deliveries {
+			os.Remove(files.blobPath(id, fingerprint))
+		}
+		delete(files.outgoing, id)
+		log.Info("file offer %s (%s) removed", id, offer.Name)
+	} else if transfer, found := files.incoming[id]; found {
+		os.Remove(files.partPath(id))
+		delete(files.incoming, id)
+		log.Info("file transfer %s (%s) removed", id, transfer.Name)
+	} else {
+		return false, nil
+	}
+
+	return true, files.save()
+}
+
+// encrypts the offered file for the given recipient, the ciphertext is stored so that the transfer
+// can be resumed with the same data at the next encounter. Must be called without the lock held.
+func (files *Files) prepare(offer *FileOffer, fingerprint string) (*FileDelivery, error) {
+	keys := files.router.PublicKeyOf(fingerprint)
+	if keys == nil {
+		// requested, we'll try again at the next round
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(offer.Path)
+	if err != nil {
+		return nil, err
+	} else if hash := sha256.Sum256(data); hex.EncodeToString(hash[:]) != offer.Hash {
+		return nil, fmt.Errorf("%s changed since it's been offered", offer.Path)
+	}
+
+	encrypted, err := files.router.local.Keys.EncryptFor(data, keys.Public)
+	if err != nil {
+		return nil, err
+	}
+
+	blobPath := files.blobPath(offer.ID, fingerprint)
+	if err = ioutil.WriteFile(blobPath, encrypted, 0644); err != nil {
+		return nil, err
+	}
+
+	files.Lock()
+	defer files.Unlock()
+
+	if _, found := files.outgoing[offer.ID]; !found {
+		// removed while we were encrypting it
+		os.Remove(blobPath)
+		return nil, nil
+	}
+
+	delivery := &FileDelivery{
+		Fingerprint: fingerprint,
+		Size:        int64(len(encrypted)),
+		Chunks:      (len(encrypted) + FileChunkSize - 1) / FileChunkSize,
+		OfferedAt:   time.Now(),
+	}
+	offer.Deliveries[fingerprint] = delivery
+	files.dirty = true
+
+	return delivery, nil
+}
+
+// must be called without the lock held
+func (files *Files) sendOffer(id string, fingerprint string) {
+	files.Lock()
+	offer, found := files.outgoing[id]
+	if !found {
+		files.Unlock()
+		return
+	}
+	delivery, prepared := offer.Deliveries[fingerprint]
+	delivered := prepared && delivery.DeliveredAt != nil
+	files.Unlock()
+
+	if delivered {
+		return
+	} else if !prepared {
+		var err error
+		if delivery, err = files.prepare(offer, fingerprint); err != nil {
+			log.Warning("error preparing %s for %s: %v", offer.Name, fingerprint, err)
+			return
+		} else if delivery == nil {
+			return
+		}
+	}
+
+	msg := fileOfferMessage{
+		ID:        offer.ID,
+		Name:      offer.Name,
+		Size:      offer.Size,
+		Hash:      offer.Hash,
+		EncSize:   delivery.Size,
+		ChunkSize: FileChunkSize,
+		Chunks:    delivery.Chunks,
+	}
+
+	signature, err := files.router.local.Keys.SignMessage(msg.signed())
+	if err != nil {
+		log.Error("error signing offer %s: %v", offer.ID, err)
+		return
+	}
+	msg.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	if err = files.router.SendTo(fingerprint, MessageFileOffer, msg); err != nil {
+		log.Debug("error sending offer %s to %s: %v", offer.ID, fingerprint, err)
+	}
+}
+
+// returns the request for the next missing chunks of the transfer, to be called with the lock held
+func (files *Files) nextRequest(transfer *FileTransfer) *fileRequestMessage {
+	missing := transfer.missing(FileWindow)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	transfer.requestedAt = time.Now()
+	return &fileRequestMessage{
+		ID:     transfer.ID,
+		Chunks: missing,
+	}
+}
+
+// must be called without the lock held
+func (files *Files) request(to string, req *fileRequestMessage) {
+	if req == nil {
+		return
+	}
+	if err := files.router.SendTo(to, MessageFileRequest, req); err != nil {
+		log.Debug("error requesting chunks of %s to %s: %v", req.ID, to, err)
+	}
+}
+
+func (files *Files) confirm(to string, id string) {
+	if err := files.router.SendTo(to, MessageFileDone, fileDoneMessage{ID: id}); err != nil {
+		log.Debug("error confirming %s to %s: %v", id, to, err)
+	}
+}
+
+func (files *Files) onOffer(ident string, peer *Peer, msg *Message) {
+	var offer fileOfferMessage
+	if err := json.Unmarshal(msg.Body, &offer); err != nil {
+		log.Debug("error decoding file offer from %s: %v", ident, err)
+		return
+	}
+
+	files.Lock()
+	if transfer, found := files.incoming[offer.ID]; found {
+		var req *fileRequestMessage
+		completed := false
+		if transfer.From != ident {
+			log.Warning("peer %s is offering file %s, already offered by %s", ident, offer.ID, transfer.From)
+		} else if transfer.CompletedAt != nil {
+			// the sender missed our confirmation
+			completed = true
+		} else if transfer.Error == "" {
+			req = files.nextRequest(transfer)
+		}
+		files.Unlock()
+
+		if completed {
+			files.confirm(ident, offer.ID)
+		}
+		files.request(ident, req)
+		return
+	}
+	files.Unlock()
+
+	if !FileAccept {
+		log.Debug("ignoring file offer %s from %s", offer.ID, ident)
+		return
+	}
+
+	keys := files.router.PublicKeyOf(ident)
+	if keys == nil {
+		// we'll check the signature at the next offer
+		return
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(offer.Signature)
+	if err != nil {
+		log.Debug("error decoding signature of offer %s: %v", offer.ID, err)
+		return
+	} else if err = keys.VerifyMessage(offer.signed(), signature); err != nil {
+		log.Warning("invalid signature for file offer %s from %s", offer.ID, ident)
+		return
+	}
+
+	if !offer.valid() {
+		log.Warning("ignoring invalid file offer %s from %s", offer.ID, ident)
+		return
+	}
+	name := filepath.Base(offer.Name)
+
+	files.Lock()
+	if _, found := files.incoming[offer.ID]; found {
+		// accepted by a concurrent offer
+		files.Unlock()
+		return
+	}
+
+	now := time.Now()
+	transfer := &FileTransfer{
+		ID:        offer.ID,
+		From:      ident,
+		Name:      name,
+		Size:      offer.Size,
+		Hash:      offer.Hash,
+		EncSize:   offer.EncSize,
+		ChunkSize: offer.ChunkSize,
+		Chunks:    offer.Chunks,
+		Bitmap:    make([]byte, (offer.Chunks+7)/8),
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	files.incoming[offer.ID] = transfer
+
+	log.Info("receiving %s (%d bytes) from %s", transfer.Name, transfer.Size, ident)
+
+	if err := files.save(); err != nil {
+		log.Error("error saving file transfers: %v", err)
+	}
+
+	req := files.nextRequest(transfer)
+	files.Unlock()
+
+	files.request(ident, req)
+}
+
+func (files *Files) onRequest(ident string, peer *Peer, msg *Message) {
+	var req fileRequestMessage
+	if err := json.Unmarshal(msg.Body, &req); err != nil {
+		log.Debug("error decoding file request from %s: %v", ident, err)
+		return
+	}
+
+	files.Lock()
+	offer, found := files.outgoing[req.ID]
+	if !found {
+		files.Unlock()
+		return
+	}
+	delivery, found := offer.Deliveries[ident]
+	if !found || delivery.DeliveredAt != nil {
+		files.Unlock()
+		return
+	}
+	blobPath := files.blobPath(offer.ID, ident)
+	files.Unlock()
+
+	blob, err := os.Open(blobPath)
+	if err != nil {
+		log.Error("error opening %s: %v", blobPath, err)
+		return
+	}
+	defer blob.Close()
+
+	buf := make([]byte, FileChunkSize)
+	for _, idx := range req.chunks(delivery.Chunks) {
+		read, err := blob.ReadAt(buf, int64(idx*FileChunkSize))
+		if read == 0 {
+			log.Error("error reading chunk %d of %s: %v", idx, blobPath, err)
+			return
+		}
+
+		if err = files.router.SendTo(ident, MessageFileChunk, fileChunkMessage{
+			ID:    req.ID,
+			Index: idx,
+			Data:  buf[:read],
+		}); err != nil {
+			log.Debug("error sending chunk %d of %s to %s: %v", idx, req.ID, ident, err)
+			return
+		}
+
+		files.Lock()
+		delivery.Served++
+		files.dirty = true
+		files.Unlock()
+	}
+}
+
+func (files *Files) onChunk(ident string, peer *Peer, msg *Message) {
+	var chunk fileChunkMessage
+	if err := json.Unmarshal(msg.Body, &chunk); err != nil {
+		log.Debug("error decoding file chunk from %s: %v", ident, err)
+		return
+	}
+
+	files.Lock()
+
+	transfer, found := files.incoming[chunk.ID]
+	if !found || transfer.From != ident || transfer.CompletedAt != nil || transfer.Error != "" {
+		files.Unlock()
+		return
+	} else if chunk.Index < 0 || chunk.Index >= transfer.Chunks || transfer.has(chunk.Index) {
+		files.Unlock()
+		return
+	}
+
+	expected := transfer.ChunkSize
+	if chunk.Index == transfer.Chunks-1 {
+		expected = int(transfer.EncSize) - chunk.Index*transfer.ChunkSize
+	}
+	if len(chunk.Data) != expected {
+		log.Debug("chunk %d of %s has size %d, expected %d", chunk.Index, chunk.ID, len(chunk.Data), expected)
+		files.Unlock()
+		return
+	}
+
+	part, err := os.OpenFile(files.partPath(chunk.ID), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Error("error opening %s: %v", files.partPath(chunk.ID), err)
+		files.Unlock()
+		return
+	}
+	_, err = part.WriteAt(chunk.Data, int64(chunk.Index*transfer.ChunkSize))
+	part.Close()
+	if err != nil {
+		log.Error("error writing chunk %d of %s: %v", chunk.Index, chunk.ID, err)
+		files.Unlock()
+		return
+	}
+
+	transfer.set(chunk.Index)
+	files.dirty = true
+
+	var req *fileRequestMessage
+	completed := transfer.Received == transfer.Chunks
+	if !completed && transfer.Received%FileWindow == 0 {
+		// window completed, ask for the next one
+		req = files.nextRequest(transfer)
+	}
+	files.Unlock()
+
+	if completed {
+		files.complete(transfer)
+	} else {
+		files.request(ident, req)
+	}
+}
+
+// to be called with the lock held when a completed transfer can't be decrypted or verified, a single
+// bogus chunk makes the whole ciphertext invalid so the transfer is restarted from scratch
+func (files *Files) retry(transfer *FileTransfer, reason string) *fileRequestMessage {
+	if transfer.Retries++; transfer.Retries >= FileRetries {
+		transfer.Error = reason
+		log.Warning("giving up on %s from %s after %d attempts: %s", transfer.Name, transfer.From, transfer.Retries, reason)
+		return nil
+	}
+
+	log.Warning("%s from %s: %s, downloading it again", transfer.Name, transfer.From, reason)
+	os.Remove(files.partPath(transfer.ID))
+	transfer.reset()
+	return files.nextRequest(transfer)
+}
+
+// decrypts and verifies a completed transfer, then moves it to the files folder, must be called without
+// the lock held
+func (files *Files) complete(transfer *FileTransfer) {
+	partPath := files.partPath(transfer.ID)
+	encrypted, readErr := ioutil.ReadFile(partPath)
+
+	var data []byte
+	var reason string
+	if readErr != nil {
+		reason = readErr.Error()
+	} else if plain, err := files.router.local.Keys.Decrypt(encrypted); err != nil {
+		reason = fmt.Sprintf("error decrypting: %v", err)
+	} else if hash := sha256.Sum256(plain); hex.EncodeToString(hash[:]) != transfer.Hash {
+		reason = "hash mismatch"
+	} else {
+		data = plain
+	}
+
+	files.Lock()
+
+	if data == nil {
+		req := files.retry(transfer, reason)
+		if err := files.save(); err != nil {
+			log.Error("error saving file transfers: %v", err)
+		}
+		files.Unlock()
+
+		files.request(transfer.From, req)
+		return
+	}
+
+	fileName := path.Join(files.path, transfer.Name)
+	for idx := 1; fs.Exists(fileName); idx++ {
+		fileName = path.Join(files.path, fmt.Sprintf("%s.%d", transfer.Name, idx))
+	}
+
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		transfer.Error = err.Error()
+		log.Error("error saving %s: %v", fileName, err)
+	} else {
+		os.Remove(partPath)
+
+		now := time.Now()
+		transfer.Path = fileName
+		transfer.CompletedAt = &now
+
+		log.Info("received %s (%d bytes) from %s", fileName, transfer.Size, transfer.From)
+	}
+
+	if err := files.save(); err != nil {
+		log.Error("error saving file transfers: %v", err)
+	}
+	completed := transfer.CompletedAt != nil
+	files.Unlock()
+
+	if completed {
+		files.confirm(transfer.From, transfer.ID)
+	}
+}
+
+func (files *Files) onDone(ident string, peer *Peer, msg *Message) {
+	var done fileDoneMessage
+	if err := json.Unmarshal(msg.Body, &done); err != nil {
+		log.Debug("error decoding file confirmation from %s: %v", ident, err)
+		return
+	}
+
+	files.Lock()
+	defer files.Unlock()
+
+	offer, found := files.outgoing[done.ID]
+	if !found {
+		return
+	}
+	delivery, found := offer.Deliveries[ident]
+	if !found || delivery.DeliveredAt != nil {
+		return
+	}
+
+	now := time.Now()
+	delivery.DeliveredAt = &now
+	os.Remove(files.blobPath(offer.ID, ident))
+
+	log.Info("%s delivered to %s", offer.Name, ident)
+
+	if err := files.save(); err != nil {
+		log.Error("error saving file transfers: %v", err)
+	}
+}
+
+// periodically offers files to peers in range, retries stalled transfers and persists the state
+func (files *Files) worker() {
+	period := time.Second
+	offerPeriod := time.Duration(FileOfferPeriod) * time.Second
+	lastOffer := time.Time{}
+
+	type offerTarget struct {
+		id          string
+		fingerprint string
+	}
+
+	type chunksRequest struct {
+		to  string
+		req *fileRequestMessage
+	}
+
+	log.Debug("files worker started with a %s period", period)
+
+	for now := range files.router.ticker(period) {
+		targets := make([]offerTarget, 0)
+		requests := make([]chunksRequest, 0)
+
+		files.Lock()
+
+		if now.Sub(lastOffer) >= offerPeriod {
+			lastOffer = now
+			for _, offer := range files.outgoing {
+				if offer.To != "" {
+					if _, found := files.router.peers.Load(offer.To); found {
+						targets = append(targets, offerTarget{offer.ID, offer.To})
+					}
+				} else {
+					files.router.peers.Range(func(ident string, peer *Peer) bool {
+						targets = append(targets, offerTarget{offer.ID, ident})
+						return true
+					})
+				}
+			}
+		}
+
+		for _, transfer := range files.incoming {
+			if transfer.CompletedAt != nil || transfer.Error != "" {
+				continue
+			} else if _, found := files.router.peers.Load(transfer.From); !found {
+				continue
+			} else if now.Sub(transfer.requestedAt) >= 2*period && now.Sub(transfer.UpdatedAt) >= period {
+				// stalled, some chunks were probably lost
+				if req := files.nextRequest(transfer); req != nil {
+					requests = append(requests, chunksRequest{transfer.From, req})
+				}
+			}
+		}
+
+		files.Unlock()
+
+		// encryption and radio writes happen without the lock held
+		for _, target := range targets {
+			files.sendOffer(target.id, target.fingerprint)
+		}
+		for _, r := range requests {
+			files.request(r.to, r.req)
+		}
+
+		files.Lock()
+		if files.dirty {
+			if err := files.save(); err != nil {
+				log.Error("error saving file transfers: %v", err)
+			}
+		}
+		files.Unlock()
+	}
+}
@@ -0,0 +1,141 @@
+package mesh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilesResolve(t *testing.T) {
+	base, err := ioutil.TempDir("", "pwngrid-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	share := filepath.Join(base, "shared")
+	secret := filepath.Join(base, "secret.txt")
+	for _, dir := range []string{share, filepath.Join(share, "sub")} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fileName := range []string{secret, filepath.Join(share, "a.txt"), filepath.Join(share, "sub", "b.txt")} {
+		if err = ioutil.WriteFile(fileName, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink(secret, filepath.Join(share, "escape.txt")); err != nil {
+		t.Fatal(err)
+	} else if err = os.Symlink(base, filepath.Join(share, "parent")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"a.txt", filepath.Join(share, "a.txt")},
+		{"sub/b.txt", filepath.Join(share, "sub", "b.txt")},
+		{"sub/../a.txt", filepath.Join(share, "a.txt")},
+		{filepath.Join(share, "a.txt"), filepath.Join(share, "a.txt")},
+		{"../secret.txt", ""},
+		{"sub/../../secret.txt", ""},
+		{secret, ""},
+		{"/etc/passwd", ""},
+		{"escape.txt", ""},
+		{"parent/secret.txt", ""},
+		{"sub", ""},
+		{".", ""},
+		{"missing.txt", ""},
+	}
+
+	files := &Files{share: share}
+	root, _ := filepath.EvalSymlinks(share)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fileName, err := files.resolve(test.name)
+			if test.expected == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", fileName)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if expected := strings.Replace(test.expected, share, root, 1); fileName != expected {
+				t.Fatalf("expected %s, got %s", expected, fileName)
+			}
+		})
+	}
+}
+
+func TestFileOfferValid(t *testing.T) {
+	valid := func(mutate func(m *fileOfferMessage)) *fileOfferMessage {
+		m := &fileOfferMessage{
+			ID:        strings.Repeat("a", 16),
+			Name:      "file.txt",
+			Size:      1000,
+			Hash:      strings.Repeat("b", 64),
+			EncSize:   1500,
+			ChunkSize: 1024,
+			Chunks:    2,
+		}
+		if mutate != nil {
+			mutate(m)
+		}
+		return m
+	}
+
+	tests := []struct {
+		name  string
+		offer *fileOfferMessage
+		valid bool
+	}{
+		{"valid", valid(nil), true},
+		{"invalid id", valid(func(m *fileOfferMessage) { m.ID = "../x" }), false},
+		{"invalid hash", valid(func(m *fileOfferMessage) { m.Hash = "nope" }), false},
+		{"path in name", valid(func(m *fileOfferMessage) { m.Name = "../../.bashrc" }), false},
+		{"hidden name", valid(func(m *fileOfferMessage) { m.Name = ".bashrc" }), false},
+		{"empty file", valid(func(m *fileOfferMessage) { m.Size = 0 }), false},
+		{"too big", valid(func(m *fileOfferMessage) { m.Size = int64(FileMaxSize) + 1 }), false},
+		{"ciphertext too small", valid(func(m *fileOfferMessage) { m.EncSize = m.Size }), false},
+		{"ciphertext too big", valid(func(m *fileOfferMessage) { m.EncSize = m.Size + fileEncOverhead + 1 }), false},
+		{"chunk too big", valid(func(m *fileOfferMessage) { m.ChunkSize = FileChunkSize + 1 }), false},
+		{"no chunks", valid(func(m *fileOfferMessage) { m.Chunks = 0 }), false},
+		{"chunks mismatch", valid(func(m *fileOfferMessage) { m.Chunks = 1000000 }), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if valid := test.offer.valid(); valid != test.valid {
+				t.Fatalf("expected valid=%v, got %v", test.valid, valid)
+			}
+		})
+	}
+}
+
+func TestFileRequestChunks(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []int
+		total    int
+		expected []int
+	}{
+		{"valid", []int{0, 1, 2}, 10, []int{0, 1, 2}},
+		{"out of range", []int{-1, 3, 10, 11}, 10, []int{3}},
+		{"duplicates", []int{1, 1, 1, 2, 1}, 10, []int{1, 2}},
+		{"window", []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, 10, []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		{"duplicates don't count for the window", []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 10, []int{0, 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := fileRequestMessage{Chunks: test.chunks}
+			if chunks := req.chunks(test.total); !reflect.DeepEqual(chunks, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, chunks)
+			}
+		})
+	}
+}
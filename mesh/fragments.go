@@ -0,0 +1,112 @@
+package mesh
+
+import (
+	"bytes"
+	"github.com/evilsocket/islazy/log"
+	"sync"
+	"time"
+)
+
+var (
+	// maximum size in bytes of the payload of a single message frame
+	FragmentSize = 1024
+	// maximum number of fragments of a single message
+	FragmentMax = 64
+	// maximum number of messages being reassembled at the same time
+	FragmentStreams = 32
+	// maximum number of messages from the same peer being reassembled at the same time
+	FragmentStreamsPerPeer = 4
+	// time in seconds to wait for the missing fragments of a message
+	FragmentTimeout = 10
+)
+
+type fragmentKey struct {
+	ident  string
+	stream uint64
+}
+
+type fragmentStream struct {
+	chunks    [][]byte
+	received  int
+	signature []byte
+	startedAt time.Time
+}
+
+// reassembles the messages that have been split in several frames
+type fragments struct {
+	sync.Mutex
+	streams map[fragmentKey]*fragmentStream
+}
+
+func newFragments() *fragments {
+	return &fragments{
+		streams: make(map[fragmentKey]*fragmentStream),
+	}
+}
+
+// adds a fragment of a message, once every fragment has been received returns the whole
+// payload and its signature, nil otherwise
+func (f *fragments) add(ident string, streamID, seqNum, seqTot uint64, payload []byte, signature []byte) ([]byte, []byte) {
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now()
+	timeout := time.Duration(FragmentTimeout) * time.Second
+	for key, stream := range f.streams {
+		if now.Sub(stream.startedAt) > timeout {
+			log.Debug("message %x from %s expired with %d/%d fragments", key.stream, key.ident, stream.received, len(stream.chunks))
+			delete(f.streams, key)
+		}
+	}
+
+	if seqTot == 0 || seqTot > uint64(FragmentMax) || seqNum >= seqTot {
+		log.Debug("invalid fragment %d/%d of message %x from %s", seqNum, seqTot, streamID, ident)
+		return nil, nil
+	}
+
+	key := fragmentKey{ident: ident, stream: streamID}
+	stream, found := f.streams[key]
+	if !found {
+		if len(f.streams) >= FragmentStreams {
+			log.Debug("too many messages being reassembled, dropping fragment of %x from %s", streamID, ident)
+			return nil, nil
+		} else if f.streamsOf(ident) >= FragmentStreamsPerPeer {
+			log.Debug("too many messages from %s being reassembled, dropping fragment of %x", ident, streamID)
+			return nil, nil
+		}
+		stream = &fragmentStream{
+			chunks:    make([][]byte, seqTot),
+			startedAt: now,
+		}
+		f.streams[key] = stream
+	} else if uint64(len(stream.chunks)) != seqTot {
+		log.Debug("fragment %d/%d doesn't match message %x from %s", seqNum, seqTot, streamID, ident)
+		return nil, nil
+	}
+
+	if stream.chunks[seqNum] == nil {
+		stream.chunks[seqNum] = payload
+		stream.received++
+	}
+	if signature != nil {
+		stream.signature = signature
+	}
+
+	if stream.received < len(stream.chunks) {
+		return nil, nil
+	}
+
+	delete(f.streams, key)
+	return bytes.Join(stream.chunks, nil), stream.signature
+}
+
+// number of messages from the given peer being reassembled (lock must be held)
+func (f *fragments) streamsOf(ident string) int {
+	n := 0
+	for key := range f.streams {
+		if key.ident == ident {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,144 @@
+package mesh
+
+import (
+	"testing"
+)
+
+type testFragment struct {
+	ident     string
+	stream    uint64
+	seqNum    uint64
+	seqTot    uint64
+	payload   string
+	signature string
+}
+
+func TestFragmentsReassembly(t *testing.T) {
+	tests := []struct {
+		name      string
+		fragments []testFragment
+		payload   string
+		signature string
+	}{
+		{
+			name: "single fragment",
+			fragments: []testFragment{
+				{"a", 1, 0, 1, "hello", "sig"},
+			},
+			payload:   "hello",
+			signature: "sig",
+		},
+		{
+			name: "in order",
+			fragments: []testFragment{
+				{"a", 1, 0, 3, "he", "sig"},
+				{"a", 1, 1, 3, "ll", ""},
+				{"a", 1, 2, 3, "o", ""},
+			},
+			payload:   "hello",
+			signature: "sig",
+		},
+		{
+			name: "out of order",
+			fragments: []testFragment{
+				{"a", 1, 2, 3, "o", ""},
+				{"a", 1, 0, 3, "he", "sig"},
+				{"a", 1, 1, 3, "ll", ""},
+			},
+			payload:   "hello",
+			signature: "sig",
+		},
+		{
+			name: "duplicate fragment",
+			fragments: []testFragment{
+				{"a", 1, 0, 2, "he", "sig"},
+				{"a", 1, 0, 2, "xx", ""},
+				{"a", 1, 1, 2, "llo", ""},
+			},
+			payload:   "hello",
+			signature: "sig",
+		},
+		{
+			name: "interleaved peers",
+			fragments: []testFragment{
+				{"a", 1, 0, 2, "he", "sig"},
+				{"b", 1, 0, 2, "wo", "other"},
+				{"a", 1, 1, 2, "llo", ""},
+			},
+			payload:   "hello",
+			signature: "sig",
+		},
+		{
+			name: "missing fragment",
+			fragments: []testFragment{
+				{"a", 1, 0, 3, "he", "sig"},
+				{"a", 1, 2, 3, "o", ""},
+			},
+		},
+		{
+			name: "zero total",
+			fragments: []testFragment{
+				{"a", 1, 0, 0, "hello", "sig"},
+			},
+		},
+		{
+			name: "sequence out of range",
+			fragments: []testFragment{
+				{"a", 1, 1, 1, "hello", "sig"},
+			},
+		},
+		{
+			name: "too many fragments",
+			fragments: []testFragment{
+				{"a", 1, 0, uint64(FragmentMax + 1), "hello", "sig"},
+			},
+		},
+		{
+			name: "total mismatch",
+			fragments: []testFragment{
+				{"a", 1, 0, 2, "he", "sig"},
+				{"a", 1, 1, 3, "llo", ""},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFragments()
+			var payload, signature []byte
+			for _, frag := range test.fragments {
+				var sig []byte
+				if frag.signature != "" {
+					sig = []byte(frag.signature)
+				}
+				if p, s := f.add(frag.ident, frag.stream, frag.seqNum, frag.seqTot, []byte(frag.payload), sig); p != nil {
+					payload, signature = p, s
+				}
+			}
+
+			if string(payload) != test.payload {
+				t.Fatalf("expected payload '%s', got '%s'", test.payload, payload)
+			} else if string(signature) != test.signature {
+				t.Fatalf("expected signature '%s', got '%s'", test.signature, signature)
+			}
+		})
+	}
+}
+
+func TestFragmentsStreamsLimit(t *testing.T) {
+	f := newFragments()
+	for stream := 0; stream < FragmentStreamsPerPeer; stream++ {
+		f.add("a", uint64(stream), 0, 2, []byte("x"), nil)
+	}
+
+	// the same peer can't start another message
+	f.add("a", 1000, 0, 2, []byte("x"), nil)
+	if n := f.streamsOf("a"); n != FragmentStreamsPerPeer {
+		t.Fatalf("expected %d streams, got %d", FragmentStreamsPerPeer, n)
+	}
+
+	// while other peers can
+	if payload, _ := f.add("b", 1000, 0, 1, []byte("x"), nil); payload == nil {
+		t.Fatalf("expected the message of another peer to be reassembled")
+	}
+}
@@ -0,0 +1,829 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/evilsocket/islazy/fs"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/crypto"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MessageGroupKey   = "group_key"
+	MessageGroupAck   = "group_key_ack"
+	MessageGroupLeave = "group_leave"
+	MessageGroupPost  = "group_post"
+
+	GroupViaMesh   = "mesh"
+	GroupViaServer = "server"
+)
+
+var (
+	// period in seconds for the group key to be sent to members in range that didn't acknowledge it yet
+	GroupKeyPeriod = 10
+	// how many posts are kept in each group inbox
+	GroupInboxSize = 100
+	// maximum size in bytes of a group post
+	GroupPostMaxSize = 1024
+)
+
+// Group is a named set of units sharing a symmetric key, only the owner can change its members.
+type Group struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Members   []string  `json:"members"`
+	Epoch     int       `json:"epoch"`
+	CreatedAt time.Time `json:"created_at"`
+	RekeyedAt time.Time `json:"rekeyed_at"`
+	// owner only, the key epoch each member acknowledged
+	Delivered map[string]int `json:"delivered,omitempty"`
+
+	key   []byte
+	inbox []*GroupPost
+}
+
+func (group *Group) copy() *Group {
+	copied := *group
+	copied.Members = append([]string{}, group.Members...)
+	if group.Delivered != nil {
+		copied.Delivered = make(map[string]int)
+		for fingerprint, epoch := range group.Delivered {
+			copied.Delivered[fingerprint] = epoch
+		}
+	}
+	copied.key = nil
+	copied.inbox = nil
+	return &copied
+}
+
+func (group *Group) isMember(fingerprint string) bool {
+	for _, member := range group.Members {
+		if member == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupPost is a message posted to a group, either by us or by another member.
+type GroupPost struct {
+	ID         string    `json:"id"`
+	From       string    `json:"from"`
+	Data       string    `json:"data"`
+	Via        string    `json:"via"`
+	SentAt     time.Time `json:"sent_at"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+type groupKeyMessage struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+	Epoch   int      `json:"epoch"`
+	// encrypted with the public key of the recipient
+	Key       []byte `json:"key"`
+	Signature []byte `json:"signature"`
+}
+
+func (m *groupKeyMessage) signed(key []byte) []byte {
+	hash := sha256.Sum256(key)
+	return []byte(fmt.Sprintf("%s:%s:%s:%s:%d:%x", m.ID, m.Name, m.Owner, strings.Join(m.Members, ","), m.Epoch, hash))
+}
+
+type groupAckMessage struct {
+	ID    string `json:"id"`
+	Epoch int    `json:"epoch"`
+}
+
+type groupLeaveMessage struct {
+	ID string `json:"id"`
+}
+
+type groupPostMessage struct {
+	ID    string `json:"id"`
+	Epoch int    `json:"epoch"`
+	// groupPostPayload encrypted with the group key
+	Data []byte `json:"data"`
+}
+
+type groupPostPayload struct {
+	From   string    `json:"from"`
+	Data   string    `json:"data"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+type jsonGroup struct {
+	*Group
+	Key   []byte       `json:"key"`
+	Inbox []*GroupPost `json:"inbox"`
+}
+
+type jsonGroups struct {
+	// last server inbox message processed
+	Cursor int                   `json:"cursor"`
+	Groups map[string]*jsonGroup `json:"groups"`
+}
+
+// Groups holds the groups we own or are member of, keys are distributed over the mesh
+// and posts are broadcast to the members in range.
+type Groups struct {
+	sync.Mutex
+	path   string
+	self   string
+	keys   *crypto.KeyPair
+	router *Router
+	cursor int
+	groups map[string]*Group
+}
+
+func GroupsFromPath(path string, router *Router) (err error, groups *Groups) {
+	if path, err = fs.Expand(path); err != nil {
+		return err, nil
+	}
+
+	groups = &Groups{
+		path:   path,
+		self:   router.local.Keys.FingerprintHex,
+		keys:   router.local.Keys,
+		router: router,
+		groups: make(map[string]*Group),
+	}
+
+	if fs.Exists(path) {
+		log.Debug("loading %s ...", path)
+		var doc jsonGroups
+		if data, err := ioutil.ReadFile(path); err != nil {
+			return fmt.Errorf("error loading %s: %v", path, err), nil
+		} else if err = json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("error loading %s: %v", path, err), nil
+		}
+
+		groups.cursor = doc.Cursor
+		for id, g := range doc.Groups {
+			if g.Group == nil {
+				continue
+			}
+			g.Group.key = g.Key
+			g.Group.inbox = g.Inbox
+			if g.Group.inbox == nil {
+				g.Group.inbox = make([]*GroupPost, 0)
+			}
+			groups.groups[id] = g.Group
+		}
+	}
+
+	for _, msgType := range []string{MessageGroupKey, MessageGroupAck, MessageGroupLeave, MessageGroupPost} {
+		router.OnSignedMessage(msgType, groups.onMessage)
+	}
+
+	log.Debug("loaded %d groups", len(groups.groups))
+
+	router.spawn(groups.worker)
+
+	return
+}
+
+// the file contains the group keys, it's readable only by us and replaced atomically
+func (groups *Groups) save() error {
+	doc := jsonGroups{
+		Cursor: groups.cursor,
+		Groups: make(map[string]*jsonGroup),
+	}
+	for id, group := range groups.groups {
+		doc.Groups[id] = &jsonGroup{
+			Group: group,
+			Key:   group.key,
+			Inbox: group.inbox,
+		}
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := groups.path + ".tmp"
+	if err = ioutil.WriteFile(tmpFileName, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, groups.path)
+}
+
+func newGroupKey() ([]byte, error) {
+	key := make([]byte, crypto.AESKEyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func normalizeMembers(self string, members []string) ([]string, error) {
+	unique := map[string]bool{self: true}
+	for _, member := range members {
+		if !fingValidator.MatchString(member) {
+			return nil, fmt.Errorf("invalid fingerprint %s", member)
+		}
+		unique[strings.ToLower(member)] = true
+	}
+
+	list := make([]string, 0, len(unique))
+	for member := range unique {
+		list = append(list, member)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+func (groups *Groups) List() []*Group {
+	groups.Lock()
+	defer groups.Unlock()
+
+	list := make([]*Group, 0, len(groups.groups))
+	for _, group := range groups.groups {
+		list = append(list, group.copy())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (groups *Groups) Of(id string) *Group {
+	groups.Lock()
+	defer groups.Unlock()
+	if group, found := groups.groups[id]; found {
+		return group.copy()
+	}
+	return nil
+}
+
+// returns the posts of a group, oldest first
+func (groups *Groups) Inbox(id string) ([]*GroupPost, error) {
+	groups.Lock()
+	defer groups.Unlock()
+
+	group, found := groups.groups[id]
+	if !found {
+		return nil, fmt.Errorf("group %s not found", id)
+	}
+
+	list := make([]*GroupPost, 0, len(group.inbox))
+	for _, post := range group.inbox {
+		copied := *post
+		list = append(list, &copied)
+	}
+	return list, nil
+}
+
+func (groups *Groups) Create(name string, members []string) (*Group, error) {
+	if name = strings.TrimSpace(name); name == "" {
+		return nil, fmt.Errorf("group name can't be empty")
+	}
+
+	members, err := normalizeMembers(groups.self, members)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := newGroupKey()
+	if err != nil {
+		return nil, err
+	}
+
+	idBuf := make([]byte, 8)
+	if _, err := rand.Read(idBuf); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	group := &Group{
+		ID:        hex.EncodeToString(idBuf),
+		Name:      name,
+		Owner:     groups.self,
+		Members:   members,
+		Epoch:     1,
+		CreatedAt: now,
+		RekeyedAt: now,
+		Delivered: map[string]int{groups.self: 1},
+		key:       key,
+		inbox:     make([]*GroupPost, 0),
+	}
+
+	groups.Lock()
+	defer groups.Unlock()
+
+	groups.groups[group.ID] = group
+
+	log.Info("group %s (%s) created with %d members", group.Name, group.ID, len(group.Members))
+
+	return group.copy(), groups.save()
+}
+
+func (groups *Groups) owned(id string) (*Group, error) {
+	group, found := groups.groups[id]
+	if !found {
+		return nil, fmt.Errorf("group %s not found", id)
+	} else if group.Owner != groups.self {
+		return nil, fmt.Errorf("group %s is owned by %s", id, group.Owner)
+	}
+	return group, nil
+}
+
+// generates a new key for the group, to be called with the lock held
+func (groups *Groups) rekey(group *Group) error {
+	key, err := newGroupKey()
+	if err != nil {
+		return err
+	}
+
+	group.key = key
+	group.Epoch++
+	group.RekeyedAt = time.Now()
+	group.Delivered = map[string]int{groups.self: group.Epoch}
+
+	log.Info("group %s (%s) rekeyed to epoch %d", group.Name, group.ID, group.Epoch)
+
+	return nil
+}
+
+func (groups *Groups) Rekey(id string) (*Group, error) {
+	groups.Lock()
+	defer groups.Unlock()
+
+	group, err := groups.owned(id)
+	if err != nil {
+		return nil, err
+	} else if err = groups.rekey(group); err != nil {
+		return nil, err
+	}
+	return group.copy(), groups.save()
+}
+
+func (groups *Groups) AddMember(id string, fingerprint string) (*Group, error) {
+	groups.Lock()
+	defer groups.Unlock()
+
+	group, err := groups.owned(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if group.Members, err = normalizeMembers(groups.self, append(group.Members, fingerprint)); err != nil {
+		return nil, err
+	}
+
+	log.Info("%s added to group %s (%s)", fingerprint, group.Name, group.ID)
+
+	return group.copy(), groups.save()
+}
+
+// removes a member and rekeys the group so that it can't read new posts
+func (groups *Groups) RemoveMember(id string, fingerprint string) (*Group, error) {
+	groups.Lock()
+	defer groups.Unlock()
+
+	group, err := groups.owned(id)
+	if err != nil {
+		return nil, err
+	} else if !group.isMember(strings.ToLower(fingerprint)) {
+		return nil, fmt.Errorf("%s is not a member of group %s", fingerprint, id)
+	}
+
+	return group.copy(), groups.removeMember(group, strings.ToLower(fingerprint))
+}
+
+func (groups *Groups) removeMember(group *Group, fingerprint string) error {
+	if fingerprint == groups.self {
+		return fmt.Errorf("the owner can't be removed from the group")
+	}
+
+	members := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		if member != fingerprint {
+			members = append(members, member)
+		}
+	}
+	group.Members = members
+
+	log.Info("%s removed from group %s (%s)", fingerprint, group.Name, group.ID)
+
+	if err := groups.rekey(group); err != nil {
+		return err
+	}
+	return groups.save()
+}
+
+// deletes the group if we own it, otherwise leaves it and returns the message to notify the owner
+func (groups *Groups) Leave(id string) (*Message, error) {
+	groups.Lock()
+	group, found := groups.groups[id]
+	if !found {
+		groups.Unlock()
+		return nil, fmt.Errorf("group %s not found", id)
+	}
+
+	delete(groups.groups, id)
+	err := groups.save()
+	groups.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if group.Owner == groups.self {
+		log.Info("group %s (%s) deleted", group.Name, group.ID)
+		return nil, nil
+	}
+
+	log.Info("left group %s (%s)", group.Name, group.ID)
+
+	if err := groups.router.SendTo(group.Owner, MessageGroupLeave, groupLeaveMessage{ID: id}); err != nil {
+		log.Debug("could not notify %s over the mesh: %v", group.Owner, err)
+	}
+
+	return NewMessage(MessageGroupLeave, groupLeaveMessage{ID: id})
+}
+
+// returns the members that didn't acknowledge the current key of a group we own
+func (groups *Groups) Pending(id string) []string {
+	groups.Lock()
+	defer groups.Unlock()
+
+	pending := make([]string, 0)
+	if group, err := groups.owned(id); err == nil {
+		for _, member := range group.Members {
+			if group.Delivered[member] < group.Epoch {
+				pending = append(pending, member)
+			}
+		}
+	}
+	return pending
+}
+
+// returns the message carrying the current group key for the given member, encrypted with its public key
+func (groups *Groups) KeyMessageFor(id string, member string, memberKeys *crypto.KeyPair) (*Message, error) {
+	groups.Lock()
+	group, err := groups.owned(id)
+	if err == nil {
+		// the key is replaced on rekey, never modified, it can be used once the lock is released
+		key := group.key
+		group = group.copy()
+		group.key = key
+	}
+	groups.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return groups.keyMessage(group, memberKeys)
+}
+
+func (groups *Groups) keyMessage(group *Group, memberKeys *crypto.KeyPair) (*Message, error) {
+	wrapped, err := groups.keys.EncryptBlockFor(group.key, memberKeys.Public)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := groupKeyMessage{
+		ID:      group.ID,
+		Name:    group.Name,
+		Owner:   group.Owner,
+		Members: group.Members,
+		Epoch:   group.Epoch,
+		Key:     wrapped,
+	}
+
+	if msg.Signature, err = groups.keys.SignMessage(msg.signed(group.key)); err != nil {
+		return nil, err
+	}
+
+	return NewMessage(MessageGroupKey, msg)
+}
+
+func postID(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:8])
+}
+
+// appends a post to the group inbox unless we already have it, to be called with the lock held
+func (groups *Groups) store(group *Group, post *GroupPost) bool {
+	for _, existing := range group.inbox {
+		if existing.ID == post.ID {
+			return false
+		}
+	}
+
+	group.inbox = append(group.inbox, post)
+	if excess := len(group.inbox) - GroupInboxSize; excess > 0 {
+		group.inbox = group.inbox[excess:]
+	}
+	return true
+}
+
+// encrypts and broadcasts a post to the members in range, the returned message can be relayed via the server
+func (groups *Groups) Post(id string, data string) (*Message, error) {
+	if len(data) > GroupPostMaxSize {
+		return nil, fmt.Errorf("max group post size is %d", GroupPostMaxSize)
+	}
+
+	post, err := groups.post(id, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// radio writes can take a while, other group operations must not wait for them
+	if err := groups.router.Broadcast(MessageGroupPost, post); err != nil {
+		log.Error("error broadcasting post to group %s: %v", post.ID, err)
+	}
+
+	return NewMessage(MessageGroupPost, post)
+}
+
+// encrypts the post with the current key of the group and stores it in our own inbox
+func (groups *Groups) post(id string, data string) (*groupPostMessage, error) {
+	groups.Lock()
+	defer groups.Unlock()
+
+	group, found := groups.groups[id]
+	if !found {
+		return nil, fmt.Errorf("group %s not found", id)
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(groupPostPayload{
+		From:   groups.self,
+		Data:   data,
+		SentAt: now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := crypto.EncryptWith(group.key, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	post := &groupPostMessage{
+		ID:    group.ID,
+		Epoch: group.Epoch,
+		Data:  encrypted,
+	}
+
+	groups.store(group, &GroupPost{
+		ID:         postID(payload),
+		From:       groups.self,
+		Data:       data,
+		Via:        GroupViaMesh,
+		SentAt:     now,
+		ReceivedAt: now,
+	})
+
+	if err := groups.save(); err != nil {
+		log.Error("error saving groups: %v", err)
+	}
+
+	return post, nil
+}
+
+func (groups *Groups) onMessage(ident string, peer *Peer, msg *Message) {
+	var keys *crypto.KeyPair
+	if msg.Type == MessageGroupKey {
+		// needed to verify the signature of the owner, if not available yet it'll be at the next attempt
+		if keys = groups.router.PublicKeyOf(ident); keys == nil {
+			return
+		}
+	}
+
+	reply, err := groups.Receive(ident, keys, msg, GroupViaMesh)
+	if err != nil {
+		log.Debug("error processing %s message from %s: %v", msg.Type, ident, err)
+	} else if reply != nil {
+		if err = groups.router.SendTo(ident, reply.Type, reply.Body); err != nil {
+			log.Debug("error replying to %s: %v", ident, err)
+		}
+	}
+}
+
+// processes a group message received either over the mesh or via the server, the sender keys are
+// only required for key messages, returns an optional reply for the sender.
+func (groups *Groups) Receive(sender string, senderKeys *crypto.KeyPair, msg *Message, via string) (*Message, error) {
+	sender = strings.ToLower(sender)
+
+	groups.Lock()
+	defer groups.Unlock()
+
+	switch msg.Type {
+	case MessageGroupKey:
+		var gk groupKeyMessage
+		if err := json.Unmarshal(msg.Body, &gk); err != nil {
+			return nil, err
+		}
+		return groups.onKey(sender, senderKeys, &gk)
+
+	case MessageGroupAck:
+		var ack groupAckMessage
+		if err := json.Unmarshal(msg.Body, &ack); err != nil {
+			return nil, err
+		} else if group, err := groups.owned(ack.ID); err != nil {
+			return nil, err
+		} else if group.isMember(sender) && ack.Epoch == group.Epoch && group.Delivered[sender] < ack.Epoch {
+			group.Delivered[sender] = ack.Epoch
+			log.Debug("%s has the key of group %s (epoch %d)", sender, group.ID, ack.Epoch)
+			return nil, groups.save()
+		}
+		return nil, nil
+
+	case MessageGroupLeave:
+		var leave groupLeaveMessage
+		if err := json.Unmarshal(msg.Body, &leave); err != nil {
+			return nil, err
+		} else if group, err := groups.owned(leave.ID); err != nil {
+			return nil, err
+		} else if group.isMember(sender) {
+			return nil, groups.removeMember(group, sender)
+		}
+		return nil, nil
+
+	case MessageGroupPost:
+		var post groupPostMessage
+		if err := json.Unmarshal(msg.Body, &post); err != nil {
+			return nil, err
+		}
+		return nil, groups.onPost(sender, &post, via)
+	}
+
+	return nil, fmt.Errorf("unexpected message type %s", msg.Type)
+}
+
+func (groups *Groups) onKey(sender string, senderKeys *crypto.KeyPair, gk *groupKeyMessage) (*Message, error) {
+	if senderKeys == nil {
+		return nil, fmt.Errorf("public key of %s not available", sender)
+	} else if gk.Owner != sender {
+		return nil, fmt.Errorf("key of group %s sent by %s, owner is %s", gk.ID, sender, gk.Owner)
+	}
+
+	key, err := groups.keys.DecryptBlock(gk.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting key of group %s: %v", gk.ID, err)
+	} else if err = senderKeys.VerifyMessage(gk.signed(key), gk.Signature); err != nil {
+		return nil, fmt.Errorf("invalid signature for key of group %s", gk.ID)
+	}
+
+	ack, err := NewMessage(MessageGroupAck, groupAckMessage{ID: gk.ID, Epoch: gk.Epoch})
+	if err != nil {
+		return nil, err
+	}
+
+	group, found := groups.groups[gk.ID]
+	if found {
+		if group.Owner != gk.Owner {
+			return nil, fmt.Errorf("group %s is owned by %s", gk.ID, group.Owner)
+		} else if gk.Epoch <= group.Epoch {
+			// already have it, the owner probably missed our ack
+			return ack, nil
+		}
+	} else {
+		group = &Group{
+			ID:        gk.ID,
+			Owner:     gk.Owner,
+			CreatedAt: time.Now(),
+			inbox:     make([]*GroupPost, 0),
+		}
+	}
+
+	members, err := normalizeMembers(gk.Owner, gk.Members)
+	if err != nil {
+		return nil, err
+	}
+
+	isMember := false
+	for _, member := range members {
+		if member == groups.self {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		return nil, fmt.Errorf("not a member of group %s", gk.ID)
+	}
+
+	group.Name = gk.Name
+	group.Members = members
+	group.Epoch = gk.Epoch
+	group.RekeyedAt = time.Now()
+	group.key = key
+	groups.groups[group.ID] = group
+
+	if found {
+		log.Info("group %s (%s) rekeyed by %s to epoch %d", group.Name, group.ID, sender, group.Epoch)
+	} else {
+		log.Info("joined group %s (%s) owned by %s", group.Name, group.ID, sender)
+	}
+
+	return ack, groups.save()
+}
+
+func (groups *Groups) onPost(sender string, post *groupPostMessage, via string) error {
+	group, found := groups.groups[post.ID]
+	if !found {
+		return nil
+	} else if !group.isMember(sender) {
+		return fmt.Errorf("%s is not a member of group %s", sender, post.ID)
+	} else if post.Epoch != group.Epoch {
+		return fmt.Errorf("post for group %s has epoch %d, current is %d", post.ID, post.Epoch, group.Epoch)
+	}
+
+	data, err := crypto.DecryptWith(group.key, post.Data)
+	if err != nil {
+		return fmt.Errorf("error decrypting post for group %s: %v", post.ID, err)
+	}
+
+	var payload groupPostPayload
+	if err = json.Unmarshal(data, &payload); err != nil {
+		return err
+	} else if payload.From != sender {
+		return fmt.Errorf("post for group %s from %s claims to be from %s", post.ID, sender, payload.From)
+	}
+
+	if groups.store(group, &GroupPost{
+		ID:         postID(data),
+		From:       sender,
+		Data:       payload.Data,
+		Via:        via,
+		SentAt:     payload.SentAt,
+		ReceivedAt: time.Now(),
+	}) {
+		log.Info("new post from %s in group %s", sender, group.Name)
+		return groups.save()
+	}
+	return nil
+}
+
+// last server inbox message processed
+func (groups *Groups) Cursor() int {
+	groups.Lock()
+	defer groups.Unlock()
+	return groups.cursor
+}
+
+func (groups *Groups) SetCursor(cursor int) error {
+	groups.Lock()
+	defer groups.Unlock()
+	if cursor == groups.cursor {
+		return nil
+	}
+	groups.cursor = cursor
+	return groups.save()
+}
+
+// periodically sends the current key of the groups we own to the members in range that don't have it yet
+func (groups *Groups) worker() {
+	period := time.Duration(GroupKeyPeriod) * time.Second
+	log.Debug("groups worker started with a %s period", period)
+
+	for range groups.router.ticker(period) {
+		pending := make(map[string][]string)
+
+		groups.Lock()
+		for id, group := range groups.groups {
+			if group.Owner != groups.self {
+				continue
+			}
+			for _, member := range group.Members {
+				if group.Delivered[member] < group.Epoch {
+					if _, found := groups.router.peers.Load(member); found {
+						pending[id] = append(pending[id], member)
+					}
+				}
+			}
+		}
+		groups.Unlock()
+
+		for id, members := range pending {
+			for _, member := range members {
+				keys := groups.router.PublicKeyOf(member)
+				if keys == nil {
+					continue
+				}
+
+				msg, err := groups.KeyMessageFor(id, member, keys)
+				if err != nil {
+					log.Debug("error creating key message of group %s for %s: %v", id, member, err)
+				} else if err = groups.router.SendTo(member, msg.Type, msg.Body); err != nil {
+					log.Debug("error sending key of group %s to %s: %v", id, member, err)
+				}
+			}
+		}
+	}
+}
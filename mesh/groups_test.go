@@ -0,0 +1,148 @@
+package mesh
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func testGroups(t *testing.T, base string, unit *testUnit) *Groups {
+	return &Groups{
+		path:   path.Join(base, unit.name+"-groups.json"),
+		self:   unit.keys.FingerprintHex,
+		keys:   unit.keys,
+		router: unit.router,
+		groups: make(map[string]*Group),
+	}
+}
+
+func TestGroupsKeysAndPosts(t *testing.T) {
+	base, err := ioutil.TempDir("", "pwngrid-groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	units := testUnits(t, base, "a", "b", "c")
+	a, b, c := testGroups(t, base, units[0]), testGroups(t, base, units[1]), testGroups(t, base, units[2])
+
+	group, err := a.Create("test", []string{b.self})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := a.KeyMessageFor(group.ID, b.self, b.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// c is not a member and can't decrypt the key, b won't accept it if not sent by the owner
+	if _, err = c.Receive(a.self, a.keys, msg, GroupViaMesh); err == nil {
+		t.Fatalf("c accepted a key encrypted for b")
+	} else if _, err = b.Receive(c.self, c.keys, msg, GroupViaMesh); err == nil {
+		t.Fatalf("b accepted a key relayed by c")
+	}
+
+	ack, err := b.Receive(a.self, a.keys, msg, GroupViaMesh)
+	if err != nil {
+		t.Fatal(err)
+	} else if ack == nil {
+		t.Fatalf("expected an ack")
+	} else if _, err = a.Receive(b.self, nil, ack, GroupViaMesh); err != nil {
+		t.Fatal(err)
+	} else if pending := a.Pending(group.ID); len(pending) != 0 {
+		t.Fatalf("expected no pending members, got %v", pending)
+	}
+
+	post, err := a.Post(group.ID, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the author of a post can deliver it
+	if _, err = b.Receive(c.self, nil, post, GroupViaServer); err == nil {
+		t.Fatalf("post accepted from a unit that is not a member")
+	} else if _, err = b.Receive(a.self, nil, post, GroupViaServer); err != nil {
+		t.Fatal(err)
+	} else if _, err = b.Receive(a.self, nil, post, GroupViaMesh); err != nil {
+		t.Fatal(err)
+	}
+
+	inbox, err := b.Inbox(group.ID)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(inbox) != 1 {
+		t.Fatalf("expected 1 post, got %d", len(inbox))
+	} else if inbox[0].From != a.self || inbox[0].Data != "hello" || inbox[0].Via != GroupViaServer {
+		t.Fatalf("unexpected post %+v", inbox[0])
+	}
+}
+
+func TestGroupsLeave(t *testing.T) {
+	base, err := ioutil.TempDir("", "pwngrid-groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	units := testUnits(t, base, "a", "b", "c")
+	a, b, c := testGroups(t, base, units[0]), testGroups(t, base, units[1]), testGroups(t, base, units[2])
+
+	group, err := a.Create("test", []string{b.self, c.self})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, member := range []*Groups{b, c} {
+		msg, err := a.KeyMessageFor(group.ID, member.self, member.keys)
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err = member.Receive(a.self, a.keys, msg, GroupViaMesh); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the owner can remove members
+	if _, err = b.RemoveMember(group.ID, c.self); err == nil {
+		t.Fatalf("member removed by a unit that doesn't own the group")
+	}
+
+	leave, err := b.Leave(group.ID)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = a.Receive(b.self, nil, leave, GroupViaMesh); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := a.Of(group.ID)
+	if updated.isMember(b.self) {
+		t.Fatalf("b is still a member")
+	} else if updated.Epoch != group.Epoch+1 {
+		t.Fatalf("expected the group to be rekeyed to epoch %d, got %d", group.Epoch+1, updated.Epoch)
+	}
+
+	// c needs the new key to read posts, b can't get it anymore
+	post, err := a.Post(group.ID, "hello")
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = c.Receive(a.self, nil, post, GroupViaMesh); err == nil {
+		t.Fatalf("post accepted with an old key")
+	}
+
+	msg, err := a.KeyMessageFor(group.ID, c.self, c.keys)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = c.Receive(a.self, a.keys, msg, GroupViaMesh); err != nil {
+		t.Fatal(err)
+	} else if _, err = c.Receive(a.self, nil, post, GroupViaMesh); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = a.KeyMessageFor(group.ID, b.self, b.keys)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = b.Receive(a.self, a.keys, msg, GroupViaMesh); err == nil {
+		t.Fatalf("b rejoined the group after leaving it")
+	}
+}
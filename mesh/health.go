@@ -0,0 +1,47 @@
+package mesh
+
+const (
+	HealthUp       = "up"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+// Health is the state of the radio links used by the mesh.
+type Health struct {
+	Status     string        `json:"status"`
+	Capture    []MuxerStatus `json:"capture"`
+	Advertiser []MuxerStatus `json:"advertiser"`
+	Peers      int           `json:"peers"`
+}
+
+func (router *Router) Health() *Health {
+	health := &Health{
+		Capture:    make([]MuxerStatus, 0, len(router.muxes)),
+		Advertiser: router.local.Links(),
+		Peers:      router.peers.Size(),
+	}
+
+	for _, mux := range router.muxes {
+		health.Capture = append(health.Capture, mux.Status())
+	}
+
+	up, total := 0, 0
+	for _, links := range [][]MuxerStatus{health.Capture, health.Advertiser} {
+		for _, link := range links {
+			if link.Up {
+				up++
+			}
+			total++
+		}
+	}
+
+	if up == total && total > 0 {
+		health.Status = HealthUp
+	} else if up == 0 {
+		health.Status = HealthDown
+	} else {
+		health.Status = HealthDegraded
+	}
+
+	return health
+}
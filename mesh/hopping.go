@@ -1,41 +1,349 @@
 package mesh
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
 	"github.com/evilsocket/islazy/log"
 	"github.com/evilsocket/islazy/str"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
-func ChannelHopping(iface string, chanList string, allChannels []int, hopPeriod int) {
+var (
+	HopEnabled  = false
+	HopPeriod   = 250
+	HopChannels = "1,6,11"
+	// when peers are around, how many slots out of DwellFactor+1 we spend on their channels
+	DwellFactor = 3
+	// bounds of the schedules we configure or align to, every slot means reconfiguring the interfaces
+	HopMinPeriod   = 100
+	HopMaxPeriod   = 60000
+	HopMaxChannels = 32
+)
+
+// Schedule is the rendezvous sequence parameters, advertised so that neighbours can align to it.
+type Schedule struct {
+	Period   int   `json:"period"`
+	Channels []int `json:"channels"`
+}
+
+// returns the rendezvous channel for a given time slot, every unit with the same schedule and a
+// reasonably synchronized clock will compute the same channel for the same slot.
+func (s Schedule) ChannelAt(slot int64) int {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(slot))
+	hash := sha256.Sum256(buf)
+	idx := binary.LittleEndian.Uint64(hash[:8]) % uint64(len(s.Channels))
+	return s.Channels[idx]
+}
+
+func (s Schedule) SlotAt(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Duration(s.Period)*time.Millisecond)
+}
+
+func (s Schedule) Equals(o Schedule) bool {
+	if s.Period != o.Period || len(s.Channels) != len(o.Channels) {
+		return false
+	}
+	for i := range s.Channels {
+		if s.Channels[i] != o.Channels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Schedule) Validate() error {
+	if s.Period < HopMinPeriod || s.Period > HopMaxPeriod {
+		return fmt.Errorf("hopping period %d is not between %d and %d milliseconds", s.Period, HopMinPeriod, HopMaxPeriod)
+	} else if len(s.Channels) == 0 {
+		return fmt.Errorf("empty hopping channels list")
+	} else if len(s.Channels) > HopMaxChannels {
+		return fmt.Errorf("%d hopping channels, no more than %d are allowed", len(s.Channels), HopMaxChannels)
+	}
+
+	seen := make(map[int]bool)
+	for _, ch := range s.Channels {
+		if ch <= 0 || ch > 173 {
+			return fmt.Errorf("invalid channel %d", ch)
+		} else if seen[ch] {
+			return fmt.Errorf("duplicate channel %d", ch)
+		}
+		seen[ch] = true
+	}
+	return nil
+}
+
+func ParseChannels(chanList string) ([]int, error) {
 	channels := []int{}
 	for _, s := range str.Comma(chanList) {
 		if ch, err := strconv.Atoi(s); err != nil {
-			log.Fatal("%v", err)
+			return nil, err
 		} else {
 			channels = append(channels, ch)
 		}
 	}
-	if len(channels) == 0 {
-		channels = allChannels
-	}
 	sort.Ints(channels)
+	return channels, nil
+}
+
+type ChannelsCallback func() []int
+
+type ChannelCallback func() int
+
+type Hopper struct {
+	sync.Mutex
+	ifaces    []string
+	supported map[string]map[int]bool
+	enabled   bool
+	local     Schedule
+	schedule  Schedule
+	leader    string
+	self      string
+	channels  map[string]int
+	peers     ChannelsCallback
+	recommend ChannelCallback
+	onChange  func(enabled bool, schedule Schedule)
+	stop      chan struct{}
+}
+
+type HopperStatus struct {
+	Enabled  bool           `json:"enabled"`
+	Channels map[string]int `json:"channels"`
+	Leader   string         `json:"leader"`
+	Schedule Schedule       `json:"schedule"`
+	Local    Schedule       `json:"local"`
+}
+
+func NewHopper(ifaces []string, self string, schedule Schedule, peers ChannelsCallback) *Hopper {
+	hop := &Hopper{
+		ifaces:    ifaces,
+		supported: make(map[string]map[int]bool),
+		channels:  make(map[string]int),
+		local:     schedule,
+		schedule:  schedule,
+		self:      self,
+		leader:    self,
+		peers:     peers,
+		recommend: func() int { return 0 },
+		onChange:  func(bool, Schedule) {},
+	}
+
+	// each radio only hops on the channels it supports (a 5GHz only card will skip 2.4GHz slots)
+	for _, iface := range ifaces {
+		if channels, err := SupportedChannels(iface); err != nil || len(channels) == 0 {
+			log.Debug("could not get supported channels for %s, assuming all: %v", iface, err)
+		} else {
+			hop.supported[iface] = make(map[int]bool)
+			for _, ch := range channels {
+				hop.supported[iface][ch] = true
+			}
+		}
+	}
+
+	return hop
+}
+
+func (hop *Hopper) supports(iface string, channel int) bool {
+	if supported, found := hop.supported[iface]; found {
+		return supported[channel]
+	}
+	return true
+}
+
+func (hop *Hopper) OnChange(cb func(enabled bool, schedule Schedule)) {
+	hop.onChange = cb
+}
+
+// sets a callback returning the best rendezvous channel, used for dwell slots while nobody is around
+func (hop *Hopper) Recommend(cb ChannelCallback) {
+	hop.recommend = cb
+}
+
+func (hop *Hopper) Status() HopperStatus {
+	hop.Lock()
+	defer hop.Unlock()
+
+	channels := make(map[string]int)
+	for iface, ch := range hop.channels {
+		channels[iface] = ch
+	}
+
+	return HopperStatus{
+		Enabled:  hop.enabled,
+		Channels: channels,
+		Leader:   hop.leader,
+		Schedule: hop.schedule,
+		Local:    hop.local,
+	}
+}
+
+func (hop *Hopper) Schedule() Schedule {
+	hop.Lock()
+	defer hop.Unlock()
+	return hop.schedule
+}
 
-	go func() {
-		period := time.Duration(hopPeriod) * time.Millisecond
-		tick := time.NewTicker(period)
+// sets the local schedule, it'll be used unless a neighbour with a lower fingerprint is advertising its own
+func (hop *Hopper) Configure(schedule Schedule) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+	sort.Ints(schedule.Channels)
+
+	hop.Lock()
+	hop.local = schedule
+	hop.schedule = schedule
+	hop.leader = hop.self
+	enabled := hop.enabled
+	hop.Unlock()
+
+	log.Info("channel hopping schedule set to %+v", schedule)
+	hop.onChange(enabled, schedule)
+	return nil
+}
 
-		log.Info("channel hopper started (period:%s channels:%v)", period, channels)
+// returns true if the unit with the given fingerprint would lead the schedule
+func (hop *Hopper) Leads(fingerprint string) bool {
+	hop.Lock()
+	defer hop.Unlock()
+	return fingerprint <= hop.leader
+}
 
-		loop := 0
-		for _ = range tick.C {
-			ch := channels[loop%len(channels)]
-			// log.Debug("hopping on channel %d", ch)
-			if err, out := SetChannel(iface, ch); err != nil {
-				log.Error("%v: %s", err, out)
+// called for every advertised schedule, we follow the one of the unit with the lowest fingerprint
+// so that every unit in range eventually converges to the same sequence.
+func (hop *Hopper) Align(fingerprint string, schedule Schedule) {
+	if schedule.Validate() != nil {
+		return
+	}
+	sort.Ints(schedule.Channels)
+
+	hop.Lock()
+	if fingerprint > hop.leader {
+		hop.Unlock()
+		return
+	} else if hop.schedule.Equals(schedule) {
+		hop.leader = fingerprint
+		hop.Unlock()
+		return
+	}
+	log.Info("aligning channel hopping to %s: %+v", fingerprint, schedule)
+	hop.leader = fingerprint
+	hop.schedule = schedule
+	enabled := hop.enabled
+	hop.Unlock()
+
+	hop.onChange(enabled, schedule)
+}
+
+// drops the leader schedule if that unit is gone
+func (hop *Hopper) Forget(fingerprint string) {
+	hop.Lock()
+	if hop.leader != fingerprint {
+		hop.Unlock()
+		return
+	}
+	hop.leader = hop.self
+	hop.schedule = hop.local
+	enabled := hop.enabled
+	schedule := hop.schedule
+	hop.Unlock()
+
+	hop.onChange(enabled, schedule)
+}
+
+// returns the channel the interface should be on for the given time, or 0 if it should stay where it is
+func (hop *Hopper) nextChannel(iface string, now time.Time, peersChannels []int, recommended int) int {
+	hop.Lock()
+	defer hop.Unlock()
+
+	slot := hop.schedule.SlotAt(now)
+	if DwellFactor > 0 && slot%int64(DwellFactor+1) != 0 {
+		// dwell on the channels where peers have been detected
+		channels := make([]int, 0)
+		for _, ch := range peersChannels {
+			if hop.supports(iface, ch) {
+				channels = append(channels, ch)
 			}
-			loop++
 		}
-	}()
+		if len(channels) > 0 {
+			return channels[int(slot)%len(channels)]
+		} else if recommended > 0 && hop.supports(iface, recommended) {
+			// nobody around, wait where units are more likely to show up
+			return recommended
+		}
+	}
+
+	if ch := hop.schedule.ChannelAt(slot); hop.supports(iface, ch) {
+		return ch
+	}
+	return 0
+}
+
+func (hop *Hopper) Enable(enabled bool) {
+	hop.Lock()
+	if hop.enabled == enabled {
+		hop.Unlock()
+		return
+	}
+	hop.enabled = enabled
+	schedule := hop.schedule
+	if enabled {
+		hop.stop = make(chan struct{})
+		go hop.worker(hop.stop)
+	} else {
+		close(hop.stop)
+	}
+	hop.Unlock()
+
+	hop.onChange(enabled, schedule)
+}
+
+func (hop *Hopper) worker(stop chan struct{}) {
+	log.Info("channel hopper started on %v (schedule:%+v)", hop.ifaces, hop.Schedule())
+	for {
+		now := time.Now()
+		peersChannels := hop.peers()
+		recommended := hop.recommend()
+
+		for _, iface := range hop.ifaces {
+			if _, err := linkIndex(iface); err != nil {
+				// the interface is gone, set the channel again once it's back
+				hop.Lock()
+				hop.channels[iface] = 0
+				hop.Unlock()
+				continue
+			}
+
+			ch := hop.nextChannel(iface, now, peersChannels, recommended)
+
+			hop.Lock()
+			changed := ch > 0 && ch != hop.channels[iface]
+			if changed {
+				hop.channels[iface] = ch
+			}
+			hop.Unlock()
+
+			if changed {
+				if err, out := SetChannel(iface, ch); err != nil {
+					log.Error("%v: %s", err, out)
+				}
+			}
+		}
+
+		hop.Lock()
+		period := time.Duration(hop.schedule.Period) * time.Millisecond
+		hop.Unlock()
+
+		// sleep until the beginning of the next slot
+		select {
+		case <-time.After(period - time.Duration(now.UnixNano()%int64(period))):
+		case <-stop:
+			log.Info("channel hopper stopped")
+			return
+		}
+	}
 }
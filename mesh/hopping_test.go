@@ -0,0 +1,76 @@
+package mesh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScheduleValidate(t *testing.T) {
+	many := make([]int, 0)
+	for ch := 1; ch <= HopMaxChannels+1; ch++ {
+		many = append(many, ch)
+	}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		valid    bool
+	}{
+		{"default", Schedule{Period: 250, Channels: []int{1, 6, 11}}, true},
+		{"minimum period", Schedule{Period: HopMinPeriod, Channels: []int{1}}, true},
+		{"zero period", Schedule{Period: 0, Channels: []int{1, 6, 11}}, false},
+		{"short period", Schedule{Period: 1, Channels: []int{1, 6, 11}}, false},
+		{"long period", Schedule{Period: HopMaxPeriod + 1, Channels: []int{1, 6, 11}}, false},
+		{"no channels", Schedule{Period: 250}, false},
+		{"invalid channel", Schedule{Period: 250, Channels: []int{1, 174}}, false},
+		{"duplicate channel", Schedule{Period: 250, Channels: []int{1, 6, 6}}, false},
+		{"max channels", Schedule{Period: 250, Channels: many[:HopMaxChannels]}, true},
+		{"too many channels", Schedule{Period: 250, Channels: many}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.schedule.Validate(); test.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if !test.valid && err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestHopperAlign(t *testing.T) {
+	self := strings.Repeat("b", 64)
+	local := Schedule{Period: 250, Channels: []int{1, 6, 11}}
+
+	tests := []struct {
+		name     string
+		leader   string
+		schedule Schedule
+		aligned  bool
+	}{
+		{"lower fingerprint", strings.Repeat("a", 64), Schedule{Period: 500, Channels: []int{11, 1}}, true},
+		{"higher fingerprint", strings.Repeat("c", 64), Schedule{Period: 500, Channels: []int{1, 11}}, false},
+		{"short period", strings.Repeat("a", 64), Schedule{Period: 1, Channels: []int{1, 11}}, false},
+		{"duplicate channels", strings.Repeat("a", 64), Schedule{Period: 500, Channels: []int{1, 1, 1}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hop := NewHopper(nil, self, local, func() []int { return nil })
+			changed := false
+			hop.onChange = func(bool, Schedule) { changed = true }
+
+			hop.Align(test.leader, test.schedule)
+
+			status := hop.Status()
+			if test.aligned {
+				if !changed || status.Leader != test.leader || !status.Schedule.Equals(test.schedule) {
+					t.Fatalf("expected to align to %s %+v, got %s %+v", test.leader, test.schedule, status.Leader, status.Schedule)
+				}
+			} else if changed || status.Leader != self || !status.Schedule.Equals(local) {
+				t.Fatalf("expected to keep the local schedule, got %s %+v", status.Leader, status.Schedule)
+			}
+		})
+	}
+}
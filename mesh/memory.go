@@ -1,22 +1,62 @@
 package mesh
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/evilsocket/islazy/fs"
 	"github.com/evilsocket/islazy/log"
+	bolt "go.etcd.io/bbolt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+var (
+	MemoryFileName    = "memory.db"
+	MemoryFlushPeriod = 30
+	MemorySync        = true
+	// retention policy, zero values disable the corresponding rule
+	MemoryMaxPeers = 0
+	MemoryMaxAge   = 0
+	// counted as encounter sessions, not as received advertisements
+	MemoryMinEncounters = 0
+	// seconds after the last sighting before MemoryMinEncounters is applied, a peer met recently could be met again
+	MemoryEncountersGrace = 86400
+
+	ErrMemoryClosed = errors.New("peers memory is closed")
+
+	peersBucket      = []byte("peers")
+	encountersBucket = []byte("encounters")
+	// proofs of encounter are kept even when the peer is forgotten
+	proofsBucket = []byte("proofs")
+)
+
+type lostEncounter struct {
+	fingerprint string
+	encounter   *Encounter
+}
+
 type Memory struct {
 	sync.Mutex
-	path  string
-	peers map[string]*Peer
+	path     string
+	db       *bolt.DB
+	peers    map[string]*Peer
+	sessions map[string]*Encounter
+	// fingerprints of the peers that changed since the last flush
+	dirty map[string]bool
+	// sessions that have been closed since the last flush
+	lost []lostEncounter
+	// fingerprints of the peers that have been evicted since the last flush
+	forgotten []string
+	stop      chan struct{}
+	done      chan struct{}
 }
 
 func MemoryFromPath(path string) (err error, mem *Memory) {
@@ -25,8 +65,14 @@ func MemoryFromPath(path string) (err error, mem *Memory) {
 	}
 
 	mem = &Memory{
-		path:  path,
-		peers: make(map[string]*Peer),
+		path:      path,
+		peers:     make(map[string]*Peer),
+		sessions:  make(map[string]*Encounter),
+		dirty:     make(map[string]bool),
+		lost:      make([]lostEncounter, 0),
+		forgotten: make([]string, 0),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
 	}
 
 	if !fs.Exists(path) {
@@ -36,8 +82,66 @@ func MemoryFromPath(path string) (err error, mem *Memory) {
 		}
 	}
 
-	err = fs.Glob(path, "*.json", func(fileName string) error {
-		log.Debug("loading %s ...", fileName)
+	dbFileName := mem.fileName()
+	log.Debug("opening %s ...", dbFileName)
+	if mem.db, err = bolt.Open(dbFileName, 0644, &bolt.Options{Timeout: 1 * time.Second}); err != nil {
+		return fmt.Errorf("error opening %s: %v", dbFileName, err), nil
+	}
+	// when disabled, a power loss might cost us the last flushed transaction, but we save a lot of fsyncs
+	mem.db.NoSync = !MemorySync
+
+	err = mem.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(peersBucket); err != nil {
+			return err
+		} else if _, err := tx.CreateBucketIfNotExists(encountersBucket); err != nil {
+			return err
+		} else if _, err := tx.CreateBucketIfNotExists(proofsBucket); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error initializing %s: %v", dbFileName, err), nil
+	}
+
+	if err = mem.migrate(); err != nil {
+		return err, nil
+	}
+
+	// evicted peers are removed before loading, so that they're never decoded in full
+	if removed, err := mem.compactStored(); err != nil {
+		return fmt.Errorf("error compacting %s: %v", dbFileName, err), nil
+	} else if removed > 0 {
+		log.Info("removed %d stored peers from memory", removed)
+	}
+
+	err = mem.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(peersBucket).ForEach(func(k, v []byte) error {
+			var peer jsonPeer
+			if err := json.Unmarshal(v, &peer); err != nil {
+				log.Error("error loading peer %s: %v", k, err)
+				return nil
+			}
+			mem.peers[peer.Fingerprint] = peerFromJSON(peer)
+			return nil
+		})
+	})
+
+	log.Debug("loaded %d known peers", len(mem.peers))
+
+	go mem.flusher()
+
+	return
+}
+
+func (mem *Memory) fileName() string {
+	return path.Join(mem.path, MemoryFileName)
+}
+
+// imports the legacy <fingerprint>.json files into the database, each one as a single encounter
+func (mem *Memory) migrate() error {
+	return fs.Glob(mem.path, "*.json", func(fileName string) error {
+		log.Info("migrating %s ...", fileName)
 		data, err := ioutil.ReadFile(fileName)
 		if err != nil {
 			log.Error("error loading %s: %v", fileName, err)
@@ -50,15 +154,301 @@ func MemoryFromPath(path string) (err error, mem *Memory) {
 			return nil
 		}
 
-		mem.peers[peer.Fingerprint] = peerFromJSON(peer)
-		return nil
+		enc := NewEncounter(peer.DetectedAt)
+		enc.Seen(peer.SeenAt, peer.Channel, peer.RSSI)
+		enc.Lost(peer.SeenAt)
+
+		err = mem.db.Update(func(tx *bolt.Tx) error {
+			if err := tx.Bucket(peersBucket).Put([]byte(peer.Fingerprint), data); err != nil {
+				return err
+			}
+			return putEncounter(tx, peer.Fingerprint, enc)
+		})
+		if err != nil {
+			return fmt.Errorf("error migrating %s: %v", fileName, err)
+		}
+
+		// keep the original file around, but out of the way
+		return os.Rename(fileName, fileName+".migrated")
 	})
+}
 
-	log.Debug("loaded %d known peers", len(mem.peers))
+// applies the retention policy to the stored peers iterating the database, returns the
+// number of peers that have been removed
+func (mem *Memory) compactStored() (removed int, err error) {
+	if MemoryMaxPeers <= 0 && MemoryMaxAge <= 0 && MemoryMinEncounters <= 0 {
+		return 0, nil
+	}
+
+	type storedPeer struct {
+		fingerprint string
+		seenAt      time.Time
+	}
+
+	maxAge := time.Duration(MemoryMaxAge) * time.Second
+	grace := time.Duration(MemoryEncountersGrace) * time.Second
+	err = mem.db.Update(func(tx *bolt.Tx) error {
+		kept := make([]storedPeer, 0)
+		evicted := make([]string, 0)
+		err := tx.Bucket(peersBucket).ForEach(func(k, v []byte) error {
+			var peer struct {
+				SeenAt time.Time `json:"seen_at"`
+			}
+			// broken records are reported when loading
+			if err := json.Unmarshal(v, &peer); err != nil {
+				return nil
+			}
+
+			fingerprint := string(k)
+			if MemoryMaxAge > 0 && time.Since(peer.SeenAt) > maxAge {
+				log.Debug("evicting peer %s, last seen %s", fingerprint, peer.SeenAt)
+				evicted = append(evicted, fingerprint)
+			} else if MemoryMinEncounters > 0 && time.Since(peer.SeenAt) > grace &&
+				countSessions(tx, fingerprint, MemoryMinEncounters) < MemoryMinEncounters {
+				log.Debug("evicting peer %s met less than %d times", fingerprint, MemoryMinEncounters)
+				evicted = append(evicted, fingerprint)
+			} else {
+				kept = append(kept, storedPeer{fingerprint: fingerprint, seenAt: peer.SeenAt})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if MemoryMaxPeers > 0 && len(kept) > MemoryMaxPeers {
+			// least recently seen first
+			sort.Slice(kept, func(i, j int) bool {
+				return kept[i].seenAt.Before(kept[j].seenAt)
+			})
+			for _, peer := range kept[:len(kept)-MemoryMaxPeers] {
+				log.Debug("evicting least recently seen peer %s", peer.fingerprint)
+				evicted = append(evicted, peer.fingerprint)
+			}
+		}
+
+		for _, fingerprint := range evicted {
+			if err := deletePeer(tx, fingerprint); err != nil {
+				return err
+			}
+		}
+		removed = len(evicted)
+		return nil
+	})
 
 	return
 }
 
+// counts the stored encounter sessions with the given peer, stopping at max
+func countSessions(tx *bolt.Tx, fingerprint string, max int) int {
+	bucket := tx.Bucket(encountersBucket).Bucket([]byte(fingerprint))
+	if bucket == nil {
+		return 0
+	}
+
+	n := 0
+	c := bucket.Cursor()
+	for k, _ := c.First(); k != nil && n < max; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+func deletePeer(tx *bolt.Tx, fingerprint string) error {
+	if err := tx.Bucket(peersBucket).Delete([]byte(fingerprint)); err != nil {
+		return err
+	} else if err := tx.Bucket(encountersBucket).DeleteBucket([]byte(fingerprint)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
+
+func putEncounter(tx *bolt.Tx, fingerprint string, enc *Encounter) error {
+	data, err := json.Marshal(enc)
+	if err != nil {
+		return err
+	}
+	return putEncounterData(tx, fingerprint, enc.key(), data)
+}
+
+func putEncounterData(tx *bolt.Tx, fingerprint string, key []byte, data []byte) error {
+	bucket, err := tx.Bucket(encountersBucket).CreateBucketIfNotExists([]byte(fingerprint))
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+func (mem *Memory) flusher() {
+	defer close(mem.done)
+
+	period := time.Duration(MemoryFlushPeriod) * time.Second
+	tick := time.NewTicker(period)
+	defer tick.Stop()
+
+	log.Debug("memory flusher started with a %s period", period)
+
+	for {
+		select {
+		case <-tick.C:
+			mem.Compact()
+			if err := mem.Flush(); err != nil {
+				log.Error("error flushing peers memory: %v", err)
+			}
+		case <-mem.stop:
+			return
+		}
+	}
+}
+
+type pendingRecord struct {
+	fingerprint string
+	key         []byte
+	data        []byte
+}
+
+// writes every peer and encounter session that changed since the last flush in a single transaction
+func (mem *Memory) Flush() error {
+	mem.Lock()
+	peers := make([]pendingRecord, 0, len(mem.dirty))
+	encounters := make([]pendingRecord, 0, len(mem.dirty)+len(mem.lost))
+	for fingerprint := range mem.dirty {
+		if peer, found := mem.peers[fingerprint]; found {
+			if data, err := json.Marshal(peer); err != nil {
+				log.Error("error encoding peer %s: %v", fingerprint, err)
+			} else {
+				peers = append(peers, pendingRecord{fingerprint: fingerprint, data: data})
+			}
+		}
+
+		if session, found := mem.sessions[fingerprint]; found {
+			if data, err := json.Marshal(session); err != nil {
+				log.Error("error encoding encounter of %s: %v", fingerprint, err)
+			} else {
+				encounters = append(encounters, pendingRecord{fingerprint: fingerprint, key: session.key(), data: data})
+			}
+		}
+	}
+	for _, lost := range mem.lost {
+		if data, err := json.Marshal(lost.encounter); err != nil {
+			log.Error("error encoding encounter of %s: %v", lost.fingerprint, err)
+		} else {
+			encounters = append(encounters, pendingRecord{fingerprint: lost.fingerprint, key: lost.encounter.key(), data: data})
+		}
+	}
+	dirty, lost, forgotten := mem.dirty, mem.lost, mem.forgotten
+	mem.dirty = make(map[string]bool)
+	mem.lost = make([]lostEncounter, 0)
+	mem.forgotten = make([]string, 0)
+	mem.Unlock()
+
+	if len(peers) == 0 && len(encounters) == 0 && len(forgotten) == 0 {
+		return nil
+	}
+
+	started := time.Now()
+	db, err := mem.database()
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(peersBucket)
+			for _, fingerprint := range forgotten {
+				if err := deletePeer(tx, fingerprint); err != nil {
+					return err
+				}
+			}
+			for _, rec := range peers {
+				if err := bucket.Put([]byte(rec.fingerprint), rec.data); err != nil {
+					return err
+				}
+			}
+			for _, rec := range encounters {
+				if err := putEncounterData(tx, rec.fingerprint, rec.key, rec.data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	if err != nil {
+		// written at the next flush
+		mem.restore(dirty, lost, forgotten)
+		return err
+	}
+
+	log.Debug("flushed %d peers and %d encounters, removed %d peers in %s",
+		len(peers), len(encounters), len(forgotten), time.Since(started))
+
+	return nil
+}
+
+// puts back the changes a flush could not write, unless the peers have been forgotten in the meantime
+func (mem *Memory) restore(dirty map[string]bool, lost []lostEncounter, forgotten []string) {
+	mem.Lock()
+	defer mem.Unlock()
+
+	removed := make(map[string]bool)
+	for _, fingerprint := range mem.forgotten {
+		removed[fingerprint] = true
+	}
+
+	for fingerprint := range dirty {
+		if !removed[fingerprint] {
+			mem.dirty[fingerprint] = true
+		}
+	}
+
+	kept := make([]lostEncounter, 0, len(lost)+len(mem.lost))
+	for _, enc := range lost {
+		if !removed[enc.fingerprint] {
+			kept = append(kept, enc)
+		}
+	}
+	mem.lost = append(kept, mem.lost...)
+	mem.forgotten = append(forgotten, mem.forgotten...)
+}
+
+// closes every open encounter session, flushes pending changes and closes the database
+func (mem *Memory) Close() error {
+	mem.Lock()
+	if mem.db == nil {
+		mem.Unlock()
+		return nil
+	}
+	now := time.Now()
+	for fingerprint, session := range mem.sessions {
+		session.Lost(now)
+		mem.lost = append(mem.lost, lostEncounter{fingerprint: fingerprint, encounter: session})
+	}
+	mem.sessions = make(map[string]*Encounter)
+	mem.Unlock()
+
+	close(mem.stop)
+	<-mem.done
+
+	log.Debug("flushing peers memory ...")
+	err := mem.Flush()
+
+	mem.Lock()
+	defer mem.Unlock()
+	if cerr := mem.db.Close(); err == nil {
+		err = cerr
+	}
+	mem.db = nil
+
+	return err
+}
+
+// returns the database, or ErrMemoryClosed if the memory has been closed
+func (mem *Memory) database() (*bolt.DB, error) {
+	mem.Lock()
+	defer mem.Unlock()
+	if mem.db == nil {
+		return nil, ErrMemoryClosed
+	}
+	return mem.db, nil
+}
+
 func (mem *Memory) Size() int {
 	mem.Lock()
 	defer mem.Unlock()
@@ -88,10 +478,52 @@ func (mem *Memory) List() []*Peer {
 	return list
 }
 
+// returns the encounters with the given peer overlapping the [from, to] time range, in chronological order
+func (mem *Memory) Encounters(fingerprint string, from, to time.Time) ([]*Encounter, error) {
+	// make sure the current session is on disk
+	if err := mem.Flush(); err != nil {
+		return nil, err
+	}
+
+	list := make([]*Encounter, 0)
+	db, err := mem.database()
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(encountersBucket).Bucket([]byte(fingerprint))
+		if bucket == nil {
+			return nil
+		}
+
+		until := NewEncounter(to).key()
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k, until) <= 0; k, v = c.Next() {
+			var enc Encounter
+			if err := json.Unmarshal(v, &enc); err != nil {
+				log.Error("error loading encounter %x of %s: %v", k, fingerprint, err)
+				continue
+			}
+
+			if enc.Overlaps(from, to) {
+				list = append(list, &enc)
+			}
+		}
+
+		return nil
+	})
+
+	return list, err
+}
+
 func (mem *Memory) Track(fingerprint string, peer *Peer) error {
 	mem.Lock()
 	defer mem.Unlock()
 
+	// SeenAt is only written by the peer itself when a frame is received
+	peer.Lock()
+	defer peer.Unlock()
+
 	if encounter, found := mem.peers[fingerprint]; !found {
 		// peer first encounter
 		peer.Encounters = 1
@@ -107,17 +539,249 @@ func (mem *Memory) Track(fingerprint string, peer *Peer) error {
 		peer.Encounters = encounter.Encounters
 	}
 
-	peer.SeenAt = time.Now()
+	// open a new encounter session if this peer has just been detected
+	session, found := mem.sessions[fingerprint]
+	if !found {
+		session = NewEncounter(peer.DetectedAt)
+		mem.sessions[fingerprint] = session
+	}
+	session.Seen(peer.SeenAt, peer.Channel, peer.RSSI)
 
-	// save/update peer data in memory
+	// save/update peer data in memory, it'll be saved on disk by the next flush
 	mem.peers[fingerprint] = peer
-	// save/update peer data on disk
-	fileName := path.Join(mem.path, fmt.Sprintf("%s.json", fingerprint))
-	if data, err := json.Marshal(peer); err != nil {
+	mem.dirty[fingerprint] = true
+
+	return nil
+}
+
+// removes a peer and its encounters from memory, returns false if the peer is unknown
+func (mem *Memory) Forget(fingerprint string) bool {
+	mem.Lock()
+	defer mem.Unlock()
+
+	if _, found := mem.peers[fingerprint]; !found {
+		return false
+	}
+
+	mem.forget(fingerprint)
+	return true
+}
+
+func (mem *Memory) forget(fingerprint string) {
+	delete(mem.peers, fingerprint)
+	delete(mem.sessions, fingerprint)
+	delete(mem.dirty, fingerprint)
+
+	lost := make([]lostEncounter, 0)
+	for _, enc := range mem.lost {
+		if enc.fingerprint != fingerprint {
+			lost = append(lost, enc)
+		}
+	}
+	mem.lost = lost
+	mem.forgotten = append(mem.forgotten, fingerprint)
+}
+
+// applies the retention policy and returns the number of peers that have been removed
+func (mem *Memory) Compact() int {
+	mem.Lock()
+	defer mem.Unlock()
+
+	// peers we're currently seeing are never removed
+	candidates := make([]string, 0)
+	seenAt := make(map[string]time.Time)
+	for fingerprint, peer := range mem.peers {
+		if _, active := mem.sessions[fingerprint]; !active {
+			peer.Lock()
+			seenAt[fingerprint] = peer.SeenAt
+			peer.Unlock()
+			candidates = append(candidates, fingerprint)
+		}
+	}
+
+	// least recently seen first
+	sort.Slice(candidates, func(i, j int) bool {
+		return seenAt[candidates[i]].Before(seenAt[candidates[j]])
+	})
+
+	var sessions map[string]int
+	if MemoryMinEncounters > 0 {
+		sessions = mem.sessionsOf(candidates)
+	}
+
+	removed := 0
+	maxAge := time.Duration(MemoryMaxAge) * time.Second
+	grace := time.Duration(MemoryEncountersGrace) * time.Second
+	kept := make([]string, 0, len(candidates))
+	for _, fingerprint := range candidates {
+		seen := time.Since(seenAt[fingerprint])
+		if MemoryMaxAge > 0 && seen > maxAge {
+			log.Debug("evicting peer %s, last seen %s", fingerprint, seenAt[fingerprint])
+		} else if n, found := sessions[fingerprint]; found && n < MemoryMinEncounters && seen > grace {
+			log.Debug("evicting peer %s met %d times", fingerprint, n)
+		} else {
+			kept = append(kept, fingerprint)
+			continue
+		}
+
+		mem.forget(fingerprint)
+		removed++
+	}
+
+	// then the least recently seen ones if still too many
+	for _, fingerprint := range kept {
+		if MemoryMaxPeers <= 0 || len(mem.peers) <= MemoryMaxPeers {
+			break
+		}
+		log.Debug("evicting least recently seen peer %s", fingerprint)
+		mem.forget(fingerprint)
+		removed++
+	}
+
+	if removed > 0 {
+		log.Info("removed %d peers from memory, %d left", removed, len(mem.peers))
+	}
+
+	return removed
+}
+
+// returns the number of closed encounter sessions with each of the given peers, both stored and
+// waiting to be flushed, counting at most up to MemoryMinEncounters (lock must be held)
+func (mem *Memory) sessionsOf(fingerprints []string) map[string]int {
+	sessions := make(map[string]int)
+	if mem.db == nil {
+		return sessions
+	}
+
+	err := mem.db.View(func(tx *bolt.Tx) error {
+		for _, fingerprint := range fingerprints {
+			sessions[fingerprint] = countSessions(tx, fingerprint, MemoryMinEncounters)
+		}
+
+		for _, lost := range mem.lost {
+			if n, found := sessions[lost.fingerprint]; !found || n >= MemoryMinEncounters {
+				continue
+			} else if bucket := tx.Bucket(encountersBucket).Bucket([]byte(lost.fingerprint)); bucket == nil || bucket.Get(lost.encounter.key()) == nil {
+				sessions[lost.fingerprint]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("error counting encounters: %v", err)
+		return make(map[string]int)
+	}
+
+	return sessions
+}
+
+// closes the current encounter session with the given peer
+func (mem *Memory) Lost(fingerprint string) error {
+	mem.Lock()
+	defer mem.Unlock()
+
+	session, found := mem.sessions[fingerprint]
+	if !found {
+		return nil
+	}
+
+	delete(mem.sessions, fingerprint)
+	session.Lost(time.Now())
+	mem.lost = append(mem.lost, lostEncounter{fingerprint: fingerprint, encounter: session})
+
+	return nil
+}
+
+func (mem *Memory) StoreProof(proof *Proof) error {
+	data, err := json.Marshal(proof)
+	if err != nil {
 		return err
-	} else if err := ioutil.WriteFile(fileName, data, os.ModePerm); err != nil {
+	}
+	db, err := mem.database()
+	if err != nil {
 		return err
 	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(proofsBucket).Put([]byte(proof.ID()), data)
+	})
+}
+
+// returns the proofs of encounter with the given peer sorted by time, or every proof if
+// fingerprint is empty, if pending is true only the ones not uploaded nor rejected yet are returned
+func (mem *Memory) Proofs(fingerprint string, pending bool) ([]*Proof, error) {
+	list := make([]*Proof, 0)
+	db, err := mem.database()
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(proofsBucket).ForEach(func(k, v []byte) error {
+			var proof Proof
+			if err := json.Unmarshal(v, &proof); err != nil {
+				log.Error("error loading proof %s: %v", k, err)
+				return nil
+			}
+			if fingerprint != "" && !strings.EqualFold(proof.A, fingerprint) && !strings.EqualFold(proof.B, fingerprint) {
+				return nil
+			} else if pending && (proof.UploadedAt != nil || proof.RejectedAt != nil) {
+				return nil
+			}
+			list = append(list, &proof)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].At < list[j].At
+	})
+	return list, nil
+}
+
+// marks the proofs with the given ids as uploaded to the server
+func (mem *Memory) ProofsUploaded(ids []string, at time.Time) error {
+	return mem.updateProofs(ids, func(proof *Proof) {
+		proof.UploadedAt = &at
+	})
+}
+
+// marks the proofs the server refused, with the reasons by id, so that they're not uploaded again
+func (mem *Memory) ProofsRejected(reasons map[string]string, at time.Time) error {
+	ids := make([]string, 0, len(reasons))
+	for id := range reasons {
+		ids = append(ids, id)
+	}
+	return mem.updateProofs(ids, func(proof *Proof) {
+		proof.RejectedAt = &at
+		proof.Rejection = reasons[proof.ID()]
+	})
+}
+
+func (mem *Memory) updateProofs(ids []string, update func(proof *Proof)) error {
+	db, err := mem.database()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(proofsBucket)
+		for _, id := range ids {
+			data := bucket.Get([]byte(id))
+			if data == nil {
+				continue
+			}
+			var proof Proof
+			if err := json.Unmarshal(data, &proof); err != nil {
+				return err
+			}
+			update(&proof)
+			if data, err := json.Marshal(proof); err != nil {
+				return err
+			} else if err = bucket.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
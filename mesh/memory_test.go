@@ -0,0 +1,242 @@
+package mesh
+
+import (
+	"encoding/json"
+	"github.com/evilsocket/islazy/fs"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMemory(t *testing.T) (string, *Memory) {
+	dir, err := ioutil.TempDir("", "pwngrid-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, mem := MemoryFromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, mem
+}
+
+func TestMemoryMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pwngrid-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fingerprint := strings.Repeat("a", 64)
+	seenAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	legacy := jsonPeer{
+		Fingerprint:   fingerprint,
+		MetAt:         seenAt.Add(-time.Hour),
+		DetectedAt:    seenAt.Add(-time.Minute),
+		SeenAt:        seenAt,
+		Encounters:    12,
+		Channel:       6,
+		RSSI:          -60,
+		SessionID:     "aa:bb:cc:dd:ee:ff",
+		Advertisement: map[string]interface{}{"identity": fingerprint, "name": "alpha"},
+	}
+	data, _ := json.Marshal(legacy)
+	fileName := path.Join(dir, fingerprint+".json")
+	if err = ioutil.WriteFile(fileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err, mem := MemoryFromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+
+	if fs.Exists(fileName) || !fs.Exists(fileName+".migrated") {
+		t.Fatalf("expected the legacy file to be moved out of the way")
+	}
+
+	peer := mem.Of(fingerprint)
+	if peer == nil {
+		t.Fatalf("expected the peer to be migrated")
+	} else if !peer.SeenAt.Equal(seenAt) || peer.Encounters != 12 || peer.Channel != 6 {
+		t.Fatalf("unexpected peer %+v", peer)
+	} else if name, _ := peer.AdvData.Load("name"); name != "alpha" {
+		t.Fatalf("unexpected name %v", name)
+	}
+
+	encounters, err := mem.Encounters(fingerprint, time.Time{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(encounters) != 1 {
+		t.Fatalf("expected one encounter, got %d", len(encounters))
+	} else if enc := encounters[0]; enc.LostAt == nil || !enc.SeenAt.Equal(seenAt) || enc.Channels[6] == nil {
+		t.Fatalf("unexpected encounter %+v", enc)
+	}
+}
+
+func TestMemoryRetention(t *testing.T) {
+	defer func(maxPeers, maxAge, minEncounters, grace int) {
+		MemoryMaxPeers, MemoryMaxAge, MemoryMinEncounters, MemoryEncountersGrace = maxPeers, maxAge, minEncounters, grace
+	}(MemoryMaxPeers, MemoryMaxAge, MemoryMinEncounters, MemoryEncountersGrace)
+
+	type testPeer struct {
+		fingerprint string
+		seenAgo     time.Duration
+		sessions    int
+	}
+
+	peers := []testPeer{
+		{strings.Repeat("a", 64), time.Minute, 1},
+		{strings.Repeat("b", 64), 2 * time.Hour, 3},
+		{strings.Repeat("c", 64), 10 * time.Minute, 2},
+	}
+
+	tests := []struct {
+		name          string
+		maxPeers      int
+		maxAge        int
+		minEncounters int
+		grace         int
+		kept          []string
+	}{
+		{"no limits", 0, 0, 0, 0, []string{"a", "b", "c"}},
+		{"max peers", 2, 0, 0, 0, []string{"a", "c"}},
+		{"max age", 0, 3600, 0, 0, []string{"a", "c"}},
+		{"min encounters", 0, 0, 2, 0, []string{"b", "c"}},
+		{"min encounters grace", 0, 0, 2, 300, []string{"a", "b", "c"}},
+		{"min encounters after grace", 0, 0, 3, 300, []string{"a", "b"}},
+		{"every rule", 1, 3600, 2, 0, []string{"c"}},
+	}
+
+	for _, test := range tests {
+		// applied to the stored peers when loading them and to the loaded ones
+		for _, stored := range []bool{true, false} {
+			name := test.name + " (loaded)"
+			if stored {
+				name = test.name + " (stored)"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				MemoryMaxPeers, MemoryMaxAge, MemoryMinEncounters, MemoryEncountersGrace = 0, 0, 0, 0
+
+				dir, mem := testMemory(t)
+				defer os.RemoveAll(dir)
+
+				now := time.Now()
+				for _, p := range peers {
+					for s := 0; s < p.sessions; s++ {
+						peer := &Peer{Sightings: make(map[string]*Sighting)}
+						peer.AdvData.Store("identity", p.fingerprint)
+						peer.DetectedAt = now.Add(-p.seenAgo - time.Duration(s+1)*time.Hour)
+						peer.SeenAt = now.Add(-p.seenAgo)
+						mem.Track(p.fingerprint, peer)
+						mem.Lost(p.fingerprint)
+					}
+				}
+				if err := mem.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				setRules := func() {
+					MemoryMaxPeers, MemoryMaxAge, MemoryMinEncounters, MemoryEncountersGrace = test.maxPeers, test.maxAge, test.minEncounters, test.grace
+				}
+				if stored {
+					setRules()
+				}
+
+				err, mem := MemoryFromPath(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer mem.Close()
+
+				if !stored {
+					setRules()
+					mem.Compact()
+				}
+
+				kept := make([]string, 0)
+				for _, p := range peers {
+					if mem.Of(p.fingerprint) != nil {
+						kept = append(kept, p.fingerprint[:1])
+					}
+				}
+				if strings.Join(kept, ",") != strings.Join(test.kept, ",") {
+					t.Fatalf("expected %v to be kept, got %v", test.kept, kept)
+				}
+			})
+		}
+	}
+}
+
+// what can't be written must be written by the next flush
+func TestMemoryFlushFailure(t *testing.T) {
+	dir, mem := testMemory(t)
+	defer os.RemoveAll(dir)
+	defer mem.Close()
+
+	fingerprint := strings.Repeat("a", 64)
+	peer := &Peer{Sightings: make(map[string]*Sighting)}
+	peer.AdvData.Store("identity", fingerprint)
+	peer.DetectedAt = time.Now().Add(-time.Hour)
+	peer.SeenAt = time.Now()
+	if err := mem.Track(fingerprint, peer); err != nil {
+		t.Fatal(err)
+	} else if err = mem.Lost(fingerprint); err != nil {
+		t.Fatal(err)
+	}
+
+	mem.Lock()
+	writable := mem.db
+	mem.Unlock()
+	if err := writable.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	readOnly, err := bolt.Open(mem.fileName(), 0644, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.Lock()
+	mem.db = readOnly
+	mem.Unlock()
+
+	if err = mem.Flush(); err == nil {
+		t.Fatalf("expected an error writing a read only database")
+	}
+
+	mem.Lock()
+	dirty, lost := mem.dirty[fingerprint], len(mem.lost)
+	mem.Unlock()
+	if !dirty || lost != 1 {
+		t.Fatalf("pending changes have been dropped (dirty=%v lost=%d)", dirty, lost)
+	}
+
+	if err = readOnly.Close(); err != nil {
+		t.Fatal(err)
+	} else if writable, err = bolt.Open(mem.fileName(), 0644, nil); err != nil {
+		t.Fatal(err)
+	}
+	mem.Lock()
+	mem.db = writable
+	mem.Unlock()
+
+	if err = mem.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := 0
+	if err = writable.View(func(tx *bolt.Tx) error {
+		sessions = countSessions(tx, fingerprint, 10)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if sessions != 1 {
+		t.Fatalf("expected 1 stored encounter, got %d", sessions)
+	}
+}
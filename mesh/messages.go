@@ -0,0 +1,449 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/crypto"
+	"github.com/evilsocket/pwngrid/wifi"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	MessagePublicKeyRequest = "key_request"
+	MessagePublicKey        = "public_key"
+
+	// minimum time between two requests to authenticate a peer
+	authRequestPeriod = 10 * time.Second
+)
+
+// Message is the payload of unicast frames exchanged between peers, the sender is identified by
+// the session id of the frame so that no identity needs to be sent in clear.
+type Message struct {
+	Type string          `json:"type"`
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+type MessageHandler func(ident string, peer *Peer, msg *Message)
+
+type messageHandlers struct {
+	sync.Mutex
+	handlers map[string]MessageHandler
+	// message types that are dropped unless signed by a known key
+	signed map[string]bool
+}
+
+type publicKeyMessage struct {
+	PEM string `json:"pem"`
+}
+
+func (router *Router) OnMessage(msgType string, cb MessageHandler) {
+	router.handlers.Lock()
+	defer router.handlers.Unlock()
+	router.handlers.handlers[msgType] = cb
+}
+
+// registers a handler for messages that are only accepted with a valid signature from the sender, to be
+// used for everything that relies on the identity of the peer
+func (router *Router) OnSignedMessage(msgType string, cb MessageHandler) {
+	router.handlers.Lock()
+	defer router.handlers.Unlock()
+	router.handlers.handlers[msgType] = cb
+	router.handlers.signed[msgType] = true
+}
+
+// the signature covers the sender and receiver addresses so that a message can't be replayed from
+// another session or to another unit
+func signedBytes(from, to net.HardwareAddr, payload []byte) []byte {
+	data := make([]byte, 0, len(from)+len(to)+len(payload))
+	data = append(data, from...)
+	data = append(data, to...)
+	return append(data, payload...)
+}
+
+// returns the peer currently using the given session id, if any
+func (router *Router) peerBySession(addr net.HardwareAddr) (string, *Peer) {
+	sessionID := addr.String()
+	found := (*Peer)(nil)
+	foundIdent := ""
+	router.peers.Range(func(ident string, peer *Peer) bool {
+		peer.Lock()
+		match := peer.SessionIDStr == sessionID
+		peer.Unlock()
+		if match {
+			found = peer
+			foundIdent = ident
+			return false
+		}
+		return true
+	})
+	return foundIdent, found
+}
+
+// returns the muxer of the interface the peer has been seen on most recently
+func (router *Router) muxFor(peer *Peer) *PacketMuxer {
+	peer.Lock()
+	defer peer.Unlock()
+
+	best := (*Sighting)(nil)
+	for _, sighting := range peer.Sightings {
+		if best == nil || sighting.SeenAt.After(best.SeenAt) {
+			best = sighting
+		}
+	}
+
+	if best != nil {
+		for idx, iface := range router.ifaces {
+			if iface == best.Interface {
+				return router.muxes[idx]
+			}
+		}
+	}
+
+	if len(router.muxes) > 0 {
+		return router.muxes[0]
+	}
+	return nil
+}
+
+func NewMessage(msgType string, body interface{}) (*Message, error) {
+	msg := &Message{Type: msgType}
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding %s message: %v", msgType, err)
+		}
+		msg.Body = raw
+	}
+	return msg, nil
+}
+
+// encodes a message in one or more frames, using the features negotiated with the receiver if any
+func (router *Router) pack(to net.HardwareAddr, msgType string, body interface{}, proto *ProtocolStatus) ([][]byte, error) {
+	msg, err := NewMessage(msgType, body)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding %s message: %v", msgType, err)
+	}
+
+	router.local.Lock()
+	from := net.HardwareAddr(append(SessionID{}, router.local.SessionID...))
+	router.local.Unlock()
+
+	if proto == nil {
+		// multicast messages are understood by every unit
+		proto = &ProtocolStatus{}
+	}
+
+	// every message is signed, legacy units just ignore the signature
+	signature, err := router.local.Keys.SignMessage(signedBytes(from, to, data))
+	if err != nil {
+		return nil, fmt.Errorf("error signing %s message: %v", msgType, err)
+	}
+
+	compress := proto.Supports(CapCompress)
+	if len(data) <= FragmentSize || !proto.Supports(CapFragment) {
+		err, raw := wifi.PackOneOf(from, to, nil, signature, 0, 0, 0, data, compress)
+		if err != nil {
+			return nil, fmt.Errorf("could not encapsulate %d bytes of %s message: %v", len(data), msgType, err)
+		}
+		return [][]byte{raw}, nil
+	}
+
+	seqTot := (len(data) + FragmentSize - 1) / FragmentSize
+	if seqTot > FragmentMax {
+		return nil, fmt.Errorf("%s message is %d bytes, can't be split in more than %d fragments", msgType, len(data), FragmentMax)
+	}
+
+	idBuf := make([]byte, 8)
+	if _, err := rand.Read(idBuf); err != nil {
+		return nil, err
+	}
+	// zero means no stream
+	streamID := binary.LittleEndian.Uint64(idBuf) | 1
+
+	frames := make([][]byte, 0, seqTot)
+	for seqNum := 0; seqNum < seqTot; seqNum++ {
+		end := (seqNum + 1) * FragmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+		// the signature of the whole message is sent with the first fragment
+		fragSignature := signature
+		if seqNum > 0 {
+			fragSignature = nil
+		}
+		err, raw := wifi.PackOneOf(from, to, nil, fragSignature, streamID, uint64(seqNum), uint64(seqTot), data[seqNum*FragmentSize:end], compress)
+		if err != nil {
+			return nil, fmt.Errorf("could not encapsulate fragment %d/%d of %s message: %v", seqNum, seqTot, msgType, err)
+		}
+		frames = append(frames, raw)
+	}
+	return frames, nil
+}
+
+// sends a message to a peer currently in range
+func (router *Router) SendTo(fingerprint string, msgType string, body interface{}) error {
+	peer, found := router.peers.Load(fingerprint)
+	if !found {
+		return fmt.Errorf("peer %s is not in range", fingerprint)
+	}
+
+	peer.Lock()
+	to := net.HardwareAddr(append(SessionID{}, peer.SessionID...))
+	proto := peer.protocol()
+	peer.Unlock()
+
+	if !proto.Supports(CapUnicast) {
+		return fmt.Errorf("peer %s doesn't support unicast messages (protocol v%d)", fingerprint, proto.Version)
+	}
+
+	frames, err := router.pack(to, msgType, body, proto)
+	if err != nil {
+		return err
+	}
+
+	mux := router.muxFor(peer)
+	if mux == nil {
+		return fmt.Errorf("no interface available to reach %s", fingerprint)
+	}
+	for _, raw := range frames {
+		if err = mux.Write(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sends a message to a session that is not registered, on every interface
+func (router *Router) sendToSession(to net.HardwareAddr, msgType string, body interface{}) error {
+	frames, err := router.pack(to, msgType, body, nil)
+	if err != nil {
+		return err
+	}
+
+	sent := false
+	for _, mux := range router.muxes {
+		if !mux.Up() {
+			continue
+		}
+		for _, raw := range frames {
+			if err = mux.Write(raw); err != nil {
+				break
+			}
+		}
+		sent = sent || err == nil
+	}
+
+	if !sent {
+		return fmt.Errorf("could not send %s message to %s", msgType, to)
+	}
+	return nil
+}
+
+// sends a message to every peer in range on every interface
+func (router *Router) Broadcast(msgType string, body interface{}) error {
+	frames, err := router.pack(wifi.MulticastAddr, msgType, body, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, mux := range router.muxes {
+		if !mux.Up() {
+			continue
+		}
+		for _, raw := range frames {
+			if err = mux.Write(raw); err != nil {
+				log.Error("error sending %d bytes of %s message on %s: %v", len(raw), msgType, mux.iface, err)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// returns the public key of a peer in range, if not known yet it is requested and nil is returned
+func (router *Router) PublicKeyOf(fingerprint string) *crypto.KeyPair {
+	peer, found := router.peers.Load(fingerprint)
+	if !found {
+		return nil
+	}
+
+	peer.Lock()
+	keys := peer.Keys
+	peer.Unlock()
+
+	if keys == nil {
+		if err := router.SendTo(fingerprint, MessagePublicKeyRequest, nil); err != nil {
+			log.Debug("error requesting public key of %s: %v", fingerprint, err)
+		}
+	}
+	return keys
+}
+
+// returns true if the peer signed a message with the key of its identity in the current session
+func (peer *Peer) Authenticated() bool {
+	peer.Lock()
+	defer peer.Unlock()
+	return peer.authenticated
+}
+
+// returns true if the peer is authenticated, if not its public key is requested since the signed
+// response authenticates it
+func (router *Router) authenticate(ident string, peer *Peer) bool {
+	peer.Lock()
+	authenticated := peer.authenticated
+	requested := !authenticated && time.Since(peer.authRequestedAt) < authRequestPeriod
+	if !authenticated && !requested {
+		peer.authRequestedAt = time.Now()
+	}
+	peer.Unlock()
+
+	if !authenticated && !requested {
+		router.spawn(func() {
+			if err := router.SendTo(ident, MessagePublicKeyRequest, nil); err != nil {
+				log.Debug("error requesting public key of %s: %v", ident, err)
+			}
+		})
+	}
+	return authenticated
+}
+
+// marks the peer as authenticated, if it was muted waiting for it the new peer event is triggered
+func (router *Router) authenticated(ident string, peer *Peer) {
+	peer.Lock()
+	was := peer.authenticated
+	peer.authenticated = true
+	peer.Unlock()
+
+	if !was && router.policy.Check(ident, peer.SessionIDStr, true) != PolicyMute {
+		router.announce(ident, peer)
+	}
+}
+
+func (router *Router) onPublicKeyRequest(ident string, peer *Peer, msg *Message) {
+	if err := router.SendTo(ident, MessagePublicKey, publicKeyMessage{
+		PEM: string(router.local.Keys.PublicPEM),
+	}); err != nil {
+		log.Debug("error sending public key to %s: %v", ident, err)
+	}
+}
+
+func (router *Router) onPublicKey(ident string, peer *Peer, msg *Message) {
+	var pub publicKeyMessage
+	if err := json.Unmarshal(msg.Body, &pub); err != nil {
+		log.Debug("error decoding public key message: %v", err)
+		return
+	}
+
+	keys, err := crypto.FromPublicPEM(pub.PEM)
+	if err != nil {
+		log.Debug("error parsing public key: %v", err)
+		return
+	}
+
+	if keys.FingerprintHex != ident {
+		log.Warning("peer %s sent a public key with fingerprint %s", ident, keys.FingerprintHex)
+		return
+	}
+
+	peer.Lock()
+	peer.Keys = keys
+	peer.Unlock()
+
+	log.Debug("got public key of %s", ident)
+}
+
+// checks the signature of a message, returns true if it has been verified with the key of the peer:
+// once the key is known every message must be signed with it, whatever the peer advertises
+func (router *Router) verify(ident string, peer *Peer, from, to net.HardwareAddr, payload []byte, signature []byte) (bool, error) {
+	peer.Lock()
+	keys := peer.Keys
+	peer.Unlock()
+
+	if keys == nil {
+		// the public key of the peer is not known yet
+		return false, nil
+	} else if signature == nil {
+		return false, fmt.Errorf("message is not signed")
+	} else if err := keys.VerifyMessage(signedBytes(from, to, payload), signature); err != nil {
+		return false, fmt.Errorf("invalid signature: %v", err)
+	}
+	return true, nil
+}
+
+func (router *Router) onMessage(pkt gopacket.Packet, radio *layers.RadioTap, dot11 *layers.Dot11) {
+	ident, peer := router.peerBySession(dot11.Address3)
+	if peer == nil {
+		// only private keys, they make units in privacy mode resolvable
+		router.onPrivateFrame(pkt, radio, dot11)
+		return
+	} else if router.policy.Check(ident, peer.SessionIDStr, peer.Authenticated()) == PolicyDeny {
+		return
+	}
+
+	err, payload := wifi.Unpack(pkt, radio, dot11)
+	if err != nil {
+		log.Debug("%v", err)
+		return
+	}
+
+	signature := wifi.Signature(pkt)
+	if found, streamID, seqNum, seqTot := wifi.Stream(pkt); found {
+		if payload, signature = router.fragments.add(ident, streamID, seqNum, seqTot, payload, signature); payload == nil {
+			return
+		}
+	}
+
+	verified, err := router.verify(ident, peer, dot11.Address3, dot11.Address1, payload, signature)
+	if err != nil {
+		log.Warning("dropping message from %s: %v", ident, err)
+		return
+	}
+
+	var msg Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Debug("error decoding message from %s: %v", ident, err)
+		return
+	}
+
+	router.handlers.Lock()
+	handler, found := router.handlers.handlers[msg.Type]
+	signed := router.handlers.signed[msg.Type]
+	router.handlers.Unlock()
+
+	if !found {
+		log.Debug("unhandled %s message from %s", msg.Type, ident)
+		return
+	}
+
+	if verified {
+		router.authenticated(ident, peer)
+	} else if msg.Type == MessagePublicKey {
+		// the key we're about to receive can verify the message carrying it
+		handler(ident, peer, &msg)
+		if verified, _ = router.verify(ident, peer, dot11.Address3, dot11.Address1, payload, signature); verified {
+			router.authenticated(ident, peer)
+		}
+		return
+	} else if signed {
+		log.Debug("dropping %s message from %s, public key unknown", msg.Type, ident)
+		// the next one will be verified
+		router.spawn(func() {
+			router.PublicKeyOf(ident)
+		})
+		return
+	}
+
+	handler(ident, peer, &msg)
+}
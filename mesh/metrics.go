@@ -0,0 +1,45 @@
+package mesh
+
+import (
+	"github.com/evilsocket/pwngrid/metrics"
+)
+
+var (
+	framesCaptured = metrics.NewCounter("pwngrid_mesh_frames_captured_total", "Frames captured on the mesh interfaces.", "iface")
+	framesInjected = metrics.NewCounter("pwngrid_mesh_frames_injected_total", "Frames injected on the mesh interfaces.", "iface")
+	writeFailures  = metrics.NewCounter("pwngrid_mesh_write_failures_total", "Frames that could not be injected.", "iface")
+	pcapReceived   = metrics.NewGauge("pwngrid_mesh_pcap_received", "Packets received by the pcap handle since it's been opened.", "iface", "handle")
+	pcapDropped    = metrics.NewGauge("pwngrid_mesh_pcap_dropped", "Packets dropped by the pcap handle since it's been opened.", "iface", "handle")
+	pcapIfDropped  = metrics.NewGauge("pwngrid_mesh_pcap_if_dropped", "Packets dropped by the interface since the pcap handle has been opened.", "iface", "handle")
+	queueDepth     = metrics.NewGauge("pwngrid_mesh_queue_depth", "Captured packets waiting to be processed.", "iface", "handle")
+	advParsed      = metrics.NewCounter("pwngrid_mesh_advertisements_total", "Peer advertisements parsed successfully.")
+	advRejected    = metrics.NewCounter("pwngrid_mesh_advertisements_rejected_total", "Peer advertisements rejected.", "reason")
+	peersPresent   = metrics.NewGauge("pwngrid_mesh_peers", "Peers currently in range.")
+	memorySize     = metrics.NewGauge("pwngrid_mesh_memory_peers", "Peers in the persistent memory.")
+)
+
+func (mux *PacketMuxer) collectMetrics(handle string) {
+	queueDepth.Set(float64(mux.Pending()), mux.iface, handle)
+	if stats, err := mux.Stats(); err == nil {
+		pcapReceived.Set(float64(stats.PacketsReceived), mux.iface, handle)
+		pcapDropped.Set(float64(stats.PacketsDropped), mux.iface, handle)
+		pcapIfDropped.Set(float64(stats.PacketsIfDropped), mux.iface, handle)
+	}
+}
+
+// updates the gauges right before the metrics are exported
+func (router *Router) collectMetrics() {
+	peersPresent.Set(float64(router.peers.Size()))
+	memorySize.Set(float64(router.memory.Size()))
+
+	for _, mux := range router.muxes {
+		mux.collectMetrics("capture")
+	}
+
+	router.local.Lock()
+	muxes := router.local.muxes
+	router.local.Unlock()
+	for _, mux := range muxes {
+		mux.collectMetrics("advertiser")
+	}
+}
@@ -0,0 +1,243 @@
+package mesh
+
+import (
+	"fmt"
+	"github.com/evilsocket/islazy/log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// advertisement field with the digest of the peers seen by a unit
+const NeighboursField = "nbrs"
+
+var (
+	// if true the digest of the peers in range is advertised
+	NeighboursAdvertise = false
+	// maximum number of peers in the digest, the strongest ones are picked
+	NeighboursMax = 16
+	// peers not seen for longer than this number of seconds are left out of the digest
+	NeighboursMaxAge = 120
+	// period in seconds the digest is updated with
+	NeighboursPeriod = 10
+	// RSSI thresholds of the buckets, a peer louder than the first one is in bucket 0
+	NeighboursBuckets = []int{-50, -65, -80}
+)
+
+// number of hex characters of the truncated fingerprints
+const neighbourIDSize = 8
+
+// NeighbourLink is a peer in range that can hear a neighbour.
+type NeighbourLink struct {
+	Fingerprint string `json:"fingerprint"`
+	Name        string `json:"name,omitempty"`
+	Bucket      int    `json:"bucket"`
+}
+
+// Neighbour is a unit heard directly or by one of the peers in range.
+type Neighbour struct {
+	// truncated fingerprint
+	ID string `json:"id"`
+	// resolved if the unit is in range or has been met before
+	Fingerprint string           `json:"fingerprint,omitempty"`
+	Name        string           `json:"name,omitempty"`
+	Direct      bool             `json:"direct"`
+	Via         []*NeighbourLink `json:"via"`
+}
+
+// Neighbourhood is the two hops view of the mesh around the unit.
+type Neighbourhood struct {
+	Direct int `json:"direct"`
+	// units only heard by the peers in range
+	Indirect int `json:"indirect"`
+	// units estimated to be around, including the ones out of our range
+	Estimate   int          `json:"estimate"`
+	Buckets    []int        `json:"buckets"`
+	Neighbours []*Neighbour `json:"neighbours"`
+}
+
+func neighbourID(fingerprint string) string {
+	if len(fingerprint) < neighbourIDSize {
+		return ""
+	}
+	return strings.ToLower(fingerprint[:neighbourIDSize])
+}
+
+func rssiBucket(rssi int) int {
+	for bucket, threshold := range NeighboursBuckets {
+		if rssi >= threshold {
+			return bucket
+		}
+	}
+	return len(NeighboursBuckets)
+}
+
+// parses a digest of comma separated truncated fingerprints, each followed by its bucket
+func parseNeighbours(digest string) map[string]int {
+	parsed := make(map[string]int)
+	for _, entry := range strings.Split(digest, ",") {
+		if len(entry) != neighbourIDSize+1 {
+			continue
+		}
+		bucket := int(entry[neighbourIDSize] - '0')
+		if bucket < 0 || bucket > 9 {
+			continue
+		}
+		parsed[entry[:neighbourIDSize]] = bucket
+	}
+	return parsed
+}
+
+// returns the digest of the peers recently seen, or nil if there's nothing to advertise
+func (router *Router) neighboursDigest(now time.Time) interface{} {
+	type seen struct {
+		id   string
+		rssi int
+	}
+
+	list := make([]seen, 0)
+	maxAge := time.Duration(NeighboursMaxAge) * time.Second
+	router.peers.Range(func(ident string, peer *Peer) bool {
+		peer.Lock()
+		defer peer.Unlock()
+
+		// units in privacy mode don't want to be linked to their identity
+		if _, blinded := peer.AdvData.Load("blinded"); blinded {
+			return true
+		} else if id := neighbourID(ident); id != "" && now.Sub(peer.SeenAt) <= maxAge {
+			rssi := peer.RSSI
+			if peer.signal != nil {
+				rssi = int(peer.signal.status(now, peer.txPower(), false).Kalman)
+			}
+			list = append(list, seen{id: id, rssi: rssi})
+		}
+		return true
+	})
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].rssi > list[j].rssi
+	})
+	if len(list) > NeighboursMax {
+		list = list[:NeighboursMax]
+	}
+
+	entries := make([]string, 0, len(list))
+	for _, s := range list {
+		entries = append(entries, fmt.Sprintf("%s%d", s.id, rssiBucket(s.rssi)))
+	}
+	return strings.Join(entries, ",")
+}
+
+// the digest would link the identities of our contacts to our session, that's what privacy mode
+// and private advertisements are meant to prevent
+func neighboursAdvertised() bool {
+	return NeighboursAdvertise && !PrivacyMode && !PrivateAdvertisements
+}
+
+func (router *Router) neighboursWorker() {
+	period := time.Duration(NeighboursPeriod) * time.Second
+	log.Debug("neighbours worker started with a %s period", period)
+
+	for now := range router.ticker(period) {
+		var digest interface{}
+		if neighboursAdvertised() {
+			digest = router.neighboursDigest(now)
+		}
+		router.local.setData(map[string]interface{}{
+			NeighboursField: digest,
+		})
+	}
+}
+
+// returns the units in range and the ones the peers in range can hear
+func (router *Router) Neighbourhood() *Neighbourhood {
+	view := &Neighbourhood{
+		Buckets:    NeighboursBuckets,
+		Neighbours: make([]*Neighbour, 0),
+	}
+
+	self := neighbourID(router.local.Keys.FingerprintHex)
+	byID := make(map[string]*Neighbour)
+	get := func(id string) *Neighbour {
+		neighbour, found := byID[id]
+		if !found {
+			neighbour = &Neighbour{
+				ID:  id,
+				Via: make([]*NeighbourLink, 0),
+			}
+			byID[id] = neighbour
+			view.Neighbours = append(view.Neighbours, neighbour)
+		}
+		return neighbour
+	}
+
+	router.peers.Range(func(ident string, peer *Peer) bool {
+		peer.Lock()
+		name, _ := peer.AdvData.Load("name")
+		digest, _ := peer.AdvData.Load(NeighboursField)
+		peer.Unlock()
+
+		nameStr, _ := name.(string)
+		direct := get(neighbourID(ident))
+		direct.Fingerprint = ident
+		direct.Name = nameStr
+		direct.Direct = true
+
+		if digestStr, ok := digest.(string); ok {
+			for id, bucket := range parseNeighbours(digestStr) {
+				if id != self {
+					neighbour := get(id)
+					neighbour.Via = append(neighbour.Via, &NeighbourLink{
+						Fingerprint: ident,
+						Name:        nameStr,
+						Bucket:      bucket,
+					})
+				}
+			}
+		}
+		return true
+	})
+
+	// units out of range might have been met before
+	for _, peer := range router.memory.List() {
+		peer.Lock()
+		ident, _ := peer.AdvData.Load("identity")
+		name, _ := peer.AdvData.Load("name")
+		peer.Unlock()
+
+		if identStr, ok := ident.(string); ok {
+			if neighbour, found := byID[neighbourID(identStr)]; found && neighbour.Fingerprint == "" {
+				neighbour.Fingerprint = identStr
+				neighbour.Name, _ = name.(string)
+			}
+		}
+	}
+
+	for _, neighbour := range view.Neighbours {
+		if neighbour.Direct {
+			view.Direct++
+		} else {
+			view.Indirect++
+		}
+		sort.Slice(neighbour.Via, func(i, j int) bool {
+			return neighbour.Via[i].Bucket < neighbour.Via[j].Bucket
+		})
+	}
+	view.Estimate = view.Direct + view.Indirect
+
+	sort.Slice(view.Neighbours, func(i, j int) bool {
+		a, b := view.Neighbours[i], view.Neighbours[j]
+		if a.Direct != b.Direct {
+			return a.Direct
+		} else if len(a.Via) != len(b.Via) {
+			return len(a.Via) > len(b.Via)
+		}
+		return a.ID < b.ID
+	})
+
+	return view
+}
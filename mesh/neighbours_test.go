@@ -0,0 +1,71 @@
+package mesh
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNeighboursAdvertised(t *testing.T) {
+	defer func(advertise, privacy, private bool) {
+		NeighboursAdvertise, PrivacyMode, PrivateAdvertisements = advertise, privacy, private
+	}(NeighboursAdvertise, PrivacyMode, PrivateAdvertisements)
+
+	tests := []struct {
+		name       string
+		advertise  bool
+		privacy    bool
+		private    bool
+		advertised bool
+	}{
+		{"disabled", false, false, false, false},
+		{"enabled", true, false, false, true},
+		{"privacy mode", true, true, false, false},
+		{"private advertisements", true, false, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			NeighboursAdvertise, PrivacyMode, PrivateAdvertisements = test.advertise, test.privacy, test.private
+			if advertised := neighboursAdvertised(); advertised != test.advertised {
+				t.Fatalf("expected %v, got %v", test.advertised, advertised)
+			}
+		})
+	}
+}
+
+func TestNeighboursDigest(t *testing.T) {
+	now := time.Now()
+	router := &Router{peers: NewRegistry()}
+
+	add := func(fingerprint string, rssi int, seenAgo time.Duration, blinded bool) {
+		peer := &Peer{RSSI: rssi, SeenAt: now.Add(-seenAgo)}
+		if blinded {
+			peer.AdvData.Store("blinded", "00")
+		}
+		router.peers.Store(fingerprint, peer)
+	}
+
+	add(strings.Repeat("a", 64), -40, time.Second, false)
+	add(strings.Repeat("b", 64), -70, time.Second, false)
+	// units in privacy mode and the ones not seen for a while are left out
+	add(strings.Repeat("c", 64), -40, time.Second, true)
+	add(strings.Repeat("d", 64), -40, time.Duration(NeighboursMaxAge+1)*time.Second, false)
+
+	digest, ok := router.neighboursDigest(now).(string)
+	if !ok {
+		t.Fatalf("expected a digest")
+	} else if digest != "aaaaaaaa0,bbbbbbbb2" {
+		t.Fatalf("unexpected digest %s", digest)
+	}
+
+	expected := map[string]int{"aaaaaaaa": 0, "bbbbbbbb": 2}
+	if parsed := parseNeighbours(digest + ",short,cccccccc?"); !reflect.DeepEqual(parsed, expected) {
+		t.Fatalf("expected %v, got %v", expected, parsed)
+	}
+
+	if digest := (&Router{peers: NewRegistry()}).neighboursDigest(now); digest != nil {
+		t.Fatalf("expected no digest, got %v", digest)
+	}
+}
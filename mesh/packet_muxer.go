@@ -1,12 +1,16 @@
 package mesh
 
 import (
+	"context"
 	"fmt"
 	"github.com/evilsocket/islazy/async"
 	"github.com/evilsocket/islazy/log"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,47 +23,92 @@ const (
 var (
 	SnapLength  = 65536
 	ReadTimeout = 100
+	// period in milliseconds to check if the interface is still there
+	LinkCheckPeriod = 1000
+	// minimum and maximum time in seconds to wait before trying to open the interface again
+	ReconnectMinDelay = 1
+	ReconnectMaxDelay = 60
+
+	ErrLinkDown = fmt.Errorf("link is down")
 )
 
 type PacketCallback func(pkt gopacket.Packet)
 
+// MuxerStatus is the state of the link of a PacketMuxer.
+type MuxerStatus struct {
+	Interface  string    `json:"interface"`
+	Up         bool      `json:"up"`
+	Since      time.Time `json:"since"`
+	Error      string    `json:"error,omitempty"`
+	Reconnects uint64    `json:"reconnects"`
+	Packets    uint64    `json:"packets"`
+	LastPacket time.Time `json:"last_packet"`
+}
+
+// PacketMuxer owns the capture handle of an interface, if the link goes away (the interface is
+// removed, recreated or brought down) the handle is closed and opened again with a backoff.
 type PacketMuxer struct {
+	sync.RWMutex
 	iface   string
 	filter  string
 	handle  *pcap.Handle
-	source  *gopacket.PacketSource
+	index   int
 	channel chan gopacket.Packet
 	queue   *async.WorkQueue
-	stop    chan struct{}
+	status  MuxerStatus
+	pending int64
+	done    chan struct{}
 
 	onPacket PacketCallback
 }
 
-func dummyPacketCallback(pkt gopacket.Packet) {
+func NewPacketMuxer(iface, filter string, workers int) (mux *PacketMuxer, err error) {
+	mux = &PacketMuxer{
+		iface:  iface,
+		filter: filter,
+		done:   make(chan struct{}),
+		status: MuxerStatus{
+			Interface: iface,
+			Since:     time.Now(),
+			Error:     ErrLinkDown.Error(),
+		},
+	}
+
+	mux.queue = async.NewQueue(workers, func(arg async.Job) {
+		mux.onPacket(arg.(gopacket.Packet))
+		atomic.AddInt64(&mux.pending, -1)
+	})
 
+	return mux, nil
 }
 
-func NewPacketMuxer(iface, filter string, workers int) (mux *PacketMuxer, err error) {
-	mux = &PacketMuxer{
-		iface:    iface,
-		filter:   filter,
-		stop:     make(chan struct{}),
-		onPacket: dummyPacketCallback,
+// returns an error if the interface doesn't exist or it's down, its index otherwise
+func linkIndex(iface string) (int, error) {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return 0, err
+	} else if link.Flags&net.FlagUp == 0 {
+		return link.Index, fmt.Errorf(ErrIfaceNotUp)
 	}
+	return link.Index, nil
+}
+
+func (mux *PacketMuxer) open() (err error) {
+	var handle *pcap.Handle
 
 	for retry := 0; ; retry++ {
-		inactiveHandle, err := pcap.NewInactiveHandle(iface)
+		inactiveHandle, err := pcap.NewInactiveHandle(mux.iface)
 		if err != nil {
-			return nil, fmt.Errorf("error while opening interface %s: %s", iface, err)
+			return fmt.Errorf("error while opening interface %s: %s", mux.iface, err)
 		}
 		defer inactiveHandle.CleanUp()
 
 		if err = inactiveHandle.SetRFMon(true); err != nil {
-			log.Warning("error while setting interface %s in monitor mode: %s", iface, err)
+			log.Warning("error while setting interface %s in monitor mode: %s", mux.iface, err)
 		}
 
 		if err = inactiveHandle.SetSnapLen(SnapLength); err != nil {
-			return nil, fmt.Errorf("error while settng span len: %s", err)
+			return fmt.Errorf("error while settng span len: %s", err)
 		}
 		/*
 		 * We don't want to pcap.BlockForever otherwise pcap_close(handle)
@@ -67,42 +116,116 @@ func NewPacketMuxer(iface, filter string, workers int) (mux *PacketMuxer, err er
 		 */
 		readTimeout := time.Duration(ReadTimeout) * time.Millisecond
 		if err = inactiveHandle.SetTimeout(readTimeout); err != nil {
-			return nil, fmt.Errorf("error while setting timeout: %s", err)
-		} else if mux.handle, err = inactiveHandle.Activate(); err != nil {
+			return fmt.Errorf("error while setting timeout: %s", err)
+		} else if handle, err = inactiveHandle.Activate(); err != nil {
 			if retry == 0 && err.Error() == ErrIfaceNotUp {
-				log.Info("interface %s is down, bringing it up ...", iface)
-				if err := ActivateInterface(iface); err != nil {
-					return nil, err
+				log.Info("interface %s is down, bringing it up ...", mux.iface)
+				if err := ActivateInterface(mux.iface); err != nil {
+					return err
 				}
 				continue
 			}
-			return nil, fmt.Errorf("error while activating handle: %s", err)
+			return fmt.Errorf("error while activating handle: %s", err)
 		}
 
-		if filter != "" {
-			if err := mux.handle.SetBPFFilter(filter); err != nil {
-				return nil, fmt.Errorf("error setting BPF filter '%s': %v", filter, err)
+		if mux.filter != "" {
+			if err := handle.SetBPFFilter(mux.filter); err != nil {
+				handle.Close()
+				return fmt.Errorf("error setting BPF filter '%s': %v", mux.filter, err)
 			}
 		}
 
 		break
 	}
 
-	mux.source = gopacket.NewPacketSource(mux.handle, mux.handle.LinkType())
-	mux.channel = mux.source.Packets()
-	mux.queue = async.NewQueue(workers, func(arg async.Job) {
-		mux.onPacket(arg.(gopacket.Packet))
-	})
+	index, _ := linkIndex(mux.iface)
 
-	return mux, nil
+	mux.Lock()
+	defer mux.Unlock()
+
+	mux.handle = handle
+	mux.index = index
+	mux.channel = nil
+	// write only muxers don't need to read anything
+	if mux.onPacket != nil {
+		mux.channel = gopacket.NewPacketSource(handle, handle.LinkType()).Packets()
+	}
+	mux.status.Up = true
+	mux.status.Since = time.Now()
+	mux.status.Error = ""
+
+	return nil
+}
+
+func (mux *PacketMuxer) close(reason error) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if mux.handle != nil {
+		mux.handle.Close()
+		mux.handle = nil
+	}
+
+	if mux.status.Up {
+		mux.status.Up = false
+		mux.status.Since = time.Now()
+	}
+	if reason != nil {
+		mux.status.Error = reason.Error()
+	}
 }
 
+// sets the packet callback, must be called before Start for the muxer to capture packets
 func (mux *PacketMuxer) OnPacket(cb PacketCallback) {
+	mux.Lock()
+	defer mux.Unlock()
 	mux.onPacket = cb
 }
 
-func (mux *PacketMuxer) Write(data []byte) error {
-	var err error
+func (mux *PacketMuxer) Status() MuxerStatus {
+	mux.RLock()
+	defer mux.RUnlock()
+	return mux.status
+}
+
+func (mux *PacketMuxer) Up() bool {
+	mux.RLock()
+	defer mux.RUnlock()
+	return mux.status.Up
+}
+
+// returns the number of captured packets waiting to be processed
+func (mux *PacketMuxer) Pending() int64 {
+	return atomic.LoadInt64(&mux.pending)
+}
+
+// returns the statistics of the capture handle, they are reset every time the interface is reopened
+func (mux *PacketMuxer) Stats() (*pcap.Stats, error) {
+	mux.RLock()
+	defer mux.RUnlock()
+
+	if mux.handle == nil {
+		return nil, ErrLinkDown
+	}
+	return mux.handle.Stats()
+}
+
+func (mux *PacketMuxer) Write(data []byte) (err error) {
+	mux.RLock()
+	defer mux.RUnlock()
+
+	if mux.handle == nil {
+		return ErrLinkDown
+	}
+
+	defer func() {
+		if err != nil {
+			writeFailures.Inc(mux.iface)
+		} else {
+			framesInjected.Inc(mux.iface)
+		}
+	}()
+
 	for attempt := 0; attempt < 5; attempt++ {
 		if err = mux.handle.WritePacketData(data); err == nil {
 			return nil
@@ -116,29 +239,103 @@ func (mux *PacketMuxer) Write(data []byte) error {
 				time.Sleep(200 * time.Millisecond)
 			}
 		} else {
-			return nil
+			return err
 		}
 	}
 	return err
 }
 
-func (mux *PacketMuxer) Start() {
-	go func() {
-		log.Debug("packet muxer started (iface:%s filter:%s)", mux.iface, mux.filter)
-		for {
-			select {
-			case packet := <-mux.channel:
-				mux.queue.Add(async.Job(packet))
-			case <-mux.stop:
+// reads packets until the context is done or the link is lost
+func (mux *PacketMuxer) read(ctx context.Context) error {
+	mux.RLock()
+	channel := mux.channel
+	index := mux.index
+	mux.RUnlock()
+
+	check := time.NewTicker(time.Duration(LinkCheckPeriod) * time.Millisecond)
+	defer check.Stop()
+
+	for {
+		select {
+		case packet, ok := <-channel:
+			if !ok {
+				return fmt.Errorf("capture stopped")
+			}
+			mux.Lock()
+			mux.status.Packets++
+			mux.status.LastPacket = time.Now()
+			mux.Unlock()
+			framesCaptured.Inc(mux.iface)
+			atomic.AddInt64(&mux.pending, 1)
+			mux.queue.Add(async.Job(packet))
+
+		case <-check.C:
+			// a recreated interface has the same name but a different index
+			if current, err := linkIndex(mux.iface); err != nil {
+				return err
+			} else if current != index {
+				return fmt.Errorf("interface %s has been recreated", mux.iface)
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (mux *PacketMuxer) run(ctx context.Context) {
+	defer close(mux.done)
+
+	minDelay := time.Duration(ReconnectMinDelay) * time.Second
+	maxDelay := time.Duration(ReconnectMaxDelay) * time.Second
+	delay := minDelay
+	failed := false
+
+	for {
+		if err := mux.open(); err != nil {
+			mux.close(err)
+			log.Warning("%v, retrying in %s", err, delay)
+		} else {
+			if failed {
+				mux.Lock()
+				mux.status.Reconnects++
+				mux.Unlock()
+				log.Info("interface %s is back", mux.iface)
+			}
+			log.Debug("packet muxer started (iface:%s filter:%s)", mux.iface, mux.filter)
+
+			err = mux.read(ctx)
+			mux.close(err)
+			if ctx.Err() != nil {
 				return
 			}
+
+			log.Warning("lost link on %s: %v", mux.iface, err)
+			delay = minDelay
 		}
-	}()
+
+		failed = true
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			mux.close(nil)
+			return
+		}
+
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// opens the interface and starts capturing, retrying with a backoff until the context is done
+func (mux *PacketMuxer) Start(ctx context.Context) {
+	go mux.run(ctx)
 }
 
-func (mux *PacketMuxer) Stop() {
-	log.Debug("stopping packet muxer ...")
-	mux.stop <- struct{}{}
+// waits for the muxer to be stopped by its context and for the pending packets to be processed
+func (mux *PacketMuxer) Wait() {
+	<-mux.done
 	mux.queue.WaitDone()
-	log.Debug("packet muxer stopped")
+	log.Debug("packet muxer stopped (iface:%s)", mux.iface)
 }
@@ -2,6 +2,7 @@ package mesh
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
@@ -15,17 +16,48 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	SignalingPeriod = 300
+	// period in seconds after which the session id is changed, 0 to keep it for the whole process lifetime
+	SessionRotation = 0
+	// if true, identity and name are not advertised and only contacts can resolve a blinded identifier
+	PrivacyMode = false
 
 	fingValidator = regexp.MustCompile("^[a-fA-F0-9]{64}$")
 )
 
 type SessionID []byte
 
+func newSessionID() SessionID {
+	id := make(SessionID, 6)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	// locally administered unicast address
+	id[0] = (id[0] | 0x02) & 0xfe
+	return id
+}
+
+func (id SessionID) String() string {
+	parts := make([]string, len(id))
+	for idx, byte := range id {
+		parts[idx] = fmt.Sprintf("%02x", byte)
+	}
+	return strings.Join(parts, ":")
+}
+
+// Sighting is the last frame received from a peer on a given interface.
+type Sighting struct {
+	Interface string    `json:"interface"`
+	Channel   int       `json:"channel"`
+	RSSI      int       `json:"rssi"`
+	SeenAt    time.Time `json:"seen_at"`
+}
+
 type Peer struct {
 	sync.Mutex
 
@@ -41,10 +73,41 @@ type Peer struct {
 	Keys         *crypto.KeyPair
 	AdvData      sync.Map
 	AdvPeriod    int
+	Sightings    map[string]*Sighting
 
 	advEnabled bool
-	mux        *PacketMuxer
-	stop       chan struct{}
+	advRound   int
+	advVersion uint64
+	advChanged map[string]bool
+	advSynced  bool
+	// owner and expiration of the fields set with SetFields
+	owned map[string]*fieldEntry
+	// local snapshots state
+	snapVersion uint64
+	snapAt      time.Time
+	snapForce   bool
+	// remote snapshots state
+	needSnapshot    bool
+	snapRequestedAt time.Time
+	// true once the peer signed a message with the key of its identity in the current session
+	authenticated   bool
+	authRequestedAt time.Time
+	// true once the new peer event has been triggered
+	announced bool
+
+	presence *presence
+	signal   *signal
+	onSignal func(enabled bool)
+	sealer   func(cleartext []byte) (string, error)
+	blinder  func(sessionID []byte) (string, error)
+	// fields received in the private section of the advertisement
+	private   map[string]bool
+	current   atomic.Value
+	rotatedAt time.Time
+	duty      *DutyCycle
+	muxes     []*PacketMuxer
+	cancel    context.CancelFunc
+	stopped   chan struct{}
 }
 
 func MakeLocalPeer(name string, keys *crypto.KeyPair) *Peer {
@@ -53,28 +116,35 @@ func MakeLocalPeer(name string, keys *crypto.KeyPair) *Peer {
 		DetectedAt: now,
 		SeenAt:     now,
 		PrevSeenAt: now,
-		SessionID:  make([]byte, 6),
+		SessionID:  newSessionID(),
 		Keys:       keys,
 		AdvData:    sync.Map{},
 		AdvPeriod:  SignalingPeriod,
-		stop:       make(chan struct{}),
+		Sightings:  make(map[string]*Sighting),
 		advEnabled: false,
+		advChanged: make(map[string]bool),
+		owned:      make(map[string]*fieldEntry),
+		onSignal:   func(bool) {},
+		duty:       NewDutyCycle(SignalingPeriod),
+		rotatedAt:  now,
 	}
 
-	if _, err := rand.Read(peer.SessionID); err != nil {
-		panic(err)
+	if err := peer.duty.SetQuietHours(AdvQuietHours); err != nil {
+		log.Warning("error parsing quiet hours: %v", err)
 	}
 
-	parts := make([]string, 6)
-	for idx, byte := range peer.SessionID {
-		parts[idx] = fmt.Sprintf("%02x", byte)
-	}
-	peer.SessionIDStr = strings.Join(parts, ":")
+	peer.SessionIDStr = peer.SessionID.String()
+	peer.current.Store(peer.SessionID)
 
 	peer.AdvData.Store("name", name)
 	peer.AdvData.Store("identity", keys.FingerprintHex)
 	peer.AdvData.Store("session_id", peer.SessionIDStr)
 	peer.AdvData.Store("grid_version", version.Version)
+	peer.AdvData.Store("proto", ProtocolVersion)
+	peer.AdvData.Store("caps", strings.Join(Capabilities, ","))
+	if TxPower != 0 {
+		peer.AdvData.Store("tx_power", TxPower)
+	}
 
 	peer.AdvData.Range(func(key, value interface{}) bool {
 		log.Debug("local.adv.%s = %s", key, value)
@@ -84,6 +154,23 @@ func MakeLocalPeer(name string, keys *crypto.KeyPair) *Peer {
 	return peer
 }
 
+// returns true if the given address is our current session id, doesn't lock as it's called for every packet
+func (peer *Peer) IsSession(addr []byte) bool {
+	current, _ := peer.current.Load().(SessionID)
+	return bytes.Equal(addr, current)
+}
+
+func (peer *Peer) rotateSessionID() {
+	prev := peer.SessionIDStr
+	peer.SessionID = newSessionID()
+	peer.SessionIDStr = peer.SessionID.String()
+	peer.current.Store(peer.SessionID)
+	peer.AdvData.Store("session_id", peer.SessionIDStr)
+	peer.rotatedAt = time.Now()
+
+	log.Debug("session id rotated: %s -> %s", prev, peer.SessionIDStr)
+}
+
 func (peer *Peer) Advertise(enabled bool) {
 	peer.Lock()
 	defer peer.Unlock()
@@ -95,10 +182,17 @@ func (peer *Peer) Advertise(enabled bool) {
 		} else {
 			log.Info("peer advertisement disabled")
 		}
+		peer.onSignal(enabled)
 	}
 }
 
-func NewPeer(radiotap *layers.RadioTap, dot11 *layers.Dot11, adv map[string]interface{}) (peer *Peer, err error) {
+func (peer *Peer) OnSignalingChange(cb func(enabled bool)) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.onSignal = cb
+}
+
+func NewPeer(iface string, radiotap *layers.RadioTap, dot11 *layers.Dot11, adv map[string]interface{}) (peer *Peer, err error) {
 	now := time.Now()
 	peer = &Peer{
 		DetectedAt: now,
@@ -106,15 +200,16 @@ func NewPeer(radiotap *layers.RadioTap, dot11 *layers.Dot11, adv map[string]inte
 		PrevSeenAt: now,
 		Channel:    wifi.Freq2Chan(int(radiotap.ChannelFrequency)),
 		RSSI:       int(radiotap.DBMAntennaSignal),
-		SessionID:  SessionID(dot11.Address3),
+		SessionID:  append(SessionID{}, dot11.Address3...),
 		AdvData:    sync.Map{},
+		Sightings:  make(map[string]*Sighting),
 	}
 
-	parts := make([]string, 6)
-	for idx, byte := range peer.SessionID {
-		parts[idx] = fmt.Sprintf("%02x", byte)
-	}
-	peer.SessionIDStr = strings.Join(parts, ":")
+	peer.sighted(iface, now)
+	peer.presence = newPresence(now, peer.RSSI)
+	peer.signal = newSignal(now, peer.RSSI)
+
+	peer.SessionIDStr = peer.SessionID.String()
 
 	// parse the fingerprint, the signature and the public key
 	fingerprint, found := adv["identity"].(string)
@@ -173,14 +268,21 @@ func NewPeer(radiotap *layers.RadioTap, dot11 *layers.Dot11, adv map[string]inte
 		}
 	*/
 
-	for key, value := range adv {
-		peer.AdvData.Store(key, value)
-	}
+	peer.applyAdvertisement(adv)
 
 	return peer, nil
 }
 
-func (peer *Peer) Update(radio *layers.RadioTap, dot11 *layers.Dot11, adv map[string]interface{}) (err error) {
+func (peer *Peer) sighted(iface string, at time.Time) {
+	peer.Sightings[iface] = &Sighting{
+		Interface: iface,
+		Channel:   peer.Channel,
+		RSSI:      peer.RSSI,
+		SeenAt:    at,
+	}
+}
+
+func (peer *Peer) Update(iface string, radio *layers.RadioTap, dot11 *layers.Dot11, adv map[string]interface{}) (err error) {
 	peer.Lock()
 	defer peer.Unlock()
 
@@ -225,22 +327,26 @@ func (peer *Peer) Update(radio *layers.RadioTap, dot11 *layers.Dot11, adv map[st
 		}
 	*/
 
+	now := time.Now()
 	peer.Channel = wifi.Freq2Chan(int(radio.ChannelFrequency))
 	peer.RSSI = int(radio.DBMAntennaSignal)
+	peer.SeenAt = now
+	peer.sighted(iface, now)
+	if peer.presence != nil {
+		peer.presence.frame(now, peer.RSSI)
+	}
+	if peer.signal != nil {
+		peer.signal.sample(now, peer.RSSI)
+	}
 
 	if !bytes.Equal(peer.SessionID, dot11.Address3) {
-		log.Info("peer %s changed session id: %x -> %x", peer.ID(), peer.SessionIDStr, dot11.Address3)
-		copy(peer.SessionID, dot11.Address3)
-		parts := make([]string, 6)
-		for idx, byte := range peer.SessionID {
-			parts[idx] = fmt.Sprintf("%02x", byte)
-		}
-		peer.SessionIDStr = strings.Join(parts, ":")
+		log.Debug("peer %s changed session id: %s -> %s", peer.ID(), peer.SessionIDStr, net.HardwareAddr(dot11.Address3))
+		peer.SessionID = append(SessionID{}, dot11.Address3...)
+		peer.SessionIDStr = peer.SessionID.String()
+		peer.authenticated = false
 	}
 
-	for key, value := range adv {
-		peer.AdvData.Store(key, value)
-	}
+	peer.applyAdvertisement(adv)
 
 	return nil
 }
@@ -258,16 +364,91 @@ func (peer *Peer) ID() string {
 	return fmt.Sprintf("%s@%s", name, ident)
 }
 
+// returns the number of seconds since the last frame of this peer
 func (peer *Peer) InactiveFor() float64 {
 	peer.Lock()
 	defer peer.Unlock()
-	return time.Since(peer.DetectedAt).Seconds()
+	return time.Since(peer.SeenAt).Seconds()
+}
+
+// evaluates the presence state of the peer, returns the previous and current states and whether it changed
+func (peer *Peer) updatePresence(now time.Time) (PresenceState, PresenceState, bool) {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.presence == nil {
+		return PresencePresent, PresencePresent, false
+	}
+
+	prev, changed := peer.presence.update(now)
+	return prev, peer.presence.state, changed
+}
+
+func (peer *Peer) Presence() *PresenceStatus {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.presence == nil {
+		return nil
+	}
+	return peer.presence.status(time.Now())
 }
 
-func (peer *Peer) SetData(adv map[string]interface{}) {
+// returns the RSSI at one meter advertised by the peer or the default one
+func (peer *Peer) txPower() int {
+	if v, found := peer.AdvData.Load("tx_power"); found {
+		if power, ok := v.(float64); ok && power < 0 && power > -100 {
+			return int(power)
+		}
+	}
+	return DefaultTxPower
+}
+
+func (peer *Peer) Signal() *SignalStatus {
 	peer.Lock()
 	defer peer.Unlock()
 
+	if peer.signal == nil {
+		return nil
+	}
+	return peer.signal.status(time.Now(), peer.txPower(), false)
+}
+
+// same as Signal, including the RSSI samples within the window
+func (peer *Peer) SignalHistory() *SignalStatus {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.signal == nil {
+		return nil
+	}
+	return peer.signal.status(time.Now(), peer.txPower(), true)
+}
+
+// validates and sets advertisement fields, a nil value removes the field
+func (peer *Peer) SetData(adv map[string]interface{}) error {
+	return peer.SetFields(OwnerDefault, 0, adv)
+}
+
+// sets advertisement fields without validation, used for the read only ones
+func (peer *Peer) setData(adv map[string]interface{}) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.apply(adv)
+}
+
+// to be called with the lock held
+func (peer *Peer) apply(adv map[string]interface{}) {
+	changed := false
+	for key, val := range adv {
+		if peer.changed(key, val) {
+			changed = true
+		}
+	}
+	if changed {
+		peer.advVersion++
+	}
+
 	for key, val := range adv {
 		if val == nil {
 			peer.AdvData.Delete(key)
@@ -280,6 +461,7 @@ func (peer *Peer) SetData(adv map[string]interface{}) {
 func (peer *Peer) Data() map[string]interface{} {
 	peer.Lock()
 	defer peer.Unlock()
+	peer.expire()
 	return peer.dataFrame()
 }
 
@@ -292,14 +474,60 @@ func (peer *Peer) dataFrame() map[string]interface{} {
 	return data
 }
 
+// returns the data to advertise, to be called with the lock held
+func (peer *Peer) advertisement() map[string]interface{} {
+	peer.expire()
+	data := peer.dataFrame()
+	if PrivacyMode || PrivateAdvertisements {
+		// only contacts knowing our fingerprint will be able to link this session id to us
+		if !PrivateAdvertisements {
+			delete(data, "identity")
+			delete(data, "name")
+			delete(data, "public_key")
+		}
+		if peer.blinder == nil {
+			log.Debug("blinded identity can't be computed yet, not sending it")
+		} else if blinded, err := peer.blinder(peer.SessionID); err != nil {
+			log.Error("could not blind identity: %v", err)
+		} else {
+			data["blinded"] = blinded
+		}
+	}
+
+	data["timestamp"] = time.Now().Unix()
+	return data
+}
+
+// returns how the advertisement fits the frame budget and which fields are left out of the next frame
+func (peer *Peer) Budget() *BudgetStatus {
+	peer.Lock()
+	defer peer.Unlock()
+	_, status := fitBudget(peer.advertisement(), advBudget(), peer.advRound)
+	return status
+}
+
 func (peer *Peer) advertise() {
 	peer.Lock()
 	defer peer.Unlock()
 
 	if peer.advEnabled {
-		data := peer.dataFrame()
+		if SessionRotation > 0 && time.Since(peer.rotatedAt) >= time.Duration(SessionRotation)*time.Second {
+			peer.rotateSessionID()
+		}
+
+		frame, meta := peer.deltaFrame(peer.advertisement())
+		data, budget := fitBudget(frame, advBudget(), peer.advRound)
+		peer.leftOut(meta, budget.Dropped)
+		if PrivateAdvertisements {
+			data = peer.seal(data)
+		}
+		peer.advRound++
+		if budget.Headroom < 0 {
+			log.Warning("advertisement is %d bytes, exceeding the %d bytes budget with required fields only", budget.Size, budget.Budget)
+		} else if len(budget.Dropped) > 0 {
+			log.Debug("advertisement fields left out of this frame: %v", budget.Dropped)
+		}
 
-		data["timestamp"] = time.Now().Unix()
 		adv, err := json.Marshal(data)
 		if err != nil {
 			log.Error("could not serialize advertisement data: %v", err)
@@ -337,40 +565,95 @@ func (peer *Peer) advertise() {
 			return
 		}
 
-		if err = peer.mux.Write(raw); err != nil {
-			log.Error("error sending %d bytes of advertisement frame: %v", len(raw), err)
+		for _, mux := range peer.muxes {
+			if !mux.Up() {
+				// the muxer is reconnecting
+				continue
+			} else if err = mux.Write(raw); err != nil {
+				log.Error("error sending %d bytes of advertisement frame on %s: %v", len(raw), mux.iface, err)
+			}
 		}
 	}
 }
 
-func (peer *Peer) StartAdvertising(iface string) (err error) {
-	if peer.mux == nil {
-		if peer.mux, err = NewPacketMuxer(iface, "", Workers); err != nil {
-			return
+// starts advertising on the given interfaces until the context is done or StopAdvertising is called,
+// interfaces that are not available yet are opened as soon as they show up.
+func (peer *Peer) StartAdvertising(ctx context.Context, ifaces []string) (err error) {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.cancel != nil {
+		return fmt.Errorf("advertiser already started")
+	}
+
+	ctx, peer.cancel = context.WithCancel(ctx)
+	peer.stopped = make(chan struct{})
+	peer.muxes = nil
+
+	for _, iface := range ifaces {
+		mux, err := NewPacketMuxer(iface, "", Workers)
+		if err != nil {
+			peer.cancel()
+			peer.cancel = nil
+			return err
 		}
+		mux.Start(ctx)
+		peer.muxes = append(peer.muxes, mux)
 	}
 
-	go func() {
-		period := time.Duration(peer.AdvPeriod) * time.Millisecond
-		ticker := time.NewTicker(period)
+	go func(stopped chan struct{}) {
+		defer close(stopped)
 
-		log.Debug("advertiser started with a %s period", period)
+		log.Debug("advertiser started with a %dms base period", peer.AdvPeriod)
 
 		for {
+			period, send := peer.duty.Next(time.Now())
 			select {
-			case _ = <-ticker.C:
-				peer.advertise()
-			case <-peer.stop:
+			case <-time.After(period):
+				if send {
+					peer.advertise()
+				}
+			case <-ctx.Done():
 				log.Info("advertiser stopped")
 				return
 			}
 		}
-	}()
+	}(peer.stopped)
 
 	return nil
 }
 
+func (peer *Peer) DutyCycle() *DutyCycle {
+	return peer.duty
+}
+
+// returns the link status of the interfaces used for advertising
+func (peer *Peer) Links() []MuxerStatus {
+	peer.Lock()
+	defer peer.Unlock()
+
+	links := make([]MuxerStatus, 0, len(peer.muxes))
+	for _, mux := range peer.muxes {
+		links = append(links, mux.Status())
+	}
+	return links
+}
+
+// stops the advertiser and waits for its interfaces to be closed, it's a no-op if not started
 func (peer *Peer) StopAdvertising() {
+	peer.Lock()
+	cancel, stopped, muxes := peer.cancel, peer.stopped, peer.muxes
+	peer.cancel = nil
+	peer.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
 	log.Debug("stopping advertiser ...")
-	peer.stop <- struct{}{}
+	cancel()
+	<-stopped
+	for _, mux := range muxes {
+		mux.Wait()
+	}
 }
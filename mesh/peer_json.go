@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"github.com/evilsocket/islazy/log"
 	"net"
+	"sort"
 	"sync"
 	"time"
 )
@@ -18,12 +19,20 @@ type jsonPeer struct {
 	Channel       int                    `json:"channel"`
 	RSSI          int                    `json:"rssi"`
 	SessionID     string                 `json:"session_id"`
+	Authenticated bool                   `json:"authenticated,omitempty"`
+	Sightings     []*Sighting            `json:"sightings,omitempty"`
+	Presence      *PresenceStatus        `json:"presence,omitempty"`
+	Signal        *SignalStatus          `json:"signal,omitempty"`
+	AdvVersion    uint64                 `json:"adv_version,omitempty"`
+	Protocol      *ProtocolStatus        `json:"protocol,omitempty"`
+	Private       map[string]interface{} `json:"private,omitempty"`
 	Advertisement map[string]interface{} `json:"advertisement"`
 }
 
 // creates a Peer object filled with the fields of the JSON representation
 func peerFromJSON(j jsonPeer) *Peer {
 	peer := &Peer{
+		MetAt:        j.MetAt,
 		DetectedAt:   j.DetectedAt,
 		SeenAt:       j.SeenAt,
 		PrevSeenAt:   j.PrevSeenAt,
@@ -32,6 +41,11 @@ func peerFromJSON(j jsonPeer) *Peer {
 		Channel:      j.Channel,
 		RSSI:         j.RSSI,
 		AdvData:      sync.Map{},
+		Sightings:    make(map[string]*Sighting),
+	}
+
+	for _, sighting := range j.Sightings {
+		peer.Sightings[sighting.Interface] = sighting
 	}
 
 	if hw, err := net.ParseMAC(j.SessionID); err == nil {
@@ -40,7 +54,12 @@ func peerFromJSON(j jsonPeer) *Peer {
 		log.Warning("error parsing peer session id %s: %v", j.SessionID, err)
 	}
 
-	for key, val := range j.Advertisement {
+	// memory files might contain data saved before the advertisement schema was enforced
+	adv, dropped := ValidateRemote(j.Advertisement)
+	if len(dropped) > 0 {
+		log.Debug("dropped invalid fields %v from stored advertisement of %s", dropped, j.Fingerprint)
+	}
+	for key, val := range adv {
 		peer.AdvData.Store(key, val)
 	}
 
@@ -64,8 +83,28 @@ func (peer *Peer) json() *jsonPeer {
 		Channel:       peer.Channel,
 		RSSI:          peer.RSSI,
 		SessionID:     peer.SessionIDStr,
+		Authenticated: peer.authenticated,
+		AdvVersion:    peer.advVersion,
+		Protocol:      peer.protocol(),
+		Private:       peer.privateData(),
+		Sightings:     make([]*Sighting, 0, len(peer.Sightings)),
 		Advertisement: make(map[string]interface{}),
 	}
+
+	if peer.presence != nil {
+		doc.Presence = peer.presence.status(time.Now())
+	}
+	if peer.signal != nil {
+		doc.Signal = peer.signal.status(time.Now(), peer.txPower(), false)
+	}
+
+	for _, sighting := range peer.Sightings {
+		copied := *sighting
+		doc.Sightings = append(doc.Sightings, &copied)
+	}
+	sort.Slice(doc.Sightings, func(i, j int) bool {
+		return doc.Sightings[i].Interface < doc.Sightings[j].Interface
+	})
 	peer.AdvData.Range(func(key, value interface{}) bool {
 		doc.Advertisement[key.(string)] = value
 		return true
@@ -0,0 +1,226 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/evilsocket/islazy/fs"
+	"github.com/evilsocket/islazy/log"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PolicyAction string
+
+const (
+	// the peer is discovered and tracked normally
+	PolicyAllow PolicyAction = "allow"
+	// advertisements from the peer are dropped
+	PolicyDeny PolicyAction = "deny"
+	// the peer is tracked, but it doesn't trigger any new/lost peer event
+	PolicyMute PolicyAction = "mute"
+)
+
+var AllowlistOnly = false
+
+type PolicyRule struct {
+	Fingerprint string       `json:"fingerprint,omitempty"`
+	SessionID   string       `json:"session_id,omitempty"`
+	Action      PolicyAction `json:"action"`
+	Reason      string       `json:"reason,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+func (rule *PolicyRule) Validate() error {
+	if rule.Fingerprint == "" && rule.SessionID == "" {
+		return fmt.Errorf("rule needs either a fingerprint or a session id")
+	} else if rule.Fingerprint != "" && rule.SessionID != "" {
+		return fmt.Errorf("rule can't have both a fingerprint and a session id")
+	} else if rule.Fingerprint != "" && !fingValidator.MatchString(rule.Fingerprint) {
+		return fmt.Errorf("invalid fingerprint %s", rule.Fingerprint)
+	} else if rule.SessionID != "" && rule.Action == PolicyAllow {
+		// anyone can advertise with any session id
+		return fmt.Errorf("allow rules need a fingerprint")
+	} else if rule.SessionID != "" {
+		if hw, err := net.ParseMAC(rule.SessionID); err != nil {
+			return fmt.Errorf("invalid session id %s: %v", rule.SessionID, err)
+		} else {
+			rule.SessionID = hw.String()
+		}
+	}
+
+	if rule.Action != PolicyAllow && rule.Action != PolicyDeny && rule.Action != PolicyMute {
+		return fmt.Errorf("invalid action '%s'", rule.Action)
+	}
+
+	rule.Fingerprint = strings.ToLower(rule.Fingerprint)
+	return nil
+}
+
+// the fingerprint or session id this rule applies to
+func (rule *PolicyRule) Target() string {
+	if rule.Fingerprint != "" {
+		return rule.Fingerprint
+	}
+	return rule.SessionID
+}
+
+type jsonPolicy struct {
+	AllowlistOnly bool                   `json:"allowlist_only"`
+	Rules         map[string]*PolicyRule `json:"rules"`
+}
+
+type Policy struct {
+	sync.Mutex
+	path          string
+	allowlistOnly bool
+	rules         map[string]*PolicyRule
+}
+
+func PolicyFromPath(path string) (err error, policy *Policy) {
+	if path, err = fs.Expand(path); err != nil {
+		return err, nil
+	}
+
+	policy = &Policy{
+		path:          path,
+		allowlistOnly: AllowlistOnly,
+		rules:         make(map[string]*PolicyRule),
+	}
+
+	if fs.Exists(path) {
+		log.Debug("loading %s ...", path)
+		var doc jsonPolicy
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error loading %s: %v", path, err), nil
+		} else if err = json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("error loading %s: %v", path, err), nil
+		}
+		// command line wins
+		policy.allowlistOnly = doc.AllowlistOnly || AllowlistOnly
+		for target, rule := range doc.Rules {
+			if rule == nil {
+				continue
+			} else if err := rule.Validate(); err != nil {
+				log.Warning("ignoring policy rule for %s: %v", target, err)
+				continue
+			}
+			policy.rules[rule.Target()] = rule
+		}
+	}
+
+	log.Debug("loaded %d policy rules (allowlist only:%v)", len(policy.rules), policy.allowlistOnly)
+
+	return
+}
+
+func (policy *Policy) json() *jsonPolicy {
+	doc := jsonPolicy{
+		AllowlistOnly: policy.allowlistOnly,
+		Rules:         make(map[string]*PolicyRule),
+	}
+	for target, rule := range policy.rules {
+		doc.Rules[target] = rule
+	}
+	return &doc
+}
+
+// the file is replaced atomically so a crash can't leave us with a partially written policy
+func (policy *Policy) save() error {
+	data, err := json.Marshal(policy.json())
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := policy.path + ".tmp"
+	if err = ioutil.WriteFile(tmpFileName, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, policy.path)
+}
+
+// returns the action to apply to the advertisements of a peer, allow rules only apply once the
+// peer proved it owns the fingerprint, until then it's muted instead of being denied
+func (policy *Policy) Check(fingerprint string, sessionID string, verified bool) PolicyAction {
+	policy.Lock()
+	defer policy.Unlock()
+
+	// fingerprint rules have precedence over session id ones
+	rule, pending := policy.rules[strings.ToLower(fingerprint)]
+	if pending && (rule.Action != PolicyAllow || verified) {
+		return rule.Action
+	} else if rule, found := policy.rules[strings.ToLower(sessionID)]; found {
+		return rule.Action
+	} else if policy.allowlistOnly && pending {
+		return PolicyMute
+	} else if policy.allowlistOnly {
+		return PolicyDeny
+	}
+	return PolicyAllow
+}
+
+// returns true if there's an allow rule for the given fingerprint
+func (policy *Policy) Allowed(fingerprint string) bool {
+	policy.Lock()
+	defer policy.Unlock()
+
+	rule, found := policy.rules[strings.ToLower(fingerprint)]
+	return found && rule.Action == PolicyAllow
+}
+
+func (policy *Policy) Set(rule PolicyRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+
+	policy.Lock()
+	defer policy.Unlock()
+
+	if rule.CreatedAt.IsZero() {
+		rule.CreatedAt = time.Now()
+	}
+	policy.rules[rule.Target()] = &rule
+
+	log.Info("policy %s %s", rule.Action, rule.Target())
+
+	return policy.save()
+}
+
+// removes the rule for the given fingerprint or session id, returns false if not found
+func (policy *Policy) Remove(target string) (bool, error) {
+	policy.Lock()
+	defer policy.Unlock()
+
+	target = strings.ToLower(target)
+	if _, found := policy.rules[target]; !found {
+		return false, nil
+	}
+
+	delete(policy.rules, target)
+
+	log.Info("policy for %s removed", target)
+
+	return true, policy.save()
+}
+
+func (policy *Policy) SetAllowlistOnly(enabled bool) error {
+	policy.Lock()
+	defer policy.Unlock()
+
+	if policy.allowlistOnly != enabled {
+		policy.allowlistOnly = enabled
+		log.Info("policy allowlist only mode: %v", enabled)
+		return policy.save()
+	}
+	return nil
+}
+
+func (policy *Policy) MarshalJSON() ([]byte, error) {
+	policy.Lock()
+	defer policy.Unlock()
+	return json.Marshal(policy.json())
+}
@@ -0,0 +1,182 @@
+package mesh
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestPolicyRuleValidate(t *testing.T) {
+	fingerprint := strings.Repeat("A", 64)
+
+	tests := []struct {
+		name   string
+		rule   PolicyRule
+		target string
+		valid  bool
+	}{
+		{"fingerprint", PolicyRule{Fingerprint: fingerprint, Action: PolicyAllow}, strings.ToLower(fingerprint), true},
+		{"session id", PolicyRule{SessionID: "AA-BB-CC-DD-EE-FF", Action: PolicyDeny}, "aa:bb:cc:dd:ee:ff", true},
+		{"no target", PolicyRule{Action: PolicyDeny}, "", false},
+		{"both targets", PolicyRule{Fingerprint: fingerprint, SessionID: "aa:bb:cc:dd:ee:ff", Action: PolicyDeny}, "", false},
+		{"short fingerprint", PolicyRule{Fingerprint: "abcd", Action: PolicyDeny}, "", false},
+		{"invalid session id", PolicyRule{SessionID: "nope", Action: PolicyDeny}, "", false},
+		{"allowed session id", PolicyRule{SessionID: "aa:bb:cc:dd:ee:ff", Action: PolicyAllow}, "", false},
+		{"invalid action", PolicyRule{Fingerprint: fingerprint, Action: "maybe"}, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.rule.Validate()
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if target := test.rule.Target(); target != test.target {
+				t.Fatalf("expected target %s, got %s", test.target, target)
+			}
+		})
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	allowed := strings.Repeat("a", 64)
+	denied := strings.Repeat("b", 64)
+	muted := strings.Repeat("c", 64)
+	unknown := strings.Repeat("d", 64)
+	deniedSession := "aa:bb:cc:dd:ee:ff"
+	otherSession := "11:22:33:44:55:66"
+
+	tests := []struct {
+		name          string
+		allowlistOnly bool
+		fingerprint   string
+		sessionID     string
+		verified      bool
+		expected      PolicyAction
+	}{
+		{"unknown peer", false, unknown, otherSession, false, PolicyAllow},
+		{"denied peer", false, denied, otherSession, true, PolicyDeny},
+		{"muted peer", false, muted, otherSession, false, PolicyMute},
+		{"denied session", false, unknown, deniedSession, false, PolicyDeny},
+		{"verified allowed peer", false, allowed, deniedSession, true, PolicyAllow},
+		{"unverified allowed peer", false, allowed, deniedSession, false, PolicyDeny},
+		{"upper case fingerprint", false, strings.ToUpper(denied), otherSession, false, PolicyDeny},
+		{"allowlist unknown peer", true, unknown, otherSession, false, PolicyDeny},
+		{"allowlist verified peer", true, allowed, otherSession, true, PolicyAllow},
+		{"allowlist unverified peer", true, allowed, otherSession, false, PolicyMute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "pwngrid-policy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			err, policy := PolicyFromPath(path.Join(dir, "policy.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rule := range []PolicyRule{
+				{Fingerprint: allowed, Action: PolicyAllow},
+				{Fingerprint: denied, Action: PolicyDeny},
+				{Fingerprint: muted, Action: PolicyMute},
+				{SessionID: deniedSession, Action: PolicyDeny},
+			} {
+				if err = policy.Set(rule); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = policy.SetAllowlistOnly(test.allowlistOnly); err != nil {
+				t.Fatal(err)
+			}
+
+			if action := policy.Check(test.fingerprint, test.sessionID, test.verified); action != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, action)
+			}
+		})
+	}
+}
+
+func TestPolicyEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pwngrid-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err, policy := PolicyFromPath(path.Join(dir, "policy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denied := strings.Repeat("b", 64)
+	unknown := strings.Repeat("d", 64)
+	deniedSession := "aa:bb:cc:dd:ee:ff"
+	otherSession := "11:22:33:44:55:66"
+	for _, rule := range []PolicyRule{
+		{Fingerprint: denied, Action: PolicyDeny},
+		{SessionID: deniedSession, Action: PolicyDeny},
+	} {
+		if err = policy.Set(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		fingerprint   string
+		peerSession   string
+		authenticated bool
+		evicted       bool
+	}{
+		{"denied fingerprint", denied, otherSession, false, true},
+		{"spoofed fingerprint", unknown, otherSession, true, false},
+		{"unauthenticated on the session", unknown, deniedSession, false, false},
+		{"authenticated on the session", unknown, deniedSession, true, true},
+	}
+
+	router := &Router{policy: policy}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peer := &Peer{SessionIDStr: test.peerSession, authenticated: test.authenticated}
+			if evicted := router.evictable(test.fingerprint, deniedSession, peer); evicted != test.evicted {
+				t.Fatalf("expected evicted to be %v, got %v", test.evicted, evicted)
+			}
+		})
+	}
+}
+
+func TestPolicyFromPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pwngrid-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fingerprint := strings.Repeat("A", 64)
+	fileName := path.Join(dir, "policy.json")
+	data := `{"allowlist_only":false,"rules":{` +
+		`"` + fingerprint + `":{"fingerprint":"` + fingerprint + `","action":"deny"},` +
+		`"nope":{"fingerprint":"nope","action":"deny"},` +
+		`"aa:bb:cc:dd:ee:ff":{"session_id":"aa:bb:cc:dd:ee:ff","action":"allow"},` +
+		`"empty":null}}`
+	if err = ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err, policy := PolicyFromPath(fileName)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(policy.rules) != 1 {
+		t.Fatalf("expected only the valid rule to be loaded, got %d", len(policy.rules))
+	} else if rule := policy.rules[strings.ToLower(fingerprint)]; rule == nil || rule.Fingerprint != strings.ToLower(fingerprint) {
+		t.Fatalf("expected the rule to be normalized, got %+v", rule)
+	}
+}
@@ -0,0 +1,193 @@
+package mesh
+
+import (
+	"time"
+)
+
+type PresenceState string
+
+const (
+	// frames are being received as expected
+	PresencePresent PresenceState = "present"
+	// some advertisements have been missed or the signal is weak and dropping
+	PresenceFading PresenceState = "fading"
+	// many advertisements have been missed, the peer is probably gone
+	PresenceAway PresenceState = "away"
+	// nothing received for PeerTTL seconds, the peer is removed
+	PresenceLost PresenceState = "lost"
+)
+
+var (
+	// number of missed advertisements after which a peer is fading
+	PresenceFadingAfter = 3
+	// number of missed advertisements after which a peer is away
+	PresenceAwayAfter = 10
+	// lower bound in seconds of silence before a peer can be fading
+	PresenceMinSilence = 5
+	// consecutive frames needed to go back to present
+	PresenceRecoverFrames = 2
+	// below this RSSI a dropping signal makes the peer fading
+	PresenceWeakRSSI = -85
+	// RSSI slope in dB/s below which the signal is considered dropping
+	PresenceRSSISlope = -2.0
+
+	presenceRanks = map[PresenceState]int{
+		PresencePresent: 0,
+		PresenceFading:  1,
+		PresenceAway:    2,
+		PresenceLost:    3,
+	}
+)
+
+const presenceSamples = 10
+
+type rssiSample struct {
+	at   time.Time
+	rssi int
+}
+
+type PresenceStatus struct {
+	State PresenceState `json:"state"`
+	Since time.Time     `json:"since"`
+	// estimated advertisement period of the peer in milliseconds
+	ExpectedPeriod int `json:"expected_period"`
+	// seconds since the last frame
+	Silence float64 `json:"silence"`
+	// RSSI slope in dB/s
+	RSSITrend float64 `json:"rssi_trend"`
+}
+
+// presence tracks the state of a peer from the timing and signal of its frames, going down
+// is immediate while going back to present needs PresenceRecoverFrames consecutive frames.
+type presence struct {
+	state     PresenceState
+	since     time.Time
+	lastFrame time.Time
+	interval  time.Duration
+	recovered int
+	samples   []rssiSample
+}
+
+func newPresence(at time.Time, rssi int) *presence {
+	return &presence{
+		state:     PresencePresent,
+		since:     at,
+		lastFrame: at,
+		samples:   []rssiSample{{at: at, rssi: rssi}},
+	}
+}
+
+func (p *presence) frame(at time.Time, rssi int) {
+	dt := at.Sub(p.lastFrame)
+	// frames are only consecutive if no advertisement has been missed in between
+	if dt > 2*p.expected() {
+		p.recovered = 0
+	}
+
+	// exponentially weighted moving average of the interval between frames
+	if dt > 0 {
+		if p.interval == 0 {
+			p.interval = dt
+		} else {
+			p.interval = (p.interval*4 + dt) / 5
+		}
+	}
+
+	p.lastFrame = at
+	p.recovered++
+	p.samples = append(p.samples, rssiSample{at: at, rssi: rssi})
+	if len(p.samples) > presenceSamples {
+		p.samples = p.samples[1:]
+	}
+}
+
+func (p *presence) expected() time.Duration {
+	if p.interval > 0 {
+		return p.interval
+	}
+	return time.Duration(SignalingPeriod) * time.Millisecond
+}
+
+// least squares slope of the recent RSSI samples, in dB/s
+func (p *presence) trend() float64 {
+	n := float64(len(p.samples))
+	if n < 3 {
+		return 0
+	}
+
+	origin := p.samples[0].at
+	sumX, sumY, sumXY, sumXX := 0.0, 0.0, 0.0, 0.0
+	for _, s := range p.samples {
+		x := s.at.Sub(origin).Seconds()
+		y := float64(s.rssi)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+
+	den := n*sumXX - sumX*sumX
+	if den == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / den
+}
+
+// the state the peer should be in at the given time, without hysteresis
+func (p *presence) target(now time.Time) PresenceState {
+	silence := now.Sub(p.lastFrame)
+	expected := p.expected()
+	minSilence := time.Duration(PresenceMinSilence) * time.Second
+
+	fadingAfter := expected * time.Duration(PresenceFadingAfter)
+	if fadingAfter < minSilence {
+		fadingAfter = minSilence
+	}
+	awayAfter := expected * time.Duration(PresenceAwayAfter)
+	if awayAfter < 2*fadingAfter {
+		awayAfter = 2 * fadingAfter
+	}
+
+	if silence > time.Duration(PeerTTL)*time.Second {
+		return PresenceLost
+	} else if silence > awayAfter {
+		return PresenceAway
+	} else if silence > fadingAfter {
+		return PresenceFading
+	}
+
+	last := p.samples[len(p.samples)-1]
+	if last.rssi < PresenceWeakRSSI && p.trend() < PresenceRSSISlope {
+		return PresenceFading
+	}
+	return PresencePresent
+}
+
+// updates the state, returns the previous one and whether it changed
+func (p *presence) update(now time.Time) (PresenceState, bool) {
+	prev := p.state
+	target := p.target(now)
+
+	if presenceRanks[target] > presenceRanks[prev] {
+		p.state = target
+		p.recovered = 0
+	} else if presenceRanks[target] < presenceRanks[prev] && p.recovered >= PresenceRecoverFrames {
+		p.state = target
+	}
+
+	if p.state != prev {
+		p.since = now
+		return prev, true
+	}
+	return prev, false
+}
+
+func (p *presence) status(now time.Time) *PresenceStatus {
+	return &PresenceStatus{
+		State:          p.state,
+		Since:          p.since,
+		ExpectedPeriod: int(p.expected() / time.Millisecond),
+		Silence:        now.Sub(p.lastFrame).Seconds(),
+		RSSITrend:      p.trend(),
+	}
+}
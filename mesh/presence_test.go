@@ -0,0 +1,117 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+)
+
+type presenceEvent struct {
+	// seconds since the first frame
+	at float64
+	// false to only evaluate the state
+	frame bool
+	rssi  int
+}
+
+// frames every second from the first to the last, both included
+func regularFrames(from, to int, rssi int) []presenceEvent {
+	events := make([]presenceEvent, 0)
+	for at := from; at <= to; at++ {
+		events = append(events, presenceEvent{at: float64(at), frame: true, rssi: rssi})
+	}
+	return events
+}
+
+func concat(lists ...[]presenceEvent) []presenceEvent {
+	events := make([]presenceEvent, 0)
+	for _, list := range lists {
+		events = append(events, list...)
+	}
+	return events
+}
+
+func TestPresence(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   []presenceEvent
+		expected PresenceState
+	}{
+		{
+			name:     "regular frames",
+			events:   regularFrames(1, 10, -50),
+			expected: PresencePresent,
+		},
+		{
+			name:     "short silence",
+			events:   concat(regularFrames(1, 4, -50), []presenceEvent{{at: 7}}),
+			expected: PresencePresent,
+		},
+		{
+			name:     "missed advertisements",
+			events:   concat(regularFrames(1, 4, -50), []presenceEvent{{at: 10}}),
+			expected: PresenceFading,
+		},
+		{
+			name:     "long silence",
+			events:   concat(regularFrames(1, 4, -50), []presenceEvent{{at: 10}, {at: 16}}),
+			expected: PresenceAway,
+		},
+		{
+			name:     "silence over the ttl",
+			events:   concat(regularFrames(1, 4, -50), []presenceEvent{{at: float64(PeerTTL) + 5}}),
+			expected: PresenceLost,
+		},
+		{
+			name:     "one frame is not enough to recover",
+			events:   concat(regularFrames(1, 4, -50), []presenceEvent{{at: 10}, {at: 10, frame: true, rssi: -50}}),
+			expected: PresenceFading,
+		},
+		{
+			name:     "consecutive frames recover",
+			events:   concat(regularFrames(1, 4, -50), []presenceEvent{{at: 10}}, regularFrames(10, 11, -50)),
+			expected: PresencePresent,
+		},
+		{
+			name: "frames separated by a gap don't recover",
+			events: concat(regularFrames(1, 4, -50), []presenceEvent{
+				{at: 10},
+				{at: 10, frame: true, rssi: -50},
+				{at: 15, frame: true, rssi: -50},
+			}),
+			expected: PresenceFading,
+		},
+		{
+			name: "weak and dropping signal",
+			events: []presenceEvent{
+				{at: 1, frame: true, rssi: -75},
+				{at: 2, frame: true, rssi: -80},
+				{at: 3, frame: true, rssi: -85},
+				{at: 4, frame: true, rssi: -90},
+			},
+			expected: PresenceFading,
+		},
+		{
+			name:     "weak but stable signal",
+			events:   regularFrames(1, 5, -90),
+			expected: PresencePresent,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			p := newPresence(start, test.events[0].rssi)
+			for _, event := range test.events {
+				at := start.Add(time.Duration(event.at * float64(time.Second)))
+				if event.frame {
+					p.frame(at, event.rssi)
+				}
+				p.update(at)
+			}
+
+			if p.state != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, p.state)
+			}
+		})
+	}
+}
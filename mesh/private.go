@@ -0,0 +1,702 @@
+package mesh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/evilsocket/islazy/fs"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/crypto"
+	"github.com/evilsocket/pwngrid/wifi"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// advertisement field with the encrypted section
+	PrivateField = "priv"
+
+	MessagePrivateKey = "private_key"
+	MessagePrivateAck = "private_key_ack"
+)
+
+var (
+	// if true every field but the ones needed to be reached is encrypted with a key only shared with contacts
+	PrivateAdvertisements = false
+	// period in seconds for the private advertisement key to be sent to contacts in range that didn't acknowledge it yet
+	PrivateKeyPeriod = 10
+
+	// fields left in clear in private advertisements, contacts resolve the blinded identity to find the key
+	publicFields = map[string]bool{
+		"session_id": true,
+		"blinded":    true,
+		"timestamp":  true,
+		"proto":      true,
+		"caps":       true,
+		AdvMetaField: true,
+		PrivateField: true,
+	}
+)
+
+// private keys and their acks are encrypted for the recipient and carry the identity of the sender, so
+// that they can be accepted from sessions we can't resolve yet: a unit in privacy mode can only be
+// resolved with the key it's delivering.
+type privateEnvelope struct {
+	Data []byte `json:"data"`
+}
+
+type privateSender struct {
+	From string `json:"from"`
+	// PEM of the sender, it must match its fingerprint
+	PublicKey string `json:"public_key"`
+}
+
+func (s *privateSender) sender() *privateSender {
+	return s
+}
+
+type privateMessage interface {
+	sender() *privateSender
+}
+
+type privateKeyMessage struct {
+	privateSender
+	Epoch     int    `json:"epoch"`
+	Key       []byte `json:"key"`
+	Signature []byte `json:"signature"`
+}
+
+func (m *privateKeyMessage) signed(to string) []byte {
+	hash := sha256.Sum256(m.Key)
+	return []byte(fmt.Sprintf("%s:%s:%d:%x", strings.ToLower(m.From), strings.ToLower(to), m.Epoch, hash))
+}
+
+type privateAckMessage struct {
+	privateSender
+	Epoch int `json:"epoch"`
+	// proves the key has been decrypted by the contact
+	Signature []byte `json:"signature"`
+}
+
+func (m *privateAckMessage) signed(to string, key []byte) []byte {
+	hash := sha256.Sum256(key)
+	return []byte(fmt.Sprintf("ack:%s:%s:%d:%x", strings.ToLower(m.From), strings.ToLower(to), m.Epoch, hash))
+}
+
+// keys shared with a contact
+type contactKeys struct {
+	// the key of the contact and its epoch
+	Key   []byte `json:"key,omitempty"`
+	Epoch int    `json:"epoch,omitempty"`
+	// the epoch of our key the contact acknowledged
+	Delivered int `json:"delivered"`
+}
+
+type jsonContactKeys struct {
+	Key      []byte                  `json:"key"`
+	Epoch    int                     `json:"epoch"`
+	Contacts map[string]*contactKeys `json:"contacts"`
+}
+
+func (c *Contacts) keysFileName() string {
+	return c.path + ".keys"
+}
+
+func (c *Contacts) loadKeys() error {
+	c.keys = make(map[string]*contactKeys)
+	if fileName := c.keysFileName(); fs.Exists(fileName) {
+		var doc jsonContactKeys
+		if data, err := ioutil.ReadFile(fileName); err != nil {
+			return fmt.Errorf("error loading %s: %v", fileName, err)
+		} else if err = json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("error loading %s: %v", fileName, err)
+		}
+		c.key = doc.Key
+		c.epoch = doc.Epoch
+		if doc.Contacts != nil {
+			c.keys = doc.Contacts
+		}
+	}
+	return nil
+}
+
+// the keys are stored apart from the contacts, readable only by us
+func (c *Contacts) saveKeys() error {
+	data, err := json.Marshal(jsonContactKeys{
+		Key:      c.key,
+		Epoch:    c.epoch,
+		Contacts: c.keys,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := c.keysFileName() + ".tmp"
+	if err = ioutil.WriteFile(tmpFileName, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, c.keysFileName())
+}
+
+func (c *Contacts) keysOf(fingerprint string) *contactKeys {
+	keys, found := c.keys[fingerprint]
+	if !found {
+		keys = &contactKeys{}
+		c.keys[fingerprint] = keys
+	}
+	return keys
+}
+
+// generates a new private advertisement key, contacts will get it the next time they're met.
+// To be called with the lock held.
+func (c *Contacts) rekey() error {
+	key := make([]byte, crypto.AESKEyLength)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	c.key = key
+	c.epoch++
+
+	log.Debug("private advertisement key rotated to epoch %d", c.epoch)
+
+	return c.saveKeys()
+}
+
+// encrypts the private section of the advertisement with our key
+func (c *Contacts) Seal(cleartext []byte) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.key == nil {
+		if err := c.rekey(); err != nil {
+			return "", err
+		}
+	}
+
+	encrypted, err := crypto.EncryptWith(c.key, cleartext)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%s", c.epoch, base64.StdEncoding.EncodeToString(encrypted)), nil
+}
+
+// returns our identity blinded with the given session id, only contacts that received our key can resolve it
+func (c *Contacts) Blind(sessionID []byte) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.key == nil {
+		if err := c.rekey(); err != nil {
+			return "", err
+		}
+	}
+	return BlindIdentity(c.key, sessionID), nil
+}
+
+// decrypts the private section of the advertisement of a contact
+func (c *Contacts) Open(fingerprint string, sealed string) ([]byte, error) {
+	parts := strings.SplitN(sealed, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid private section")
+	}
+
+	epoch, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid private section epoch: %v", err)
+	}
+
+	encrypted, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid private section: %v", err)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	keys, found := c.keys[strings.ToLower(fingerprint)]
+	if !found || keys.Key == nil {
+		return nil, fmt.Errorf("no key shared yet")
+	} else if keys.Epoch != epoch {
+		return nil, fmt.Errorf("key epoch is %d, section is encrypted with epoch %d", keys.Epoch, epoch)
+	}
+	return crypto.DecryptWith(keys.Key, encrypted)
+}
+
+// returns the contacts that didn't acknowledge our current key
+func (c *Contacts) pendingKeys() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	pending := make([]string, 0)
+	for fingerprint := range c.contacts {
+		if keys, found := c.keys[fingerprint]; !found || keys.Delivered < c.epoch {
+			pending = append(pending, fingerprint)
+		}
+	}
+	return pending
+}
+
+// returns the public key of a contact, if known
+func (c *Contacts) publicKeyOf(fingerprint string) *crypto.KeyPair {
+	c.Lock()
+	defer c.Unlock()
+
+	if contact, found := c.contacts[strings.ToLower(fingerprint)]; found && contact.PublicKey != "" {
+		if keys, err := crypto.FromPublicPEM(contact.PublicKey); err == nil {
+			return keys
+		}
+	}
+	return nil
+}
+
+// stores the public key of a contact, so that our key can be delivered even if it can't be resolved
+func (c *Contacts) learn(keys *crypto.KeyPair) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if contact, found := c.contacts[keys.FingerprintHex]; found && contact.PublicKey == "" {
+		contact.PublicKey = string(keys.PublicPEM)
+		return c.save()
+	}
+	return nil
+}
+
+func senderOf(keys *crypto.KeyPair) privateSender {
+	return privateSender{
+		From:      keys.FingerprintHex,
+		PublicKey: string(keys.PublicPEM),
+	}
+}
+
+// encrypts a private key message or ack for the contact
+func sealEnvelope(ourKeys *crypto.KeyPair, toKeys *crypto.KeyPair, msgType string, body interface{}) (*Message, error) {
+	cleartext, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ourKeys.EncryptFor(cleartext, toKeys.Public)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMessage(msgType, privateEnvelope{Data: data})
+}
+
+// decrypts a private key message or ack, the sender must be a contact and the public key it sent must
+// match its fingerprint
+func (c *Contacts) openEnvelope(ourKeys *crypto.KeyPair, msg *Message, body privateMessage) (*crypto.KeyPair, error) {
+	var env privateEnvelope
+	if err := json.Unmarshal(msg.Body, &env); err != nil {
+		return nil, err
+	}
+
+	cleartext, err := ourKeys.Decrypt(env.Data)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt %s message: %v", msg.Type, err)
+	} else if err = json.Unmarshal(cleartext, body); err != nil {
+		return nil, err
+	}
+
+	sender := body.sender()
+	keys, err := crypto.FromPublicPEM(sender.PublicKey)
+	if err != nil {
+		return nil, err
+	} else if keys.FingerprintHex != strings.ToLower(sender.From) {
+		return nil, fmt.Errorf("%s sent a public key with fingerprint %s", sender.From, keys.FingerprintHex)
+	} else if c.Of(sender.From) == nil {
+		return nil, fmt.Errorf("%s is not a contact", sender.From)
+	}
+
+	sender.From = keys.FingerprintHex
+	return keys, nil
+}
+
+func (c *Contacts) keyMessage(ourKeys *crypto.KeyPair, to string, toKeys *crypto.KeyPair) (*Message, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.key == nil {
+		if err := c.rekey(); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := privateKeyMessage{
+		privateSender: senderOf(ourKeys),
+		Epoch:         c.epoch,
+		Key:           c.key,
+	}
+
+	var err error
+	if msg.Signature, err = ourKeys.SignMessage(msg.signed(to)); err != nil {
+		return nil, err
+	}
+
+	return sealEnvelope(ourKeys, toKeys, MessagePrivateKey, msg)
+}
+
+// decrypts and verifies the key of a contact
+func (c *Contacts) openKey(ourKeys *crypto.KeyPair, msg *Message) (*privateKeyMessage, *crypto.KeyPair, error) {
+	var pk privateKeyMessage
+	senderKeys, err := c.openEnvelope(ourKeys, msg, &pk)
+	if err != nil {
+		return nil, nil, err
+	} else if len(pk.Key) != crypto.AESKEyLength {
+		return nil, nil, fmt.Errorf("invalid private key of %s", pk.From)
+	} else if err = senderKeys.VerifyMessage(pk.signed(ourKeys.FingerprintHex), pk.Signature); err != nil {
+		return nil, nil, fmt.Errorf("invalid signature of the private key of %s: %v", pk.From, err)
+	}
+	return &pk, senderKeys, nil
+}
+
+// stores the key of a contact and returns the ack to send back, sent again if we already had the key
+// because the contact missed our previous ack
+func (c *Contacts) storeKey(ourKeys *crypto.KeyPair, pk *privateKeyMessage, senderKeys *crypto.KeyPair) (*Message, error) {
+	c.Lock()
+	keys := c.keysOf(pk.From)
+	if pk.Epoch < keys.Epoch || (pk.Epoch == keys.Epoch && !bytes.Equal(pk.Key, keys.Key)) {
+		// an old message replayed, it would replace the current key
+		current := keys.Epoch
+		c.Unlock()
+		return nil, fmt.Errorf("private key of %s has epoch %d, current epoch is %d", pk.From, pk.Epoch, current)
+	} else if pk.Epoch > keys.Epoch {
+		keys.Key = pk.Key
+		keys.Epoch = pk.Epoch
+		if err := c.saveKeys(); err != nil {
+			c.Unlock()
+			return nil, err
+		}
+	}
+	c.Unlock()
+
+	ack := privateAckMessage{
+		privateSender: senderOf(ourKeys),
+		Epoch:         pk.Epoch,
+	}
+
+	var err error
+	if ack.Signature, err = ourKeys.SignMessage(ack.signed(pk.From, pk.Key)); err != nil {
+		return nil, err
+	}
+
+	return sealEnvelope(ourKeys, senderKeys, MessagePrivateAck, ack)
+}
+
+// decrypts an ack of our key
+func (c *Contacts) openAck(ourKeys *crypto.KeyPair, msg *Message) (*privateAckMessage, *crypto.KeyPair, error) {
+	var ack privateAckMessage
+	senderKeys, err := c.openEnvelope(ourKeys, msg, &ack)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &ack, senderKeys, nil
+}
+
+// marks our key as delivered to the contact if the ack is for the current epoch, returns true if it wasn't yet
+func (c *Contacts) storeAck(ourKeys *crypto.KeyPair, ack *privateAckMessage, senderKeys *crypto.KeyPair) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if ack.Epoch != c.epoch {
+		return false, nil
+	} else if err := senderKeys.VerifyMessage(ack.signed(ourKeys.FingerprintHex, c.key), ack.Signature); err != nil {
+		return false, fmt.Errorf("invalid private key ack from %s: %v", ack.From, err)
+	}
+
+	if keys := c.keysOf(ack.From); keys.Delivered < ack.Epoch {
+		keys.Delivered = ack.Epoch
+		return true, c.saveKeys()
+	}
+	return false, nil
+}
+
+func (router *Router) privateKeysWorker() {
+	period := time.Duration(PrivateKeyPeriod) * time.Second
+	log.Debug("private keys worker started with a %s period", period)
+
+	for range router.ticker(period) {
+		// the key is needed by contacts to resolve our blinded identity as well
+		if !PrivateAdvertisements && !PrivacyMode {
+			continue
+		}
+
+		// a contact in privacy mode could be around, we can't resolve it until it gets our key
+		unresolved := time.Since(time.Unix(0, atomic.LoadInt64(&router.unresolvedAt))) < 2*period
+
+		for _, fingerprint := range router.contacts.pendingKeys() {
+			_, inRange := router.peers.Load(fingerprint)
+			keys := router.contacts.publicKeyOf(fingerprint)
+			if inRange && keys == nil {
+				// if not known yet it's requested and we'll try again at the next round
+				if keys = router.PublicKeyOf(fingerprint); keys == nil {
+					continue
+				} else if err := router.contacts.learn(keys); err != nil {
+					log.Error("error saving the public key of %s: %v", fingerprint, err)
+				}
+			} else if !inRange && (keys == nil || !unresolved) {
+				continue
+			}
+
+			msg, err := router.contacts.keyMessage(router.local.Keys, fingerprint, keys)
+			if err != nil {
+				log.Error("error creating private key message for %s: %v", fingerprint, err)
+			} else if inRange {
+				if err = router.SendTo(fingerprint, msg.Type, msg.Body); err != nil {
+					log.Debug("error sending private key to %s: %v", fingerprint, err)
+				}
+			} else if err = router.Broadcast(msg.Type, msg.Body); err != nil {
+				// only the contact can decrypt it and tell who sent it
+				log.Debug("error broadcasting private key for %s: %v", fingerprint, err)
+			}
+		}
+	}
+}
+
+// replies to the peer if registered, to its session otherwise
+func (router *Router) replyTo(ident string, session net.HardwareAddr, msg *Message) error {
+	if ident != "" {
+		return router.SendTo(ident, msg.Type, msg.Body)
+	}
+	return router.sendToSession(session, msg.Type, msg.Body)
+}
+
+// handles private keys and acks from sessions that are not registered, the sender is verified with the
+// public key it sent and the signature of the frame
+func (router *Router) onPrivateFrame(pkt gopacket.Packet, radio *layers.RadioTap, dot11 *layers.Dot11) {
+	session := net.HardwareAddr(dot11.Address3)
+	sessionID := session.String()
+
+	err, payload := wifi.Unpack(pkt, radio, dot11)
+	if err != nil {
+		log.Debug("%v", err)
+		return
+	}
+
+	signature := wifi.Signature(pkt)
+	if found, streamID, seqNum, seqTot := wifi.Stream(pkt); found {
+		if payload, signature = router.fragments.add(sessionID, streamID, seqNum, seqTot, payload, signature); payload == nil {
+			return
+		}
+	}
+
+	var msg Message
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Debug("error decoding message from %s: %v", sessionID, err)
+		return
+	} else if msg.Type != MessagePrivateKey && msg.Type != MessagePrivateAck {
+		log.Debug("ignoring %s message from unknown session %s", msg.Type, sessionID)
+		return
+	}
+
+	verify := func(keys *crypto.KeyPair) error {
+		if signature == nil {
+			return fmt.Errorf("message is not signed")
+		}
+		return keys.VerifyMessage(signedBytes(dot11.Address3, dot11.Address1, payload), signature)
+	}
+
+	if msg.Type == MessagePrivateKey {
+		router.gotPrivateKey("", session, &msg, verify)
+	} else {
+		router.gotPrivateAck("", session, &msg, verify)
+	}
+}
+
+func (router *Router) onPrivateKey(ident string, peer *Peer, msg *Message) {
+	peer.Lock()
+	session := net.HardwareAddr(append(SessionID{}, peer.SessionID...))
+	peer.Unlock()
+
+	router.gotPrivateKey(ident, session, msg, nil)
+}
+
+func (router *Router) onPrivateAck(ident string, peer *Peer, msg *Message) {
+	peer.Lock()
+	session := net.HardwareAddr(append(SessionID{}, peer.SessionID...))
+	peer.Unlock()
+
+	router.gotPrivateAck(ident, session, msg, nil)
+}
+
+// checks who sent a private key message or ack, ident is empty if the session is not registered
+func (router *Router) checkPrivateSender(ident string, sender *privateSender, keys *crypto.KeyPair, session net.HardwareAddr, verify func(*crypto.KeyPair) error) error {
+	if ident != "" && !strings.EqualFold(ident, sender.From) {
+		return fmt.Errorf("%s sent a message from %s", ident, sender.From)
+	} else if verify != nil {
+		if err := verify(keys); err != nil {
+			return fmt.Errorf("invalid signature from %s: %v", sender.From, err)
+		}
+	}
+
+	if router.policy.Check(sender.From, session.String(), true) == PolicyDeny {
+		return fmt.Errorf("%s is denied", sender.From)
+	}
+	return nil
+}
+
+func (router *Router) gotPrivateKey(ident string, session net.HardwareAddr, msg *Message, verify func(*crypto.KeyPair) error) {
+	pk, senderKeys, err := router.contacts.openKey(router.local.Keys, msg)
+	if err != nil {
+		log.Debug("ignoring private key from %s: %v", session, err)
+		return
+	} else if err = router.checkPrivateSender(ident, &pk.privateSender, senderKeys, session, verify); err != nil {
+		log.Warning("ignoring private key from %s: %v", session, err)
+		return
+	}
+
+	if err = router.contacts.learn(senderKeys); err != nil {
+		log.Error("error saving the public key of %s: %v", pk.From, err)
+	}
+
+	ack, err := router.contacts.storeKey(router.local.Keys, pk, senderKeys)
+	if err != nil {
+		log.Warning("ignoring private key of %s: %v", pk.From, err)
+		return
+	}
+
+	log.Debug("got private advertisement key of %s (epoch %d)", pk.From, pk.Epoch)
+
+	if err = router.replyTo(ident, session, ack); err != nil {
+		log.Debug("error acknowledging private key of %s: %v", pk.From, err)
+	}
+}
+
+func (router *Router) gotPrivateAck(ident string, session net.HardwareAddr, msg *Message, verify func(*crypto.KeyPair) error) {
+	ack, senderKeys, err := router.contacts.openAck(router.local.Keys, msg)
+	if err != nil {
+		log.Debug("ignoring private key ack from %s: %v", session, err)
+		return
+	} else if err = router.checkPrivateSender(ident, &ack.privateSender, senderKeys, session, verify); err != nil {
+		log.Warning("ignoring private key ack from %s: %v", session, err)
+		return
+	}
+
+	if err = router.contacts.learn(senderKeys); err != nil {
+		log.Error("error saving the public key of %s: %v", ack.From, err)
+	}
+
+	if delivered, err := router.contacts.storeAck(router.local.Keys, ack, senderKeys); err != nil {
+		log.Warning("%v", err)
+	} else if delivered {
+		log.Debug("%s has our private advertisement key (epoch %d)", ack.From, ack.Epoch)
+	}
+}
+
+// moves every field that is not needed to reach us into the encrypted section, if it can't be
+// encrypted those fields are not sent at all
+func (peer *Peer) seal(data map[string]interface{}) map[string]interface{} {
+	public := make(map[string]interface{})
+	private := make(map[string]interface{})
+	for key, value := range data {
+		if publicFields[key] {
+			public[key] = value
+		} else {
+			private[key] = value
+		}
+	}
+
+	if len(private) == 0 {
+		return public
+	} else if peer.sealer == nil {
+		log.Warning("private advertisement fields can't be encrypted, not sending them")
+		return public
+	}
+
+	cleartext, err := json.Marshal(private)
+	if err != nil {
+		log.Error("could not serialize private advertisement data: %v", err)
+		return public
+	}
+
+	if public[PrivateField], err = peer.sealer(cleartext); err != nil {
+		log.Error("could not encrypt private advertisement data: %v", err)
+		delete(public, PrivateField)
+	}
+	return public
+}
+
+// sets the function used to encrypt the private section of the advertisement
+func (peer *Peer) SealWith(cb func(cleartext []byte) (string, error)) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.sealer = cb
+}
+
+// sets the function used to blind our identity with the session id
+func (peer *Peer) BlindWith(cb func(sessionID []byte) (string, error)) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.blinder = cb
+}
+
+// returns the fields of the advertisement we decrypted from the private section
+func (peer *Peer) Private() map[string]interface{} {
+	peer.Lock()
+	defer peer.Unlock()
+	return peer.privateData()
+}
+
+// to be called with the lock held
+func (peer *Peer) privateData() map[string]interface{} {
+	if len(peer.private) == 0 {
+		return nil
+	}
+
+	data := make(map[string]interface{})
+	for key := range peer.private {
+		if value, found := peer.AdvData.Load(key); found {
+			data[key] = value
+		}
+	}
+	return data
+}
+
+func (peer *Peer) setPrivate(fields map[string]interface{}) {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.private == nil {
+		peer.private = make(map[string]bool)
+	}
+	for key := range fields {
+		peer.private[key] = true
+	}
+}
+
+// decrypts the private section of the advertisement of a contact, returns the validated fields
+func (router *Router) openPrivate(contact *Contact, sealed string) (map[string]interface{}, error) {
+	cleartext, err := router.contacts.Open(contact.Fingerprint, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	private := make(map[string]interface{})
+	if err = json.Unmarshal(cleartext, &private); err != nil {
+		return nil, err
+	}
+
+	private, dropped := ValidateRemote(private)
+	if len(dropped) > 0 {
+		log.Debug("dropped invalid private fields %v from %s", dropped, contact.Fingerprint)
+	}
+
+	if ident, found := private["identity"]; found && !strings.EqualFold(ident.(string), contact.Fingerprint) {
+		return nil, fmt.Errorf("private section identity %s doesn't match", ident)
+	}
+	delete(private, "identity")
+	delete(private, "blinded")
+
+	return private, nil
+}
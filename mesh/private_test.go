@@ -0,0 +1,285 @@
+package mesh
+
+import (
+	"bytes"
+	"github.com/evilsocket/pwngrid/crypto"
+	"github.com/evilsocket/pwngrid/wifi"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+type testUnit struct {
+	name     string
+	keys     *crypto.KeyPair
+	contacts *Contacts
+	router   *Router
+}
+
+func testUnits(t *testing.T, base string, names ...string) []*testUnit {
+	units := make([]*testUnit, 0, len(names))
+	for _, name := range names {
+		keys := testKeys(t)
+
+		err, contacts := ContactsFromPath(path.Join(base, name+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err, policy := PolicyFromPath(path.Join(base, name+"-policy.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		units = append(units, &testUnit{
+			name:     name,
+			keys:     keys,
+			contacts: contacts,
+			router: &Router{
+				local:     MakeLocalPeer(name, keys),
+				peers:     NewRegistry(),
+				policy:    policy,
+				contacts:  contacts,
+				fragments: newFragments(),
+			},
+		})
+	}
+	return units
+}
+
+func (unit *testUnit) add(t *testing.T, contacts ...*testUnit) {
+	for _, contact := range contacts {
+		if err := unit.contacts.Add(Contact{Fingerprint: contact.keys.FingerprintHex}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sends a message the way the router of the unit does and has it received by the router of the other one
+func (unit *testUnit) deliver(t *testing.T, to *testUnit, msg *Message) {
+	unit.send(t, net.HardwareAddr(to.router.local.SessionID), to, msg)
+}
+
+func (unit *testUnit) broadcast(t *testing.T, to *testUnit, msg *Message) {
+	unit.send(t, wifi.MulticastAddr, to, msg)
+}
+
+func (unit *testUnit) send(t *testing.T, dst net.HardwareAddr, to *testUnit, msg *Message) {
+	frames, err := unit.router.pack(dst, msg.Type, msg.Body, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, raw := range frames {
+		pkt := gopacket.NewPacket(raw, layers.LayerTypeRadioTap, gopacket.Default)
+		ok, radio, dot11 := wifi.Parse(pkt)
+		if !ok {
+			t.Fatalf("could not parse frame")
+		}
+		to.router.onMessage(pkt, radio, dot11)
+	}
+}
+
+// the key is needed to resolve the sender, so both units deliver it without knowing who's on the other side
+func TestPrivateKeysExchange(t *testing.T) {
+	base, err := ioutil.TempDir("", "pwngrid-private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	units := testUnits(t, base, "a", "b")
+	a, b := units[0], units[1]
+	a.add(t, b)
+	b.add(t, a)
+
+	for _, pair := range [][2]*testUnit{{a, b}, {b, a}} {
+		from, to := pair[0], pair[1]
+
+		msg, err := from.contacts.keyMessage(from.keys, to.keys.FingerprintHex, to.keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the session of the sender is not registered by the recipient
+		from.deliver(t, to, msg)
+
+		sessionID := newSessionID()
+		blinded, err := from.contacts.Blind(sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contact := to.contacts.Resolve(sessionID, blinded); contact == nil || contact.Fingerprint != from.keys.FingerprintHex {
+			t.Fatalf("%s can't resolve the blinded identity of %s", to.name, from.name)
+		}
+
+		sealed, err := from.contacts.Seal([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened, err := to.contacts.Open(from.keys.FingerprintHex, sealed); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(opened, []byte("hello")) {
+			t.Fatalf("unexpected private section '%s'", opened)
+		}
+
+		// the ack is sent back to the session, radios are not available here
+		pk, senderKeys, err := to.contacts.openKey(to.keys, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, err := to.contacts.storeKey(to.keys, pk, senderKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		to.deliver(t, from, ack)
+
+		if pending := from.contacts.pendingKeys(); len(pending) != 0 {
+			t.Fatalf("key of %s still pending for %v", from.name, pending)
+		}
+	}
+}
+
+func TestPrivateKeysRejected(t *testing.T) {
+	base, err := ioutil.TempDir("", "pwngrid-private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	units := testUnits(t, base, "a", "b", "c")
+	a, b, c := units[0], units[1], units[2]
+	a.add(t, b, c)
+	b.add(t, a)
+	c.add(t, a)
+
+	hasKeyOf := func(unit, of *testUnit) bool {
+		unit.contacts.Lock()
+		defer unit.contacts.Unlock()
+		keys, found := unit.contacts.keys[of.keys.FingerprintHex]
+		return found && keys.Key != nil
+	}
+
+	// b is not a contact of c
+	msg, err := b.contacts.keyMessage(b.keys, c.keys.FingerprintHex, c.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.deliver(t, c, msg)
+	if hasKeyOf(c, b) {
+		t.Fatalf("key accepted from a unit that is not a contact")
+	}
+
+	// encrypted for b, c can't read it
+	msg, err = a.contacts.keyMessage(a.keys, b.keys.FingerprintHex, b.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.deliver(t, c, msg)
+	if hasKeyOf(c, a) {
+		t.Fatalf("key accepted by a unit it was not encrypted for")
+	}
+
+	// sent from a session of c, the frame signature doesn't match the key of a
+	c.deliver(t, b, msg)
+	if hasKeyOf(b, a) {
+		t.Fatalf("key accepted from a frame signed by someone else")
+	}
+
+	a.deliver(t, b, msg)
+	if !hasKeyOf(b, a) {
+		t.Fatalf("key of a not accepted")
+	}
+
+	// once rotated, the previous key can't be replayed
+	a.contacts.Lock()
+	if err = a.contacts.rekey(); err != nil {
+		t.Fatal(err)
+	}
+	a.contacts.Unlock()
+
+	rotated, err := a.contacts.keyMessage(a.keys, b.keys.FingerprintHex, b.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.deliver(t, b, rotated)
+	a.deliver(t, b, msg)
+
+	b.contacts.Lock()
+	epoch := b.contacts.keys[a.keys.FingerprintHex].Epoch
+	b.contacts.Unlock()
+	if epoch != 2 {
+		t.Fatalf("expected epoch 2, got %d", epoch)
+	}
+}
+
+// units in privacy mode can't resolve each other, one of them needs to know the public key of the other
+func TestPrivateKeysMulticast(t *testing.T) {
+	base, err := ioutil.TempDir("", "pwngrid-private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	units := testUnits(t, base, "a", "b", "c")
+	a, b, c := units[0], units[1], units[2]
+	b.add(t, a)
+	c.add(t, a)
+
+	if err = a.contacts.Add(Contact{Fingerprint: b.keys.FingerprintHex, PublicKey: string(c.keys.PublicPEM)}); err == nil {
+		t.Fatalf("expected an error for a public key that doesn't match the fingerprint")
+	} else if err = a.contacts.Add(Contact{Fingerprint: b.keys.FingerprintHex, PublicKey: string(b.keys.PublicPEM)}); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := a.contacts.keyMessage(a.keys, b.keys.FingerprintHex, a.contacts.publicKeyOf(b.keys.FingerprintHex))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every unit in range gets it, only b can read it
+	a.broadcast(t, b, msg)
+	a.broadcast(t, c, msg)
+
+	if c.contacts.publicKeyOf(a.keys.FingerprintHex) != nil {
+		t.Fatalf("c learned the key of a from a message for b")
+	}
+
+	// b learned the public key of a and can answer with its own key the same way
+	keys := b.contacts.publicKeyOf(a.keys.FingerprintHex)
+	if keys == nil {
+		t.Fatalf("b didn't learn the public key of a")
+	}
+
+	msg, err = b.contacts.keyMessage(b.keys, a.keys.FingerprintHex, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.broadcast(t, a, msg)
+
+	for _, pair := range [][2]*testUnit{{a, b}, {b, a}} {
+		from, to := pair[0], pair[1]
+
+		sessionID := newSessionID()
+		blinded, err := from.contacts.Blind(sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contact := to.contacts.Resolve(sessionID, blinded); contact == nil || contact.Fingerprint != from.keys.FingerprintHex {
+			t.Fatalf("%s can't resolve the blinded identity of %s", to.name, from.name)
+		}
+	}
+
+	sessionID := newSessionID()
+	blinded, err := a.contacts.Blind(sessionID)
+	if err != nil {
+		t.Fatal(err)
+	} else if contact := c.contacts.Resolve(sessionID, blinded); contact != nil {
+		t.Fatalf("c resolved the blinded identity of a")
+	}
+}
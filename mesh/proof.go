@@ -0,0 +1,374 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/crypto"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MessageProofChallenge = "proof_challenge"
+	MessageProofResponse  = "proof_response"
+	MessageProof          = "proof"
+
+	ProofNonceSize = 16
+)
+
+var (
+	// if true units in range exchange signed proofs of the encounter
+	EncounterProofs = true
+	// minimum time in seconds between two proofs with the same peer
+	ProofInterval = 3600
+	// time in seconds to wait for the response to a challenge
+	ProofTimeout = 30
+	// maximum difference in seconds between the time of a proof and the local clock
+	ProofMaxSkew = 120
+)
+
+// Proof is a token signed by both units of an encounter: A is the unit that sent the challenge,
+// B the one that responded.
+type Proof struct {
+	A          string `json:"a"`
+	B          string `json:"b"`
+	At         int64  `json:"at"`
+	Channel    int    `json:"channel"`
+	NonceA     []byte `json:"nonce_a"`
+	NonceB     []byte `json:"nonce_b"`
+	SignatureA []byte `json:"signature_a"`
+	SignatureB []byte `json:"signature_b"`
+	// local only, not signed
+	UploadedAt *time.Time `json:"uploaded_at,omitempty"`
+	// set if the server refused it for a reason that won't change, it's not uploaded again
+	RejectedAt *time.Time `json:"rejected_at,omitempty"`
+	Rejection  string     `json:"rejection,omitempty"`
+}
+
+// the data signed by both units
+func (p *Proof) Payload() []byte {
+	return []byte(fmt.Sprintf("pwngrid-encounter:%s:%s:%d:%d:%x:%x",
+		strings.ToLower(p.A), strings.ToLower(p.B), p.At, p.Channel, p.NonceA, p.NonceB))
+}
+
+func (p *Proof) ID() string {
+	hash := sha256.Sum256(p.Payload())
+	return hex.EncodeToString(hash[:16])
+}
+
+func (p *Proof) Time() time.Time {
+	return time.Unix(p.At, 0)
+}
+
+// returns the fingerprint of the other unit of the encounter
+func (p *Proof) Peer(self string) string {
+	if strings.EqualFold(p.A, self) {
+		return p.B
+	}
+	return p.A
+}
+
+// checks the proof is well formed and signed by both units
+func (p *Proof) Verify(keysA, keysB *crypto.KeyPair) error {
+	if !fingValidator.MatchString(p.A) || !fingValidator.MatchString(p.B) {
+		return fmt.Errorf("invalid fingerprints")
+	} else if strings.EqualFold(p.A, p.B) {
+		return fmt.Errorf("a unit can't meet itself")
+	} else if len(p.NonceA) != ProofNonceSize || len(p.NonceB) != ProofNonceSize {
+		return fmt.Errorf("invalid nonces")
+	} else if !strings.EqualFold(keysA.FingerprintHex, p.A) || !strings.EqualFold(keysB.FingerprintHex, p.B) {
+		return fmt.Errorf("keys don't match the fingerprints")
+	} else if err := keysA.VerifyMessage(p.Payload(), p.SignatureA); err != nil {
+		return fmt.Errorf("invalid signature of %s: %v", p.A, err)
+	} else if err := keysB.VerifyMessage(p.Payload(), p.SignatureB); err != nil {
+		return fmt.Errorf("invalid signature of %s: %v", p.B, err)
+	}
+	return nil
+}
+
+type proofChallenge struct {
+	At      int64  `json:"at"`
+	Channel int    `json:"channel"`
+	Nonce   []byte `json:"nonce"`
+}
+
+type proofResponse struct {
+	Nonce     []byte `json:"nonce"`
+	Signature []byte `json:"signature"`
+}
+
+type pendingProof struct {
+	proof  *Proof
+	sentAt time.Time
+}
+
+// state of the challenges we sent
+type provers struct {
+	sync.Mutex
+	pending map[string]*pendingProof
+	last    map[string]time.Time
+}
+
+func newProvers() *provers {
+	return &provers{
+		pending: make(map[string]*pendingProof),
+		last:    make(map[string]time.Time),
+	}
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, ProofNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// returns true if the peer has been seen on the given channel
+func (peer *Peer) seenOn(channel int) bool {
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.Channel == channel {
+		return true
+	}
+	for _, sighting := range peer.Sightings {
+		if sighting.Channel == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// sends a challenge to the peers in range we don't have a recent proof with, only the unit with
+// the lower fingerprint starts the exchange
+func (router *Router) proofsWorker() {
+	period := time.Duration(ProofTimeout) * time.Second
+	log.Debug("proofs worker started with a %s period", period)
+
+	self := router.local.Keys.FingerprintHex
+	for now := range router.ticker(period) {
+		// proofs are sent in clear and would link our identity to this session
+		if !EncounterProofs || PrivacyMode || PrivateAdvertisements {
+			continue
+		}
+
+		router.peers.Range(func(ident string, peer *Peer) bool {
+			if strings.ToLower(self) >= strings.ToLower(ident) {
+				return true
+			}
+
+			router.provers.Lock()
+			last := router.provers.last[ident]
+			pending := router.provers.pending[ident]
+			router.provers.Unlock()
+
+			if now.Sub(last) < time.Duration(ProofInterval)*time.Second {
+				return true
+			} else if pending != nil && now.Sub(pending.sentAt) < time.Duration(ProofTimeout)*time.Second {
+				return true
+			} else if router.PublicKeyOf(ident) == nil {
+				// needed to verify the response, it'll be there for the next round
+				return true
+			}
+
+			router.spawn(func() {
+				router.challenge(ident, peer, now)
+			})
+			return true
+		})
+	}
+}
+
+func (router *Router) challenge(ident string, peer *Peer, now time.Time) {
+	nonce, err := newNonce()
+	if err != nil {
+		log.Error("error generating proof nonce: %v", err)
+		return
+	}
+
+	peer.Lock()
+	channel := peer.Channel
+	peer.Unlock()
+
+	challenge := proofChallenge{
+		At:      now.Unix(),
+		Channel: channel,
+		Nonce:   nonce,
+	}
+
+	router.provers.Lock()
+	router.provers.pending[ident] = &pendingProof{
+		proof: &Proof{
+			A:       router.local.Keys.FingerprintHex,
+			B:       ident,
+			At:      challenge.At,
+			Channel: challenge.Channel,
+			NonceA:  nonce,
+		},
+		sentAt: now,
+	}
+	router.provers.Unlock()
+
+	log.Debug("sending encounter challenge to %s", ident)
+
+	if err := router.SendTo(ident, MessageProofChallenge, challenge); err != nil {
+		log.Debug("error sending encounter challenge to %s: %v", ident, err)
+	}
+}
+
+func (router *Router) onProofChallenge(ident string, peer *Peer, msg *Message) {
+	if !EncounterProofs || PrivacyMode || PrivateAdvertisements {
+		return
+	}
+
+	var challenge proofChallenge
+	if err := json.Unmarshal(msg.Body, &challenge); err != nil {
+		log.Debug("error decoding encounter challenge from %s: %v", ident, err)
+		return
+	} else if skew := abs(time.Now().Unix() - challenge.At); skew > int64(ProofMaxSkew) {
+		log.Debug("ignoring encounter challenge from %s, clocks differ by %ds", ident, skew)
+		return
+	} else if !peer.seenOn(challenge.Channel) {
+		log.Debug("ignoring encounter challenge from %s, never seen on channel %d", ident, challenge.Channel)
+		return
+	} else if len(challenge.Nonce) != ProofNonceSize {
+		log.Debug("ignoring encounter challenge from %s, invalid nonce", ident)
+		return
+	}
+
+	// we'll need it to verify the final proof
+	router.PublicKeyOf(ident)
+
+	nonce, err := newNonce()
+	if err != nil {
+		log.Error("error generating proof nonce: %v", err)
+		return
+	}
+
+	proof := &Proof{
+		A:       ident,
+		B:       router.local.Keys.FingerprintHex,
+		At:      challenge.At,
+		Channel: challenge.Channel,
+		NonceA:  challenge.Nonce,
+		NonceB:  nonce,
+	}
+
+	signature, err := router.local.Keys.SignMessage(proof.Payload())
+	if err != nil {
+		log.Error("error signing encounter proof: %v", err)
+		return
+	}
+
+	if err := router.SendTo(ident, MessageProofResponse, proofResponse{
+		Nonce:     nonce,
+		Signature: signature,
+	}); err != nil {
+		log.Debug("error sending encounter response to %s: %v", ident, err)
+	}
+}
+
+func (router *Router) onProofResponse(ident string, peer *Peer, msg *Message) {
+	var response proofResponse
+	if err := json.Unmarshal(msg.Body, &response); err != nil {
+		log.Debug("error decoding encounter response from %s: %v", ident, err)
+		return
+	}
+
+	router.provers.Lock()
+	pending := router.provers.pending[ident]
+	delete(router.provers.pending, ident)
+	router.provers.Unlock()
+
+	if pending == nil {
+		log.Debug("unexpected encounter response from %s", ident)
+		return
+	}
+
+	keys := router.PublicKeyOf(ident)
+	if keys == nil {
+		log.Debug("can't verify encounter response from %s, public key unknown", ident)
+		return
+	}
+
+	proof := pending.proof
+	proof.NonceB = response.Nonce
+	proof.SignatureB = response.Signature
+
+	var err error
+	if proof.SignatureA, err = router.local.Keys.SignMessage(proof.Payload()); err != nil {
+		log.Error("error signing encounter proof: %v", err)
+		return
+	} else if err = proof.Verify(router.local.Keys, keys); err != nil {
+		log.Warning("invalid encounter response from %s: %v", ident, err)
+		return
+	}
+
+	router.provers.Lock()
+	router.provers.last[ident] = time.Now()
+	router.provers.Unlock()
+
+	router.storeProof(proof)
+
+	if err = router.SendTo(ident, MessageProof, proof); err != nil {
+		log.Debug("error sending encounter proof to %s: %v", ident, err)
+	}
+}
+
+func (router *Router) onProof(ident string, peer *Peer, msg *Message) {
+	var proof Proof
+	if err := json.Unmarshal(msg.Body, &proof); err != nil {
+		log.Debug("error decoding encounter proof from %s: %v", ident, err)
+		return
+	} else if !strings.EqualFold(proof.A, ident) || !strings.EqualFold(proof.B, router.local.Keys.FingerprintHex) {
+		log.Debug("ignoring encounter proof from %s, wrong units", ident)
+		return
+	}
+
+	keys := router.PublicKeyOf(ident)
+	if keys == nil {
+		log.Debug("can't verify encounter proof from %s, public key unknown", ident)
+		return
+	} else if err := proof.Verify(keys, router.local.Keys); err != nil {
+		log.Warning("invalid encounter proof from %s: %v", ident, err)
+		return
+	}
+
+	proof.UploadedAt = nil
+	router.storeProof(&proof)
+}
+
+func (router *Router) storeProof(proof *Proof) {
+	if err := router.memory.StoreProof(proof); err != nil {
+		log.Error("error saving encounter proof %s: %v", proof.ID(), err)
+	} else {
+		log.Info("encounter with %s proved on channel %d", proof.Peer(router.local.Keys.FingerprintHex), proof.Channel)
+	}
+}
+
+// returns the proofs of encounter with the given peer, or every proof if fingerprint is empty
+func (router *Router) Proofs(fingerprint string, pending bool) ([]*Proof, error) {
+	return router.memory.Proofs(fingerprint, pending)
+}
+
+func (router *Router) ProofsUploaded(ids []string) error {
+	return router.memory.ProofsUploaded(ids, time.Now())
+}
+
+// marks the proofs the server refused, with the reasons by id
+func (router *Router) ProofsRejected(reasons map[string]string) error {
+	return router.memory.ProofsRejected(reasons, time.Now())
+}
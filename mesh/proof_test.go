@@ -0,0 +1,136 @@
+package mesh
+
+import (
+	"bytes"
+	"github.com/evilsocket/pwngrid/crypto"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testKeys(t *testing.T) *crypto.KeyPair {
+	path, err := ioutil.TempDir("", "pwngrid-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	keys, err := crypto.LoadOrCreate(path, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestProofPayload(t *testing.T) {
+	proof := Proof{
+		A:       "AABB",
+		B:       "ccdd",
+		At:      1234,
+		Channel: 6,
+		NonceA:  []byte{0x01, 0x02},
+		NonceB:  []byte{0xff},
+	}
+
+	expected := []byte("pwngrid-encounter:aabb:ccdd:1234:6:0102:ff")
+	if payload := proof.Payload(); !bytes.Equal(payload, expected) {
+		t.Fatalf("expected '%s', got '%s'", expected, payload)
+	}
+
+	// signatures and upload state are not part of it
+	proof.SignatureA = []byte("sig")
+	if payload := proof.Payload(); !bytes.Equal(payload, expected) {
+		t.Fatalf("expected '%s', got '%s'", expected, payload)
+	}
+}
+
+func TestProofVerify(t *testing.T) {
+	keysA := testKeys(t)
+	keysB := testKeys(t)
+	keysC := testKeys(t)
+
+	signed := func(mutate func(p *Proof)) *Proof {
+		p := &Proof{
+			A:       keysA.FingerprintHex,
+			B:       keysB.FingerprintHex,
+			At:      1234,
+			Channel: 6,
+			NonceA:  make([]byte, ProofNonceSize),
+			NonceB:  bytes.Repeat([]byte{1}, ProofNonceSize),
+		}
+		if mutate != nil {
+			mutate(p)
+		}
+		p.SignatureA, _ = keysA.SignMessage(p.Payload())
+		p.SignatureB, _ = keysB.SignMessage(p.Payload())
+		return p
+	}
+
+	tests := []struct {
+		name  string
+		proof *Proof
+		keysA *crypto.KeyPair
+		keysB *crypto.KeyPair
+		valid bool
+	}{
+		{"valid", signed(nil), keysA, keysB, true},
+		{"invalid fingerprint", signed(func(p *Proof) { p.A = "nope" }), keysA, keysB, false},
+		{"same unit", signed(func(p *Proof) { p.B = p.A }), keysA, keysA, false},
+		{"short nonce", signed(func(p *Proof) { p.NonceA = []byte{1} }), keysA, keysB, false},
+		{"keys swapped", signed(nil), keysB, keysA, false},
+		{"wrong key", signed(nil), keysA, keysC, false},
+		{"tampered channel", func() *Proof { p := signed(nil); p.Channel = 11; return p }(), keysA, keysB, false},
+		{"tampered time", func() *Proof { p := signed(nil); p.At++; return p }(), keysA, keysB, false},
+		{"missing signature", func() *Proof { p := signed(nil); p.SignatureB = nil; return p }(), keysA, keysB, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.proof.Verify(test.keysA, test.keysB)
+			if test.valid && err != nil {
+				t.Fatalf("expected valid proof, got %v", err)
+			} else if !test.valid && err == nil {
+				t.Fatalf("expected invalid proof")
+			}
+		})
+	}
+}
+
+// proofs uploaded or refused by the server are not pending anymore
+func TestProofsPending(t *testing.T) {
+	dir, mem := testMemory(t)
+	defer os.RemoveAll(dir)
+	defer mem.Close()
+
+	ids := make([]string, 0)
+	for at := int64(1); at <= 3; at++ {
+		proof := &Proof{A: "aa", B: "bb", At: at}
+		if err := mem.StoreProof(proof); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, proof.ID())
+	}
+
+	now := time.Now()
+	if err := mem.ProofsUploaded(ids[:1], now); err != nil {
+		t.Fatal(err)
+	} else if err = mem.ProofsRejected(map[string]string{ids[1]: "unit aa is not enrolled"}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if pending, err := mem.Proofs("", true); err != nil {
+		t.Fatal(err)
+	} else if len(pending) != 1 || pending[0].ID() != ids[2] {
+		t.Fatalf("expected only %s to be pending, got %v", ids[2], pending)
+	}
+
+	all, err := mem.Proofs("", false)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(all) != 3 {
+		t.Fatalf("expected 3 proofs, got %d", len(all))
+	} else if all[1].RejectedAt == nil || all[1].Rejection != "unit aa is not enrolled" {
+		t.Fatalf("expected %s to be rejected, got %+v", ids[1], all[1])
+	}
+}
@@ -0,0 +1,99 @@
+package mesh
+
+import (
+	"strings"
+)
+
+const (
+	// version of the mesh protocol, units not advertising it are legacy ones
+	ProtocolVersion = 2
+	LegacyProtocol  = 1
+
+	// the unit handles unicast messages
+	CapUnicast = "unicast"
+	// unicast messages are signed with the key of the unit
+	CapSigned = "signed"
+	// messages bigger than FragmentSize are split in a stream of frames
+	CapFragment = "fragment"
+	// message payloads are compressed
+	CapCompress = "compress"
+)
+
+// capabilities advertised by the local unit
+var Capabilities = []string{CapUnicast, CapSigned, CapFragment, CapCompress}
+
+// ProtocolStatus describes the protocol spoken by a peer and the features negotiated with it.
+type ProtocolStatus struct {
+	Version      int      `json:"version"`
+	GridVersion  string   `json:"grid_version,omitempty"`
+	Legacy       bool     `json:"legacy"`
+	Capabilities []string `json:"capabilities"`
+	// capabilities supported by both units, used when talking to this peer
+	Negotiated []string `json:"negotiated"`
+}
+
+func (status *ProtocolStatus) Supports(capability string) bool {
+	for _, negotiated := range status.Negotiated {
+		if negotiated == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCapabilities(caps string) []string {
+	list := make([]string, 0)
+	for _, capability := range strings.Split(caps, ",") {
+		if capability = strings.TrimSpace(capability); capability != "" {
+			list = append(list, capability)
+		}
+	}
+	return list
+}
+
+// to be called with the lock held
+func (peer *Peer) protocol() *ProtocolStatus {
+	status := &ProtocolStatus{
+		Version:      LegacyProtocol,
+		Capabilities: make([]string, 0),
+		Negotiated:   make([]string, 0),
+	}
+
+	if v, found := peer.AdvData.Load("proto"); found {
+		switch num := v.(type) {
+		case float64:
+			status.Version = int(num)
+		case int:
+			status.Version = num
+		}
+	}
+	if v, found := peer.AdvData.Load("grid_version"); found {
+		status.GridVersion, _ = v.(string)
+	}
+	if v, found := peer.AdvData.Load("caps"); found {
+		if caps, ok := v.(string); ok {
+			status.Capabilities = parseCapabilities(caps)
+		}
+	}
+
+	// legacy units only understand plain advertisements
+	if status.Legacy = status.Version <= LegacyProtocol; !status.Legacy {
+		for _, local := range Capabilities {
+			for _, remote := range status.Capabilities {
+				if local == remote {
+					status.Negotiated = append(status.Negotiated, local)
+					break
+				}
+			}
+		}
+	}
+
+	return status
+}
+
+// returns the protocol version and capabilities of the peer
+func (peer *Peer) Protocol() *ProtocolStatus {
+	peer.Lock()
+	defer peer.Unlock()
+	return peer.protocol()
+}
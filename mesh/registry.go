@@ -0,0 +1,60 @@
+package mesh
+
+import (
+	"sync"
+)
+
+// Registry holds the peers currently detected by a router, indexed by fingerprint.
+type Registry struct {
+	peers sync.Map
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (reg *Registry) Load(ident string) (*Peer, bool) {
+	if obj, found := reg.peers.Load(ident); found {
+		return obj.(*Peer), true
+	}
+	return nil, false
+}
+
+func (reg *Registry) Store(ident string, peer *Peer) {
+	reg.peers.Store(ident, peer)
+}
+
+// stores the peer unless another one has been stored with the same fingerprint, in which case that
+// one is returned along with true
+func (reg *Registry) LoadOrStore(ident string, peer *Peer) (*Peer, bool) {
+	obj, loaded := reg.peers.LoadOrStore(ident, peer)
+	return obj.(*Peer), loaded
+}
+
+func (reg *Registry) Delete(ident string) {
+	reg.peers.Delete(ident)
+}
+
+func (reg *Registry) Range(cb func(ident string, peer *Peer) bool) {
+	reg.peers.Range(func(key, value interface{}) bool {
+		return cb(key.(string), value.(*Peer))
+	})
+}
+
+func (reg *Registry) List() []*Peer {
+	list := make([]*Peer, 0)
+	reg.Range(func(ident string, peer *Peer) bool {
+		list = append(list, peer)
+		return true
+	})
+	return list
+}
+
+func (reg *Registry) Size() int {
+	size := 0
+	reg.Range(func(ident string, peer *Peer) bool {
+		size++
+		return true
+	})
+	return size
+}
@@ -2,63 +2,229 @@ package mesh
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/evilsocket/islazy/log"
+	"github.com/evilsocket/pwngrid/metrics"
 	"github.com/evilsocket/pwngrid/wifi"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	Workers = 0
-	PeerTTL = 1800
-	Peers   = sync.Map{}
+	// seconds without frames after which a peer is lost
+	PeerTTL = 300
 )
 
 func dummyPeerActivityCallback(ident string, peer *Peer) {}
 
+func dummyPresenceCallback(ident string, peer *Peer, from PresenceState, to PresenceState) {}
+
 type PeerActivityCallback func(ident string, peer *Peer)
 
+type PresenceCallback func(ident string, peer *Peer, from PresenceState, to PresenceState)
+
 type Router struct {
+	// last time, in nanoseconds, we heard a unit in privacy mode we can't resolve.
+	// First field so that it's 64 bit aligned for atomic operations on 32 bit platforms.
+	unresolvedAt int64
+
+	ctx        context.Context
+	cancel     context.CancelFunc
 	local      *Peer
-	mux        *PacketMuxer
+	ifaces     []string
+	muxes      []*PacketMuxer
+	peers      *Registry
 	onNewPeer  PeerActivityCallback
 	onPeerLost PeerActivityCallback
+	onPresence PresenceCallback
 	memory     *Memory
+	policy     *Policy
+	contacts   *Contacts
+	hopper     *Hopper
+	channels   *Channels
+	fragments  *fragments
+	provers    *provers
+	files      *Files
+	groups     *Groups
+	shouts     *Shouts
+	handlers   messageHandlers
+	// background workers Stop waits for
+	workers sync.WaitGroup
+}
+
+// where the router listens and keeps its state
+type RouterConfig struct {
+	Interfaces   []string
+	PeersPath    string
+	PolicyPath   string
+	ContactsPath string
+	FilesPath    string
+	SharePath    string
+	GroupsPath   string
 }
 
-func StartRouting(iface string, peersPath string, local *Peer) (*Router, error) {
-	err, memory := MemoryFromPath(peersPath)
+func StartRouting(ctx context.Context, config RouterConfig, local *Peer) (*Router, error) {
+	ifaces := config.Interfaces
+	err, memory := MemoryFromPath(config.PeersPath)
 	if err != nil {
 		return nil, err
 	}
 
-	filter := fmt.Sprintf("type mgt subtype beacon and ether src %s", wifi.SignatureAddrStr)
-	mux, err := NewPacketMuxer(iface, filter, Workers)
+	err, policy := PolicyFromPath(config.PolicyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err, contacts := ContactsFromPath(config.ContactsPath)
 	if err != nil {
 		return nil, err
 	}
 
+	channels, err := ParseChannels(HopChannels)
+	if err != nil {
+		return nil, err
+	}
+	schedule := Schedule{Period: HopPeriod, Channels: channels}
+	if err = schedule.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
 	router := &Router{
-		mux:        mux,
+		ctx:        ctx,
+		cancel:     cancel,
+		ifaces:     ifaces,
+		muxes:      make([]*PacketMuxer, 0),
+		peers:      NewRegistry(),
 		local:      local,
 		memory:     memory,
+		policy:     policy,
+		contacts:   contacts,
+		channels:   NewChannels(),
+		fragments:  newFragments(),
+		provers:    newProvers(),
 		onNewPeer:  dummyPeerActivityCallback,
 		onPeerLost: dummyPeerActivityCallback,
+		onPresence: dummyPresenceCallback,
+		handlers: messageHandlers{
+			handlers: make(map[string]MessageHandler),
+			signed:   make(map[string]bool),
+		},
 	}
-	mux.OnPacket(router.onPacket)
-	mux.Start()
 
-	log.Info("started beacon discovery and message routing (%d known peers)", router.memory.Size())
+	router.OnMessage(MessagePublicKeyRequest, router.onPublicKeyRequest)
+	router.OnMessage(MessagePublicKey, router.onPublicKey)
+	router.OnMessage(MessageSnapshotRequest, router.onSnapshotRequest)
+	router.OnSignedMessage(MessagePrivateKey, router.onPrivateKey)
+	router.OnSignedMessage(MessagePrivateAck, router.onPrivateAck)
+	router.OnSignedMessage(MessageProofChallenge, router.onProofChallenge)
+	router.OnSignedMessage(MessageProofResponse, router.onProofResponse)
+	router.OnSignedMessage(MessageProof, router.onProof)
+	local.SealWith(contacts.Seal)
+	local.BlindWith(contacts.Blind)
+
+	if err, router.files = FilesFromPath(config.FilesPath, config.SharePath, router); err != nil {
+		cancel()
+		return nil, err
+	} else if err, router.groups = GroupsFromPath(config.GroupsPath, router); err != nil {
+		cancel()
+		return nil, err
+	}
 
-	go router.peersPruner()
+	router.shouts = NewShouts(router)
+
+	router.hopper = NewHopper(ifaces, local.Keys.FingerprintHex, schedule, router.peersChannels)
+	router.hopper.OnChange(router.onHoppingChange)
+	router.hopper.Recommend(router.recommendedChannel)
+
+	filter := fmt.Sprintf("type mgt subtype beacon and ether src %s", wifi.SignatureAddrStr)
+	for _, iface := range ifaces {
+		mux, err := NewPacketMuxer(iface, filter, Workers)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		// each interface gets its own muxer, packets are tagged with the interface they've been captured from
+		func(iface string) {
+			mux.OnPacket(func(pkt gopacket.Packet) {
+				router.onPacket(iface, pkt)
+			})
+		}(iface)
+		mux.Start(ctx)
+
+		router.muxes = append(router.muxes, mux)
+	}
+
+	router.hopper.Enable(HopEnabled)
+
+	// the advertiser backs off while nobody is around
+	local.DutyCycle().CountPeersWith(router.peers.Size)
+
+	log.Info("started beacon discovery and message routing on %v (%d known peers)", ifaces, router.memory.Size())
+
+	metrics.OnCollect(router.collectMetrics)
+
+	router.spawn(router.peersPruner)
+	router.spawn(router.neighboursWorker)
+	router.spawn(router.privateKeysWorker)
+	router.spawn(router.proofsWorker)
 
 	return router, nil
 }
 
+// stops capturing and every background worker of the router, waiting for the pending packets to be processed
+func (router *Router) Stop() {
+	router.cancel()
+	router.hopper.Enable(false)
+	for _, mux := range router.muxes {
+		mux.Wait()
+	}
+	// no more packets, nothing else can spawn a worker
+	router.workers.Wait()
+}
+
+// runs fn in the background, Stop waits for it to return
+func (router *Router) spawn(fn func()) {
+	if router.ctx.Err() != nil {
+		return
+	}
+	router.workers.Add(1)
+	go func() {
+		defer router.workers.Done()
+		fn()
+	}()
+}
+
+func (router *Router) Close() error {
+	router.Stop()
+	return router.memory.Close()
+}
+
+func (router *Router) Interfaces() []string {
+	return router.ifaces
+}
+
+func (router *Router) Peers() []*Peer {
+	return router.peers.List()
+}
+
+// returns the peer in range with the given fingerprint, or nil
+func (router *Router) Peer(fingerprint string) *Peer {
+	if peer, found := router.peers.Load(fingerprint); found {
+		return peer
+	}
+	return nil
+}
+
 func (router *Router) Memory() []*Peer {
 	return router.memory.List()
 }
@@ -67,6 +233,92 @@ func (router *Router) MemoryOf(fingerprint string) *Peer {
 	return router.memory.Of(fingerprint)
 }
 
+func (router *Router) Forget(fingerprint string) bool {
+	return router.memory.Forget(fingerprint)
+}
+
+func (router *Router) CompactMemory() (int, error) {
+	removed := router.memory.Compact()
+	return removed, router.memory.Flush()
+}
+
+func (router *Router) EncountersOf(fingerprint string, from, to time.Time) ([]*Encounter, error) {
+	return router.memory.Encounters(fingerprint, from, to)
+}
+
+func (router *Router) Policy() *Policy {
+	return router.policy
+}
+
+func (router *Router) Contacts() *Contacts {
+	return router.contacts
+}
+
+func (router *Router) Hopper() *Hopper {
+	return router.hopper
+}
+
+func (router *Router) Files() *Files {
+	return router.files
+}
+
+func (router *Router) Groups() *Groups {
+	return router.groups
+}
+
+func (router *Router) Shouts() *Shouts {
+	return router.shouts
+}
+
+// returns the channel statistics and the best rendezvous channel among the hopping ones
+func (router *Router) Channels() *ChannelsReport {
+	return router.channels.Report(router.hopper.Schedule().Channels)
+}
+
+func (router *Router) recommendedChannel() int {
+	return router.channels.Best(router.hopper.Schedule().Channels)
+}
+
+// returns the channels where peers are currently being detected
+func (router *Router) peersChannels() []int {
+	unique := make(map[int]bool)
+	router.peers.Range(func(ident string, peer *Peer) bool {
+		peer.Lock()
+		if peer.Channel > 0 {
+			unique[peer.Channel] = true
+		}
+		peer.Unlock()
+		return true
+	})
+
+	channels := make([]int, 0, len(unique))
+	for ch := range unique {
+		channels = append(channels, ch)
+	}
+	sort.Ints(channels)
+	return channels
+}
+
+// advertise the schedule we're following so that neighbours can align to it
+func (router *Router) onHoppingChange(enabled bool, schedule Schedule) {
+	if enabled {
+		router.local.setData(map[string]interface{}{
+			"hopping": schedule,
+		})
+	} else {
+		router.local.setData(map[string]interface{}{
+			"hopping": nil,
+		})
+	}
+}
+
+func (router *Router) onPeerSchedule(ident string, peer *Peer, adv *Advertisement) {
+	// anyone can claim a low fingerprint, only follow units that proved to own it
+	if adv.Hopping != nil && router.hopper.Leads(ident) && router.authenticate(ident, peer) {
+		router.hopper.Align(ident, *adv.Hopping)
+	}
+}
+
 func (router *Router) OnNewPeer(cb PeerActivityCallback) {
 	router.onNewPeer = cb
 }
@@ -75,86 +327,255 @@ func (router *Router) OnPeerLost(cb PeerActivityCallback) {
 	router.onPeerLost = cb
 }
 
-func (router *Router) peersPruner() {
-	period := time.Duration(500) * time.Millisecond
-	tick := time.NewTicker(period)
+func (router *Router) OnPresenceChange(cb PresenceCallback) {
+	router.onPresence = cb
+}
 
-	log.Debug("peers pruner started with a %s period", period)
+// evaluates the presence state of a peer, if lost it's removed
+func (router *Router) checkPresence(ident string, peer *Peer, now time.Time) {
+	from, to, changed := peer.updatePresence(now)
+	if !changed {
+		return
+	}
+
+	log.Debug("peer %s is %s (was %s)", ident, to, from)
+
+	if router.policy.Check(ident, peer.SessionIDStr, peer.Authenticated()) != PolicyMute {
+		router.onPresence(ident, peer, from, to)
+	}
 
-	for _ = range tick.C {
-		stale := map[string]*Peer{}
+	if to == PresenceLost {
+		router.lostPeer(ident, peer)
+	}
+}
+
+// returns a channel ticking every period until the router is stopped, then it's closed
+func (router *Router) ticker(period time.Duration) <-chan time.Time {
+	out := make(chan time.Time)
+	go func() {
+		tick := time.NewTicker(period)
+		defer tick.Stop()
+		defer close(out)
 
-		Peers.Range(func(key, value interface{}) bool {
-			ident := key.(string)
-			peer := value.(*Peer)
-			inactive := peer.InactiveFor()
-			if int(inactive) > PeerTTL {
-				stale[ident] = peer
+		for {
+			select {
+			case now := <-tick.C:
+				select {
+				case out <- now:
+				case <-router.ctx.Done():
+					return
+				}
+			case <-router.ctx.Done():
+				return
 			}
+		}
+	}()
+	return out
+}
+
+func (router *Router) peersPruner() {
+	period := time.Duration(500) * time.Millisecond
+	log.Debug("peers pruner started with a %s period", period)
+
+	for now := range router.ticker(period) {
+		peers := map[string]*Peer{}
+		router.peers.Range(func(ident string, peer *Peer) bool {
+			peers[ident] = peer
 			return true
 		})
 
-		for ident, peer := range stale {
-			Peers.Delete(ident)
-			router.onPeerLost(ident, peer)
+		for ident, peer := range peers {
+			router.checkPresence(ident, peer, now)
 		}
 	}
 }
 
+// called once the peer has been stored in the registry
 func (router *Router) newPeer(ident string, peer *Peer) {
-	Peers.Store(ident, peer)
-	router.onNewPeer(ident, peer)
+	if proto := peer.Protocol(); proto.Version > ProtocolVersion {
+		log.Warning("peer %s speaks protocol v%d, newer than v%d", ident, proto.Version, ProtocolVersion)
+	} else {
+		log.Debug("peer %s speaks protocol v%d, negotiated %v", ident, proto.Version, proto.Negotiated)
+	}
+
+	router.local.DutyCycle().Boost()
+	if router.policy.Check(ident, peer.SessionIDStr, peer.Authenticated()) != PolicyMute {
+		router.announce(ident, peer)
+	}
 }
 
-func (router *Router) onPeerAdvertisement(pkt gopacket.Packet, radio *layers.RadioTap, dot11 *layers.Dot11) {
+// triggers the new peer event only once per peer
+func (router *Router) announce(ident string, peer *Peer) {
+	peer.Lock()
+	announced := peer.announced
+	peer.announced = true
+	peer.Unlock()
+
+	if !announced {
+		router.onNewPeer(ident, peer)
+	}
+}
+
+func (router *Router) lostPeer(ident string, peer *Peer) {
+	router.peers.Delete(ident)
+	router.hopper.Forget(ident)
+	if err := router.memory.Lost(ident); err != nil {
+		log.Error("error saving peer encounter for %s: %v", ident, err)
+	}
+	if router.policy.Check(ident, peer.SessionIDStr, peer.Authenticated()) != PolicyMute {
+		router.onPeerLost(ident, peer)
+	}
+}
+
+// any frame can claim any fingerprint, when it's denied because of its session id the registered peer
+// is only evicted if it authenticated on that same session, otherwise only the fingerprint counts
+func (router *Router) evictable(ident string, sessionID string, peer *Peer) bool {
+	peer.Lock()
+	authenticated := peer.authenticated
+	onSession := authenticated && peer.SessionIDStr == sessionID
+	peer.Unlock()
+
+	return onSession || router.policy.Check(ident, "", authenticated) == PolicyDeny
+}
+
+func (router *Router) onPeerAdvertisement(iface string, pkt gopacket.Packet, radio *layers.RadioTap, dot11 *layers.Dot11) {
 	err, payload := wifi.Unpack(pkt, radio, dot11)
 	if err != nil {
 		log.Debug("%v", err)
+		advRejected.Inc("unpack")
 		return
 	}
 
 	advData := make(map[string]interface{})
 	if err := json.Unmarshal(payload, &advData); err != nil {
 		log.Debug("error decoding payload '%s': %v", payload, err)
+		advRejected.Inc("decode")
+		return
+	}
+
+	advData, dropped := ValidateRemote(advData)
+	if len(dropped) > 0 {
+		log.Debug("dropped invalid advertisement fields %v from %x", dropped, dot11.Address3)
+	}
+
+	adv, err := AdvertisementOf(advData)
+	if err != nil {
+		log.Debug("error decoding advertisement '%s': %v", payload, err)
+		advRejected.Inc("decode")
 		return
 	}
 
-	ident, ok := advData["identity"]
-	if !ok {
+	sessionID := net.HardwareAddr(dot11.Address3).String()
+	private := map[string]interface{}(nil)
+
+	// units in privacy mode only advertise an identity blinded with the session id
+	if adv.Blinded != "" {
+		contact := router.contacts.Resolve(dot11.Address3, adv.Blinded)
+		if contact == nil {
+			log.Debug("ignoring private advertisement from %s", sessionID)
+			atomic.StoreInt64(&router.unresolvedAt, time.Now().UnixNano())
+			advRejected.Inc("private")
+			return
+		}
+		adv.Identity = contact.Fingerprint
+		advData["identity"] = contact.Fingerprint
+
+		if adv.Private != "" {
+			if private, err = router.openPrivate(contact, adv.Private); err != nil {
+				log.Debug("can't read the private advertisement of %s: %v", contact.Fingerprint, err)
+			} else {
+				for key, value := range private {
+					advData[key] = value
+				}
+				if adv, err = AdvertisementOf(advData); err != nil {
+					log.Debug("error decoding private advertisement of %s: %v", contact.Fingerprint, err)
+					advRejected.Inc("decode")
+					return
+				}
+			}
+		}
+
+		if adv.Name == "" && contact.Name != "" {
+			advData["name"] = contact.Name
+		}
+	}
+	delete(advData, PrivateField)
+
+	ident := adv.Identity
+	if ident == "" {
 		log.Debug("error parsing identity from payload '%s'", payload)
+		advRejected.Inc("identity")
+		return
+	}
+
+	peer, existing := router.peers.Load(ident)
+	if router.policy.Check(ident, sessionID, existing && peer.Authenticated()) == PolicyDeny {
+		log.Debug("dropping advertisement of denied peer %s (%s)", ident, sessionID)
+		if existing && router.evictable(ident, sessionID, peer) {
+			router.lostPeer(ident, peer)
+		}
+		advRejected.Inc("denied")
 		return
 	}
 
-	var peer *Peer
+	if !existing {
+		created, err := NewPeer(iface, radio, dot11, advData)
+		if err != nil {
+			log.Debug("error creating peer: %v", err)
+			advRejected.Inc("invalid")
+			return
+		}
+		// another interface might have heard the same beacon in the meantime
+		if peer, existing = router.peers.LoadOrStore(ident, created); !existing {
+			if err := router.memory.Track(ident, peer); err != nil {
+				log.Error("error saving peer encounter for %s: %v", ident, err)
+			}
+			router.newPeer(ident, peer)
+		}
+	}
 
-	_peer, existing := Peers.Load(ident)
 	if existing {
-		peer = _peer.(*Peer)
-		if err := peer.Update(radio, dot11, advData); err != nil {
+		if err := peer.Update(iface, radio, dot11, advData); err != nil {
 			log.Warning("error updating peer %s: %v", peer.ID(), err)
-		} else if err := router.memory.Track(ident.(string), peer); err != nil {
-			log.Error("error saving peer encounter for %s: %v", ident, err)
-		}
-	} else {
-		if peer, err = NewPeer(radio, dot11, advData); err != nil {
-			log.Debug("error creating peer: %v", err)
+			advRejected.Inc("invalid")
 			return
-		} else if err := router.memory.Track(ident.(string), peer); err != nil {
+		} else if err := router.memory.Track(ident, peer); err != nil {
 			log.Error("error saving peer encounter for %s: %v", ident, err)
-		} else {
-			router.newPeer(ident.(string), peer)
 		}
+		router.checkPresence(ident, peer, time.Now())
+	}
+
+	if private != nil {
+		peer.setPrivate(private)
 	}
 
+	// allowed peers are muted until their key is verified
+	if router.policy.Allowed(ident) {
+		router.authenticate(ident, peer)
+	}
+
+	advParsed.Inc()
+	router.requestSnapshot(ident, peer)
+	router.onPeerSchedule(ident, peer, adv)
 }
 
-func (router *Router) onPacket(pkt gopacket.Packet) {
+func (router *Router) onPacket(iface string, pkt gopacket.Packet) {
 	if ok, radio, dot11 := wifi.Parse(pkt); ok && dot11.ChecksumValid() {
 		src := dot11.Address3
 		dst := dot11.Address1
-		if !bytes.Equal(src, router.local.SessionID) {
+		if !router.local.IsSession(src) {
+			rate := 0.0
+			if radio.Present.Rate() {
+				// radiotap rates are in 500Kbps units
+				rate = float64(radio.Rate) / 2
+			}
+			router.channels.Seen(time.Now(), wifi.Freq2Chan(int(radio.ChannelFrequency)),
+				net.HardwareAddr(src).String(), int(radio.DBMAntennaSignal), len(pkt.Data())-int(radio.Length), rate)
+
 			if bytes.Equal(dst, wifi.BroadcastAddr) {
-				router.onPeerAdvertisement(pkt, radio, dot11)
+				router.onPeerAdvertisement(iface, pkt, radio, dot11)
+			} else if router.local.IsSession(dst) || bytes.Equal(dst, wifi.MulticastAddr) {
+				router.onMessage(pkt, radio, dot11)
 			} else {
 				// log.Debug("ignoring message %x > %x", src, dst)
 			}
@@ -0,0 +1,285 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+)
+
+type FieldType string
+
+const (
+	FieldString  FieldType = "string"
+	FieldInteger FieldType = "integer"
+	FieldBoolean FieldType = "boolean"
+	FieldObject  FieldType = "object"
+)
+
+// key of the extension namespace, plugins can advertise their own fields inside of it
+const ExtField = "ext"
+
+var (
+	// maximum encoded size in bytes of a single extension field
+	ExtFieldBudget = 256
+	// maximum encoded size in bytes of the whole extension namespace
+	ExtBudget = 1024
+
+	extKeyParser = regexp.MustCompile(`^[a-z0-9_\-]{1,32}$`)
+)
+
+// FieldSpec describes the type and constraints of an advertisement field.
+type FieldSpec struct {
+	Name        string    `json:"name"`
+	Type        FieldType `json:"type"`
+	Description string    `json:"description"`
+	// maximum length in characters for strings, in encoded bytes for objects
+	MaxLength int      `json:"max_length,omitempty"`
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	// set by pwngrid itself, can't be changed with SetData
+	ReadOnly bool `json:"read_only,omitempty"`
+	// fields with lower priority are the first to be left out when the advertisement doesn't fit a frame
+	Priority Priority `json:"priority"`
+
+	pattern *regexp.Regexp
+}
+
+type ExtSpec struct {
+	Field       string `json:"field"`
+	KeyPattern  string `json:"key_pattern"`
+	FieldBudget int    `json:"field_budget"`
+	Budget      int    `json:"budget"`
+}
+
+type Schema struct {
+	Fields []*FieldSpec `json:"fields"`
+	Ext    ExtSpec      `json:"ext"`
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+var fields = map[string]*FieldSpec{}
+
+func init() {
+	for _, spec := range []*FieldSpec{
+		{Name: "identity", Type: FieldString, Pattern: "^[a-fA-F0-9]{64}$", ReadOnly: true, Priority: PriorityRequired, Description: "Fingerprint of the unit public key."},
+		{Name: "session_id", Type: FieldString, Pattern: "^([a-f0-9]{2}:){5}[a-f0-9]{2}$", ReadOnly: true, Priority: PriorityRequired, Description: "Current mesh session id."},
+		{Name: "public_key", Type: FieldString, MaxLength: 2048, ReadOnly: true, Priority: PriorityLow, Description: "Base64 encoded PEM public key."},
+		{Name: "blinded", Type: FieldString, MaxLength: 128, ReadOnly: true, Priority: PriorityRequired, Description: "Identity blinded with the session id, in privacy mode."},
+		{Name: "timestamp", Type: FieldInteger, Min: bound(0), ReadOnly: true, Priority: PriorityRequired, Description: "Unix time the advertisement has been sent at."},
+		{Name: AdvMetaField, Type: FieldObject, MaxLength: 512, ReadOnly: true, Priority: PriorityRequired, Description: "Version of the advertisement data and delta information."},
+		{Name: PrivateField, Type: FieldString, MaxLength: 4096, Pattern: "^[0-9]+:[A-Za-z0-9+/=]+$", ReadOnly: true, Priority: PriorityRequired, Description: "Fields encrypted with a key shared with contacts, prefixed by the key epoch."},
+		{Name: "grid_version", Type: FieldString, MaxLength: 16, ReadOnly: true, Priority: PriorityHigh, Description: "Version of pwngrid."},
+		{Name: "proto", Type: FieldInteger, Min: bound(1), ReadOnly: true, Priority: PriorityHigh, Description: "Version of the mesh protocol."},
+		{Name: "caps", Type: FieldString, MaxLength: 128, Pattern: "^[a-z0-9_]+(,[a-z0-9_]+)*$", ReadOnly: true, Priority: PriorityHigh, Description: "Comma separated capabilities of the unit."},
+		{Name: "hopping", Type: FieldObject, MaxLength: 512, ReadOnly: true, Priority: PriorityHigh, Description: "Channel hopping schedule followed by the unit."},
+		{Name: "name", Type: FieldString, MaxLength: 64, Priority: PriorityHigh, Description: "Name of the unit."},
+		{Name: "version", Type: FieldString, MaxLength: 16, Priority: PriorityNormal, Description: "Version of pwnagotchi."},
+		{Name: "face", Type: FieldString, MaxLength: 32, Priority: PriorityNormal, Description: "Current face of the unit."},
+		{Name: "pwnd_run", Type: FieldInteger, Min: bound(0), Priority: PriorityNormal, Description: "Handshakes captured in the current session."},
+		{Name: "pwnd_tot", Type: FieldInteger, Min: bound(0), Priority: PriorityNormal, Description: "Handshakes captured since the unit was created."},
+		{Name: "uptime", Type: FieldInteger, Min: bound(0), Priority: PriorityNormal, Description: "Uptime of the unit in seconds."},
+		{Name: "epoch", Type: FieldInteger, Min: bound(0), Priority: PriorityNormal, Description: "Current epoch of the unit."},
+		{Name: "policy", Type: FieldObject, MaxLength: 1024, Priority: PriorityLow, Description: "Personality parameters of the unit."},
+		{Name: "tx_power", Type: FieldInteger, Min: bound(-100), Max: bound(0), Priority: PriorityNormal, Description: "Calibrated RSSI at one meter from the unit."},
+		{Name: NeighboursField, Type: FieldString, MaxLength: 1024, Pattern: "^[a-f0-9]{8}[0-9](,[a-f0-9]{8}[0-9])*$", ReadOnly: true, Priority: PriorityLow, Description: "Truncated fingerprints of the peers seen by the unit, each followed by its RSSI bucket."},
+		{Name: ExtField, Type: FieldObject, Priority: PriorityLow, Description: "Extension namespace for plugin fields."},
+	} {
+		AddField(spec)
+	}
+}
+
+// registers or replaces the specification of an advertisement field
+func AddField(spec *FieldSpec) {
+	if spec.Priority == 0 {
+		spec.Priority = PriorityNormal
+	}
+	if spec.Pattern != "" {
+		spec.pattern = regexp.MustCompile(spec.Pattern)
+	}
+	fields[spec.Name] = spec
+}
+
+func FieldOf(name string) *FieldSpec {
+	return fields[name]
+}
+
+func GetSchema() *Schema {
+	schema := &Schema{
+		Fields: make([]*FieldSpec, 0, len(fields)),
+		Ext: ExtSpec{
+			Field:       ExtField,
+			KeyPattern:  extKeyParser.String(),
+			FieldBudget: ExtFieldBudget,
+			Budget:      ExtBudget,
+		},
+	}
+	for _, spec := range fields {
+		schema.Fields = append(schema.Fields, spec)
+	}
+	sort.Slice(schema.Fields, func(i, j int) bool {
+		return schema.Fields[i].Name < schema.Fields[j].Name
+	})
+	return schema
+}
+
+// converts a value to its generic JSON representation, returns it with its encoded form
+func normalize(value interface{}) (interface{}, []byte, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	var generic interface{}
+	if err = json.Unmarshal(raw, &generic); err != nil {
+		return nil, nil, err
+	}
+	return generic, raw, nil
+}
+
+// checks a value against the field specification, returns its normalized form
+func (spec *FieldSpec) Validate(value interface{}) (interface{}, error) {
+	value, raw, err := normalize(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", spec.Name, err)
+	}
+
+	switch spec.Type {
+	case FieldString:
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a string", spec.Name)
+		} else if spec.MaxLength > 0 && utf8.RuneCountInString(str) > spec.MaxLength {
+			return nil, fmt.Errorf("%s can't be longer than %d characters", spec.Name, spec.MaxLength)
+		} else if spec.pattern != nil && !spec.pattern.MatchString(str) {
+			return nil, fmt.Errorf("%s must match %s", spec.Name, spec.Pattern)
+		}
+
+	case FieldInteger:
+		num, ok := value.(float64)
+		if !ok || num != math.Trunc(num) {
+			return nil, fmt.Errorf("%s must be an integer", spec.Name)
+		} else if spec.Min != nil && num < *spec.Min {
+			return nil, fmt.Errorf("%s can't be lower than %v", spec.Name, *spec.Min)
+		} else if spec.Max != nil && num > *spec.Max {
+			return nil, fmt.Errorf("%s can't be greater than %v", spec.Name, *spec.Max)
+		}
+
+	case FieldBoolean:
+		if _, ok := value.(bool); !ok {
+			return nil, fmt.Errorf("%s must be a boolean", spec.Name)
+		}
+
+	case FieldObject:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be an object", spec.Name)
+		} else if spec.MaxLength > 0 && len(raw) > spec.MaxLength {
+			return nil, fmt.Errorf("%s can't be bigger than %d bytes", spec.Name, spec.MaxLength)
+		} else if spec.Name == ExtField {
+			return validateExt(obj)
+		}
+	}
+
+	return value, nil
+}
+
+func validateExt(ext map[string]interface{}) (interface{}, error) {
+	total := 0
+	for key, value := range ext {
+		if !extKeyParser.MatchString(key) {
+			return nil, fmt.Errorf("invalid extension field name '%s'", key)
+		}
+		raw, _ := json.Marshal(value)
+		if len(raw) > ExtFieldBudget {
+			return nil, fmt.Errorf("extension field %s is %d bytes, the budget is %d", key, len(raw), ExtFieldBudget)
+		}
+		total += len(raw)
+	}
+	if total > ExtBudget {
+		return nil, fmt.Errorf("extension fields are %d bytes, the budget is %d", total, ExtBudget)
+	}
+	return ext, nil
+}
+
+// validates the fields to be set locally, nil values delete a field. Read only fields are
+// ignored, unknown ones are refused and should be moved to the extension namespace.
+func ValidateLocal(data map[string]interface{}) (map[string]interface{}, error) {
+	valid := make(map[string]interface{})
+	for key, value := range data {
+		spec := fields[key]
+		if spec == nil {
+			return nil, fmt.Errorf("unknown field %s, plugin fields must be set inside '%s'", key, ExtField)
+		} else if spec.ReadOnly {
+			continue
+		} else if value == nil {
+			valid[key] = nil
+		} else if value, err := spec.Validate(value); err != nil {
+			return nil, err
+		} else {
+			valid[key] = value
+		}
+	}
+	return valid, nil
+}
+
+// validates the fields of a received or stored advertisement, unknown and invalid fields are
+// dropped and their names returned.
+func ValidateRemote(data map[string]interface{}) (map[string]interface{}, []string) {
+	valid := make(map[string]interface{})
+	dropped := make([]string, 0)
+	for key, value := range data {
+		if spec := fields[key]; spec == nil || value == nil {
+			dropped = append(dropped, key)
+		} else if value, err := spec.Validate(value); err != nil {
+			dropped = append(dropped, key)
+		} else {
+			valid[key] = value
+		}
+	}
+	sort.Strings(dropped)
+	return valid, dropped
+}
+
+// Advertisement is the typed view of the known advertisement fields.
+type Advertisement struct {
+	Identity    string                 `json:"identity"`
+	SessionID   string                 `json:"session_id,omitempty"`
+	PublicKey   string                 `json:"public_key,omitempty"`
+	Blinded     string                 `json:"blinded,omitempty"`
+	Timestamp   int64                  `json:"timestamp,omitempty"`
+	GridVersion string                 `json:"grid_version,omitempty"`
+	Proto       int                    `json:"proto,omitempty"`
+	Caps        string                 `json:"caps,omitempty"`
+	Hopping     *Schedule              `json:"hopping,omitempty"`
+	Name        string                 `json:"name,omitempty"`
+	Version     string                 `json:"version,omitempty"`
+	Face        string                 `json:"face,omitempty"`
+	PwndRun     int                    `json:"pwnd_run,omitempty"`
+	PwndTot     int                    `json:"pwnd_tot,omitempty"`
+	Uptime      int                    `json:"uptime,omitempty"`
+	Epoch       int                    `json:"epoch,omitempty"`
+	Policy      map[string]interface{} `json:"policy,omitempty"`
+	TxPower     int                    `json:"tx_power,omitempty"`
+	Neighbours  string                 `json:"nbrs,omitempty"`
+	Private     string                 `json:"priv,omitempty"`
+	Ext         map[string]interface{} `json:"ext,omitempty"`
+}
+
+// converts validated advertisement data to its typed form
+func AdvertisementOf(data map[string]interface{}) (*Advertisement, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var adv Advertisement
+	if err = json.Unmarshal(raw, &adv); err != nil {
+		return nil, err
+	}
+	return &adv, nil
+}
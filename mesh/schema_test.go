@@ -0,0 +1,115 @@
+package mesh
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFieldValidate(t *testing.T) {
+	tests := []struct {
+		field string
+		value interface{}
+		valid bool
+	}{
+		{"name", "alpha", true},
+		{"name", 42, false},
+		{"name", strings.Repeat("x", 65), false},
+		{"identity", strings.Repeat("a", 64), true},
+		{"identity", strings.Repeat("a", 63), false},
+		{"identity", strings.Repeat("g", 64), false},
+		{"session_id", "aa:bb:cc:dd:ee:ff", true},
+		{"session_id", "AA:BB:CC:DD:EE:FF", false},
+		{"pwnd_tot", 10, true},
+		{"pwnd_tot", 1.5, false},
+		{"pwnd_tot", -1, false},
+		{"pwnd_tot", "10", false},
+		{"tx_power", -45, true},
+		{"tx_power", 10, false},
+		{"tx_power", -101, false},
+		{"policy", map[string]interface{}{"a": 1}, true},
+		{"policy", "nope", false},
+		{"policy", map[string]interface{}{"a": strings.Repeat("x", 1024)}, false},
+		{ExtField, map[string]interface{}{"plugin": "x"}, true},
+		{ExtField, map[string]interface{}{"Plugin!": "x"}, false},
+		{ExtField, map[string]interface{}{"plugin": strings.Repeat("x", ExtFieldBudget)}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.field, func(t *testing.T) {
+			_, err := FieldOf(test.field).Validate(test.value)
+			if test.valid && err != nil {
+				t.Fatalf("expected %v to be valid, got %v", test.value, err)
+			} else if !test.valid && err == nil {
+				t.Fatalf("expected %v to be invalid", test.value)
+			}
+		})
+	}
+}
+
+func TestValidateLocal(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  map[string]interface{}
+		valid map[string]interface{}
+		err   bool
+	}{
+		{
+			name:  "known fields",
+			data:  map[string]interface{}{"name": "alpha", "uptime": 10},
+			valid: map[string]interface{}{"name": "alpha", "uptime": float64(10)},
+		},
+		{
+			name:  "read only fields are ignored",
+			data:  map[string]interface{}{"name": "alpha", "identity": strings.Repeat("a", 64)},
+			valid: map[string]interface{}{"name": "alpha"},
+		},
+		{
+			name:  "nil deletes",
+			data:  map[string]interface{}{"face": nil},
+			valid: map[string]interface{}{"face": nil},
+		},
+		{
+			name: "unknown field",
+			data: map[string]interface{}{"plugin_field": 1},
+			err:  true,
+		},
+		{
+			name: "invalid value",
+			data: map[string]interface{}{"uptime": -1},
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			valid, err := ValidateLocal(test.data)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if !reflect.DeepEqual(valid, test.valid) {
+				t.Fatalf("expected %v, got %v", test.valid, valid)
+			}
+		})
+	}
+}
+
+func TestValidateRemote(t *testing.T) {
+	valid, dropped := ValidateRemote(map[string]interface{}{
+		"name":     "alpha",
+		"uptime":   "not a number",
+		"unknown":  1,
+		"face":     nil,
+		"pwnd_tot": 3,
+	})
+
+	expected := map[string]interface{}{"name": "alpha", "pwnd_tot": float64(3)}
+	if !reflect.DeepEqual(valid, expected) {
+		t.Fatalf("expected %v, got %v", expected, valid)
+	} else if !reflect.DeepEqual(dropped, []string{"face", "unknown", "uptime"}) {
+		t.Fatalf("unexpected dropped fields %v", dropped)
+	}
+}
@@ -0,0 +1,281 @@
+package mesh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/evilsocket/islazy/log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const MessageShout = "shout"
+
+var (
+	// maximum length in characters of a shout
+	ShoutMaxSize = 140
+	// default lifetime in seconds of a shout
+	ShoutTTL = 3600
+	// period in seconds for our active shouts to be broadcast
+	ShoutPeriod = 15
+	// minimum time in seconds between two of our shouts
+	ShoutMinInterval = 60
+	// how many shouts of the same author are kept in the feed
+	ShoutMaxPerAuthor = 5
+	// if true the feed is sent to the server with the unit data
+	ShoutRelay = false
+)
+
+// Shout is a short public status message signed by its author.
+type Shout struct {
+	ID         string    `json:"id"`
+	Author     string    `json:"author"`
+	Name       string    `json:"name,omitempty"`
+	Text       string    `json:"text"`
+	CreatedAt  time.Time `json:"created_at"`
+	TTL        int       `json:"ttl"`
+	Signature  []byte    `json:"signature"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+func (shout *Shout) signed() []byte {
+	return []byte(fmt.Sprintf("%s:%s:%d:%d:%s", shout.Author, shout.Name, shout.CreatedAt.Unix(), shout.TTL, shout.Text))
+}
+
+func (shout *Shout) ExpiresAt() time.Time {
+	return shout.CreatedAt.Add(time.Duration(shout.TTL) * time.Second)
+}
+
+func (shout *Shout) expired(now time.Time) bool {
+	return now.After(shout.ExpiresAt())
+}
+
+func shoutID(shout *Shout) string {
+	hash := sha256.Sum256(shout.signed())
+	return hex.EncodeToString(hash[:8])
+}
+
+type ShoutCallback func(shout *Shout)
+
+// Shouts is the feed of public messages from nearby units, ours included.
+type Shouts struct {
+	sync.Mutex
+	router    *Router
+	feed      map[string]*Shout
+	lastShout time.Time
+	onShout   ShoutCallback
+}
+
+func NewShouts(router *Router) *Shouts {
+	shouts := &Shouts{
+		router:  router,
+		feed:    make(map[string]*Shout),
+		onShout: func(*Shout) {},
+	}
+
+	router.OnMessage(MessageShout, shouts.onMessage)
+
+	router.spawn(shouts.worker)
+
+	return shouts
+}
+
+// sets a callback for every new shout added to the feed
+func (shouts *Shouts) OnShout(cb ShoutCallback) {
+	shouts.Lock()
+	defer shouts.Unlock()
+	shouts.onShout = cb
+}
+
+// returns the shouts that are not expired yet, newest first
+func (shouts *Shouts) Feed() []*Shout {
+	shouts.Lock()
+	defer shouts.Unlock()
+
+	now := time.Now()
+	list := make([]*Shout, 0, len(shouts.feed))
+	for _, shout := range shouts.feed {
+		if !shout.expired(now) {
+			copied := *shout
+			list = append(list, &copied)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
+
+func (shouts *Shouts) Shout(text string, ttl int) (*Shout, error) {
+	if PrivacyMode || PrivateAdvertisements {
+		return nil, fmt.Errorf("can't shout in privacy mode")
+	} else if text = strings.TrimSpace(text); text == "" {
+		return nil, fmt.Errorf("shout can't be empty")
+	} else if utf8.RuneCountInString(text) > ShoutMaxSize {
+		return nil, fmt.Errorf("max shout size is %d", ShoutMaxSize)
+	}
+
+	if ttl <= 0 || ttl > ShoutTTL {
+		ttl = ShoutTTL
+	}
+
+	shouts.Lock()
+	if wait := time.Duration(ShoutMinInterval)*time.Second - time.Since(shouts.lastShout); wait > 0 {
+		shouts.Unlock()
+		return nil, fmt.Errorf("rate limited, try again in %s", wait.Round(time.Second))
+	}
+	shouts.Unlock()
+
+	local := shouts.router.local
+	name, _ := local.AdvData.Load("name")
+	nameStr, _ := name.(string)
+
+	now := time.Now()
+	shout := &Shout{
+		Author:     local.Keys.FingerprintHex,
+		Name:       nameStr,
+		Text:       text,
+		CreatedAt:  now,
+		TTL:        ttl,
+		ReceivedAt: now,
+	}
+	shout.ID = shoutID(shout)
+
+	var err error
+	if shout.Signature, err = local.Keys.SignMessage(shout.signed()); err != nil {
+		return nil, err
+	}
+
+	shouts.Lock()
+	shouts.lastShout = now
+	shouts.add(shout)
+	shouts.Unlock()
+
+	log.Info("shouting '%s' for %ds", text, ttl)
+
+	shouts.broadcast(shout)
+
+	copied := *shout
+	return &copied, nil
+}
+
+// retracts one of our shouts, returns false if not found
+func (shouts *Shouts) Remove(id string) bool {
+	shouts.Lock()
+	defer shouts.Unlock()
+
+	if shout, found := shouts.feed[id]; found && shout.Author == shouts.router.local.Keys.FingerprintHex {
+		delete(shouts.feed, id)
+		log.Info("shout %s removed", id)
+		return true
+	}
+	return false
+}
+
+// to be called with the lock held
+func (shouts *Shouts) add(shout *Shout) {
+	shouts.feed[shout.ID] = shout
+
+	// only keep the most recent shouts of each author
+	byAuthor := make([]*Shout, 0)
+	for _, s := range shouts.feed {
+		if s.Author == shout.Author {
+			byAuthor = append(byAuthor, s)
+		}
+	}
+	if excess := len(byAuthor) - ShoutMaxPerAuthor; excess > 0 {
+		sort.Slice(byAuthor, func(i, j int) bool {
+			return byAuthor[i].CreatedAt.Before(byAuthor[j].CreatedAt)
+		})
+		for _, s := range byAuthor[:excess] {
+			delete(shouts.feed, s.ID)
+		}
+	}
+
+	go shouts.onShout(shout)
+}
+
+func (shouts *Shouts) broadcast(shout *Shout) {
+	if err := shouts.router.Broadcast(MessageShout, shout); err != nil {
+		log.Error("error broadcasting shout %s: %v", shout.ID, err)
+	}
+}
+
+func (shouts *Shouts) onMessage(ident string, peer *Peer, msg *Message) {
+	var shout Shout
+	if err := json.Unmarshal(msg.Body, &shout); err != nil {
+		log.Debug("error decoding shout from %s: %v", ident, err)
+		return
+	} else if shout.Author != ident {
+		log.Debug("ignoring shout of %s relayed by %s", shout.Author, ident)
+		return
+	}
+
+	now := time.Now()
+	if shout.expired(now) || shout.TTL > ShoutTTL || shout.CreatedAt.After(now.Add(time.Minute)) ||
+		utf8.RuneCountInString(shout.Text) > ShoutMaxSize || shout.ID != shoutID(&shout) {
+		log.Debug("ignoring invalid shout from %s", ident)
+		return
+	}
+
+	shouts.Lock()
+	_, found := shouts.feed[shout.ID]
+	shouts.Unlock()
+	if found {
+		return
+	}
+
+	// the public key is requested if not known yet, the author will broadcast the shout again
+	keys := shouts.router.PublicKeyOf(ident)
+	if keys == nil {
+		return
+	} else if err := keys.VerifyMessage(shout.signed(), shout.Signature); err != nil {
+		log.Warning("invalid signature for shout %s from %s", shout.ID, ident)
+		return
+	}
+
+	shout.ReceivedAt = now
+
+	shouts.Lock()
+	defer shouts.Unlock()
+
+	if _, found := shouts.feed[shout.ID]; !found {
+		log.Info("%s shouted '%s'", ident, shout.Text)
+		shouts.add(&shout)
+	}
+}
+
+// periodically broadcasts our active shouts and prunes the expired ones
+func (shouts *Shouts) worker() {
+	period := time.Duration(ShoutPeriod) * time.Second
+	self := shouts.router.local.Keys.FingerprintHex
+
+	log.Debug("shouts worker started with a %s period", period)
+
+	for now := range shouts.router.ticker(period) {
+		active := make([]*Shout, 0)
+
+		shouts.Lock()
+		for id, shout := range shouts.feed {
+			if shout.expired(now) {
+				delete(shouts.feed, id)
+			} else if shout.Author == self {
+				active = append(active, shout)
+			}
+		}
+		shouts.Unlock()
+
+		// nobody to shout to
+		if shouts.router.peers.Size() == 0 {
+			continue
+		}
+
+		for _, shout := range active {
+			shouts.broadcast(shout)
+		}
+	}
+}
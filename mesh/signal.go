@@ -0,0 +1,165 @@
+package mesh
+
+import (
+	"math"
+	"time"
+)
+
+type Proximity string
+
+const (
+	ProximityImmediate Proximity = "immediate"
+	ProximityNear      Proximity = "near"
+	ProximityFar       Proximity = "far"
+)
+
+var (
+	// RSSI measured at one meter from this unit, advertised as tx_power if not 0
+	TxPower = 0
+	// RSSI at one meter assumed for peers not advertising their own calibration
+	DefaultTxPower = -45
+	// path loss exponent of the environment, 2 in free space, higher indoors
+	PathLossExponent = 2.7
+	// distance in meters below which a peer is immediate
+	ProximityImmediateDist = 1.0
+	// distance in meters below which a peer is near
+	ProximityNearDist = 5.0
+	// estimated distances are capped to this value in meters
+	MaxDistance = 1000.0
+	// smoothing factor of the RSSI moving average
+	SignalAlpha = 0.25
+	// process and measurement noise of the RSSI kalman filter
+	SignalProcessNoise = 0.5
+	SignalMeasureNoise = 8.0
+	// seconds of RSSI history kept for each peer, used for the min and max RSSI
+	SignalWindow = 30
+	// maximum number of RSSI samples kept for each peer, whatever the window
+	SignalMaxSamples = 1024
+)
+
+type SignalSample struct {
+	At   time.Time `json:"at"`
+	RSSI int       `json:"rssi"`
+}
+
+type SignalStatus struct {
+	EWMA      float64         `json:"ewma"`
+	Kalman    float64         `json:"kalman"`
+	Min       int             `json:"min"`
+	Max       int             `json:"max"`
+	TxPower   int             `json:"tx_power"`
+	Distance  float64         `json:"distance"`
+	Proximity Proximity       `json:"proximity"`
+	History   []*SignalSample `json:"history,omitempty"`
+}
+
+// signal filters the raw RSSI of the frames received from a peer.
+type signal struct {
+	ewma    float64
+	kalman  float64
+	errCov  float64
+	history []SignalSample
+}
+
+func newSignal(at time.Time, rssi int) *signal {
+	return &signal{
+		ewma:    float64(rssi),
+		kalman:  float64(rssi),
+		errCov:  SignalMeasureNoise,
+		history: []SignalSample{{At: at, RSSI: rssi}},
+	}
+}
+
+func (s *signal) sample(at time.Time, rssi int) {
+	value := float64(rssi)
+
+	s.ewma = SignalAlpha*value + (1-SignalAlpha)*s.ewma
+
+	// one dimensional kalman filter with a constant model
+	s.errCov += SignalProcessNoise
+	gain := s.errCov / (s.errCov + SignalMeasureNoise)
+	s.kalman += gain * (value - s.kalman)
+	s.errCov *= 1 - gain
+
+	s.history = append(s.history, SignalSample{At: at, RSSI: rssi})
+	s.prune(at)
+}
+
+// removes the samples older than the window, the last one is always kept
+func (s *signal) prune(now time.Time) {
+	from := now.Add(-time.Duration(SignalWindow) * time.Second)
+	expired := 0
+	for expired < len(s.history)-1 && s.history[expired].At.Before(from) {
+		expired++
+	}
+	if excess := len(s.history) - SignalMaxSamples; excess > expired {
+		expired = excess
+	}
+	if expired > 0 {
+		s.history = append(s.history[:0:0], s.history[expired:]...)
+	}
+}
+
+// estimated distance in meters using the log-distance path loss model, always finite so that it
+// can be serialized
+func EstimateDistance(rssi float64, txPower int) float64 {
+	if !(PathLossExponent > 0) {
+		return MaxDistance
+	}
+
+	distance := math.Pow(10, (float64(txPower)-rssi)/(10*PathLossExponent))
+	if math.IsNaN(distance) || distance > MaxDistance {
+		return MaxDistance
+	}
+	return distance
+}
+
+func ProximityOf(distance float64) Proximity {
+	if distance < ProximityImmediateDist {
+		return ProximityImmediate
+	} else if distance < ProximityNearDist {
+		return ProximityNear
+	}
+	return ProximityFar
+}
+
+// the samples are only included if history is true
+func (s *signal) status(now time.Time, txPower int, history bool) *SignalStatus {
+	st := &SignalStatus{
+		EWMA:    s.ewma,
+		Kalman:  s.kalman,
+		Min:     math.MaxInt32,
+		Max:     math.MinInt32,
+		TxPower: txPower,
+	}
+	if history {
+		st.History = make([]*SignalSample, 0, len(s.history))
+	}
+
+	from := now.Add(-time.Duration(SignalWindow) * time.Second)
+	for _, sample := range s.history {
+		if !sample.At.Before(from) {
+			if sample.RSSI < st.Min {
+				st.Min = sample.RSSI
+			}
+			if sample.RSSI > st.Max {
+				st.Max = sample.RSSI
+			}
+		}
+		if history {
+			copied := sample
+			st.History = append(st.History, &copied)
+		}
+	}
+
+	// nothing within the window, use the last sample
+	if st.Min > st.Max {
+		last := s.history[len(s.history)-1]
+		st.Min, st.Max = last.RSSI, last.RSSI
+	}
+
+	st.Distance = EstimateDistance(s.kalman, txPower)
+	st.Proximity = ProximityOf(st.Distance)
+
+	return st
+}
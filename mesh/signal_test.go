@@ -0,0 +1,146 @@
+package mesh
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSignalFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []int
+		ewma    float64
+		kalman  float64
+		// maximum distance from the expected values
+		tolerance float64
+	}{
+		{"single sample", []int{-60}, -60, -60, 0},
+		{"constant signal", []int{-60, -60, -60, -60}, -60, -60, 0},
+		{"converges to a step", append([]int{-80}, repeat(-50, 100)...), -50, -50, 0.5},
+		{"noise is smoothed", alternate(-50, -70, 100), -60, -60, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Now()
+			s := newSignal(now, test.samples[0])
+			for idx, rssi := range test.samples[1:] {
+				s.sample(now.Add(time.Duration(idx+1)*time.Second), rssi)
+			}
+
+			if math.Abs(s.ewma-test.ewma) > test.tolerance {
+				t.Fatalf("expected ewma %f, got %f", test.ewma, s.ewma)
+			} else if math.Abs(s.kalman-test.kalman) > test.tolerance {
+				t.Fatalf("expected kalman %f, got %f", test.kalman, s.kalman)
+			}
+		})
+	}
+}
+
+func TestSignalEWMA(t *testing.T) {
+	now := time.Now()
+	s := newSignal(now, -80)
+	s.sample(now, -40)
+
+	if expected := SignalAlpha*-40 + (1-SignalAlpha)*-80; s.ewma != expected {
+		t.Fatalf("expected ewma %f, got %f", expected, s.ewma)
+	}
+}
+
+func TestSignalWindow(t *testing.T) {
+	now := time.Now()
+	s := newSignal(now, -90)
+	for sec := 1; sec <= 2*SignalWindow; sec++ {
+		s.sample(now.Add(time.Duration(sec)*time.Second), -50-sec%10)
+	}
+
+	last := now.Add(time.Duration(2*SignalWindow) * time.Second)
+	for _, sample := range s.history {
+		if last.Sub(sample.At) > time.Duration(SignalWindow)*time.Second {
+			t.Fatalf("sample at %s is older than the window", sample.At)
+		}
+	}
+
+	st := s.status(last, DefaultTxPower, true)
+	if st.Min != -59 || st.Max != -50 {
+		t.Fatalf("expected min -59 and max -50, got %d and %d", st.Min, st.Max)
+	} else if len(st.History) != len(s.history) {
+		t.Fatalf("expected %d samples, got %d", len(s.history), len(st.History))
+	} else if st = s.status(last, DefaultTxPower, false); st.History != nil {
+		t.Fatalf("expected no history")
+	}
+
+	// the last sample is kept after a long silence
+	s.prune(last.Add(time.Hour))
+	if len(s.history) != 1 {
+		t.Fatalf("expected one sample, got %d", len(s.history))
+	}
+}
+
+func TestProximity(t *testing.T) {
+	tests := []struct {
+		rssi     float64
+		txPower  int
+		expected Proximity
+	}{
+		{-40, -45, ProximityImmediate},
+		{-45, -45, ProximityNear},
+		{-60, -45, ProximityNear},
+		{-80, -45, ProximityFar},
+	}
+
+	for _, test := range tests {
+		distance := EstimateDistance(test.rssi, test.txPower)
+		if proximity := ProximityOf(distance); proximity != test.expected {
+			t.Fatalf("rssi %f: expected %s, got %s (%fm)", test.rssi, test.expected, proximity, distance)
+		}
+	}
+}
+
+func TestEstimateDistance(t *testing.T) {
+	defer func(prev float64) { PathLossExponent = prev }(PathLossExponent)
+
+	tests := []struct {
+		name     string
+		exponent float64
+		rssi     float64
+		expected float64
+	}{
+		{"one meter", 2, -45, 1},
+		{"ten meters", 2, -65, 10},
+		{"capped", 2, -200, MaxDistance},
+		{"zero exponent", 0, -65, MaxDistance},
+		{"negative exponent", -2, -65, MaxDistance},
+		{"invalid rssi", 2, math.NaN(), MaxDistance},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			PathLossExponent = test.exponent
+			if distance := EstimateDistance(test.rssi, -45); math.Abs(distance-test.expected) > 0.001 {
+				t.Fatalf("expected %f meters, got %f", test.expected, distance)
+			}
+		})
+	}
+}
+
+func repeat(value, n int) []int {
+	list := make([]int, n)
+	for idx := range list {
+		list[idx] = value
+	}
+	return list
+}
+
+func alternate(a, b, n int) []int {
+	list := make([]int, n)
+	for idx := range list {
+		if idx%2 == 0 {
+			list[idx] = a
+		} else {
+			list[idx] = b
+		}
+	}
+	return list
+}
@@ -0,0 +1,240 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minimal implementation of the prometheus text exposition format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+var (
+	DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	lock       = sync.Mutex{}
+	families   = make(map[string]*family)
+	collectors = make([]func(), 0)
+)
+
+type series struct {
+	values  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+type family struct {
+	sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+func register(name, help, kind string, buckets []float64, labels []string) *family {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if f, found := families[name]; found {
+		return f
+	}
+
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	families[name] = f
+	return f
+}
+
+// to be called with the lock held
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, %d values given", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	s, found := f.series[key]
+	if !found {
+		s = &series{
+			values:  append([]string{}, values...),
+			buckets: make([]uint64, len(f.buckets)),
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+type Counter struct {
+	f *family
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{f: register(name, help, typeCounter, nil, labels)}
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) Add(v float64, values ...string) {
+	c.f.Lock()
+	defer c.f.Unlock()
+	c.f.with(values).value += v
+}
+
+type Gauge struct {
+	f *family
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{f: register(name, help, typeGauge, nil, labels)}
+}
+
+func (g *Gauge) Set(v float64, values ...string) {
+	g.f.Lock()
+	defer g.f.Unlock()
+	g.f.with(values).value = v
+}
+
+func (g *Gauge) Add(v float64, values ...string) {
+	g.f.Lock()
+	defer g.f.Unlock()
+	g.f.with(values).value += v
+}
+
+type Histogram struct {
+	f *family
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return &Histogram{f: register(name, help, typeHistogram, buckets, labels)}
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.f.Lock()
+	defer h.f.Unlock()
+
+	s := h.f.with(values)
+	s.value += v
+	s.count++
+	for idx, le := range h.f.buckets {
+		if v <= le {
+			s.buckets[idx]++
+		}
+	}
+}
+
+// registers a callback to update gauges right before the metrics are exported
+func OnCollect(cb func()) {
+	lock.Lock()
+	defer lock.Unlock()
+	collectors = append(collectors, cb)
+}
+
+func escape(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func labelsOf(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for idx, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape(values[idx])))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[0], escape(extra[1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+func (f *family) write(buf *bytes.Buffer) {
+	f.Lock()
+	defer f.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != typeHistogram {
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, labelsOf(f.labels, s.values), formatFloat(s.value))
+			continue
+		}
+
+		for idx, le := range f.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, labelsOf(f.labels, s.values, "le", formatFloat(le)), s.buckets[idx])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, labelsOf(f.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, labelsOf(f.labels, s.values), formatFloat(s.value))
+		fmt.Fprintf(buf, "%s_count%s %d\n", f.name, labelsOf(f.labels, s.values), s.count)
+	}
+}
+
+// writes every metric in the text exposition format
+func Handler(w http.ResponseWriter, r *http.Request) {
+	lock.Lock()
+	cbs := append([]func(){}, collectors...)
+	lock.Unlock()
+
+	for _, cb := range cbs {
+		cb()
+	}
+
+	lock.Lock()
+	list := make([]*family, 0, len(families))
+	for _, f := range families {
+		list = append(list, f)
+	}
+	lock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+
+	buf := new(bytes.Buffer)
+	for _, f := range list {
+		f.write(buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	counter := NewCounter("test_events_total", "Events.", "kind")
+	counter.Inc("b")
+	counter.Add(2, "a")
+	counter.Inc("b")
+
+	gauge := NewGauge("test_peers", "Peers.")
+	gauge.Set(3)
+	gauge.Add(-1)
+
+	escaped := NewGauge("test_escaped", "Escaped labels.", "value")
+	escaped.Set(1, "a\"b\\c\nd")
+
+	histogram := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+
+	collected := NewGauge("test_collected", "Set when collected.")
+	OnCollect(func() {
+		collected.Set(42)
+	})
+
+	rec := httptest.NewRecorder()
+	Handler(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+
+	expected := []string{
+		"# HELP test_collected Set when collected.\n# TYPE test_collected gauge\ntest_collected 42\n",
+		"# HELP test_escaped Escaped labels.\n# TYPE test_escaped gauge\ntest_escaped{value=\"a\\\"b\\\\c\\nd\"} 1\n",
+		"# HELP test_events_total Events.\n# TYPE test_events_total counter\n" +
+			"test_events_total{kind=\"a\"} 2\ntest_events_total{kind=\"b\"} 2\n",
+		"# HELP test_latency_seconds Latency.\n# TYPE test_latency_seconds histogram\n" +
+			"test_latency_seconds_bucket{le=\"0.1\"} 1\n" +
+			"test_latency_seconds_bucket{le=\"1\"} 2\n" +
+			"test_latency_seconds_bucket{le=\"+Inf\"} 3\n" +
+			"test_latency_seconds_sum 5.55\n" +
+			"test_latency_seconds_count 3\n",
+		"# HELP test_peers Peers.\n# TYPE test_peers gauge\ntest_peers 2\n",
+	}
+
+	// other tests might have registered their own metrics
+	body := rec.Body.String()
+	for _, family := range expected {
+		if !strings.Contains(body, family) {
+			t.Fatalf("expected:\n%s\ngot:\n%s", family, body)
+		}
+	}
+}
+
+func TestLabelsMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected a panic")
+		}
+	}()
+	NewCounter("test_mismatch_total", "Mismatch.", "a", "b").Inc("a")
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"time"
+)
+
+// Encounter is a verified proof that two units met, UnitID is always the lower of the two ids.
+type Encounter struct {
+	ID         uint       `gorm:"primary_key" json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"-"`
+	DeletedAt  *time.Time `sql:"index" json:"-"`
+	ProofID    string     `gorm:"size:64;not null;unique" json:"proof_id"`
+	UnitID     uint       `gorm:"index" json:"-"`
+	PeerID     uint       `gorm:"index" json:"-"`
+	MetAt      time.Time  `json:"met_at"`
+	Channel    int        `json:"channel"`
+	ReportedBy uint       `json:"-"`
+}
+
+type MetUnit struct {
+	Name        string    `json:"name"`
+	Fingerprint string    `json:"fingerprint"`
+	FirstMetAt  time.Time `json:"first_met_at"`
+	LastMetAt   time.Time `json:"last_met_at"`
+	Encounters  int       `json:"encounters"`
+}
+
+// stores a verified encounter, returns false if it was already known
+func RecordEncounter(proofID string, a, b *Unit, metAt time.Time, channel int, reporter *Unit) (bool, error) {
+	var existing Encounter
+	if err := db.Where("proof_id = ?", proofID).Take(&existing).Error; err == nil {
+		return false, nil
+	}
+
+	enc := Encounter{
+		ProofID:    proofID,
+		UnitID:     a.ID,
+		PeerID:     b.ID,
+		MetAt:      metAt,
+		Channel:    channel,
+		ReportedBy: reporter.ID,
+	}
+	if enc.UnitID > enc.PeerID {
+		enc.UnitID, enc.PeerID = enc.PeerID, enc.UnitID
+	}
+
+	if err := db.Create(&enc).Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// returns true if there's a verified encounter between the two units
+func (u *Unit) HasMet(other *Unit) bool {
+	low, high := u.ID, other.ID
+	if low > high {
+		low, high = high, low
+	}
+	count := 0
+	db.Model(Encounter{}).Where("unit_id = ? AND peer_id = ?", low, high).Count(&count)
+	return count > 0
+}
+
+// returns the units this unit has a verified encounter with
+func (u *Unit) MetUnits() ([]MetUnit, error) {
+	results := make([]MetUnit, 0)
+	err := db.Raw(`SELECT units.name, units.fingerprint, MIN(encounters.met_at) AS first_met_at,
+		MAX(encounters.met_at) AS last_met_at, COUNT(encounters.id) AS encounters
+		FROM encounters JOIN units ON units.id = IF(encounters.unit_id = ?, encounters.peer_id, encounters.unit_id)
+		WHERE (encounters.unit_id = ? OR encounters.peer_id = ?) AND encounters.deleted_at IS NULL AND units.deleted_at IS NULL
+		GROUP BY units.id ORDER BY last_met_at DESC`, u.ID, u.ID, u.ID).Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -21,7 +21,7 @@ func Setup() (err error) {
 	if db, err = gorm.Open("mysql", dbURL); err != nil {
 		return
 	}
-	db.Debug().AutoMigrate(&Unit{}, &AccessPoint{}, &Message{})
+	db.Debug().AutoMigrate(&Unit{}, &AccessPoint{}, &Message{}, &Encounter{})
 	return
 }
 
@@ -23,5 +23,6 @@ var (
 	SignatureAddr    = net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad}
 	SignatureAddrStr = "de:ad:be:ef:de:ad"
 	BroadcastAddr    = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	MulticastAddr    = net.HardwareAddr{0x01, 0xde, 0xad, 0xbe, 0xef, 0x01}
 	wpaFlags         = 1041
 )
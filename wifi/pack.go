@@ -35,8 +35,13 @@ func PackOneOf(from, to net.HardwareAddr, peerID []byte, signature []byte, strea
 		stack = append(stack, Info(IDWhisperIdentity, peerID))
 	}
 
-	if signature != nil {
-		stack = append(stack, Info(IDWhisperSignature, signature))
+	// signatures of large keys don't fit a single information element
+	for off := 0; off < len(signature); off += 0xff {
+		end := off + 0xff
+		if end > len(signature) {
+			end = len(signature)
+		}
+		stack = append(stack, Info(IDWhisperSignature, signature[off:end]))
 	}
 
 	if streamID > 0 {
@@ -1,6 +1,8 @@
 package wifi
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -32,3 +34,39 @@ func Unpack(pkt gopacket.Packet, radio *layers.RadioTap, dot11 *layers.Dot11) (e
 
 	return nil, payload
 }
+
+func infoOf(pkt gopacket.Packet, id layers.Dot11InformationElementID) (found bool, data []byte) {
+	for _, layer := range pkt.Layers() {
+		if layer.LayerType() == layers.LayerTypeDot11InformationElement {
+			if info, ok := layer.(*layers.Dot11InformationElement); ok && info.ID == id {
+				found = true
+				data = append(data, info.Info...)
+			}
+		}
+	}
+	return
+}
+
+// returns the signature of the frame, or nil if it's not signed
+func Signature(pkt gopacket.Packet) []byte {
+	_, signature := infoOf(pkt, IDWhisperSignature)
+	return signature
+}
+
+// returns the stream header of the frame, if it's part of a stream
+func Stream(pkt gopacket.Packet) (found bool, streamID uint64, seqNum uint64, seqTot uint64) {
+	found, header := infoOf(pkt, IDWhisperStreamHeader)
+	if !found {
+		return
+	}
+
+	buf := bytes.NewReader(header)
+	if err := binary.Read(buf, binary.LittleEndian, &streamID); err != nil {
+		return false, 0, 0, 0
+	} else if err = binary.Read(buf, binary.LittleEndian, &seqNum); err != nil {
+		return false, 0, 0, 0
+	} else if err = binary.Read(buf, binary.LittleEndian, &seqTot); err != nil {
+		return false, 0, 0, 0
+	}
+	return
+}